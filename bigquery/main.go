@@ -19,6 +19,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"os"
 	"regexp"
@@ -28,7 +29,6 @@ import (
 	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/civil"
 	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
-	log "github.com/golang/glog"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -54,7 +54,7 @@ const megaByte = int64(1000000)
 
 func main() {
 	if err := notifiers.Main(&bqNotifier{bqf: &actualBQFactory{}}); err != nil {
-		log.Fatalf("fatal error: %v", err)
+		notifiers.Fatalf(context.Background(), "fatal error: %v", err)
 	}
 }
 
@@ -65,6 +65,7 @@ type bqNotifier struct {
 	client   bq
 	br       notifiers.BindingResolver
 	tmplView *notifiers.TemplateView
+	secrets  *notifiers.TemplateSecrets
 }
 
 type bqRow struct {
@@ -157,7 +158,7 @@ func imageManifestToBuildImage(image string) (*buildImage, error) {
 	return &buildImage{SHA: sha.String(), ContainerSizeMB: containerSize}, nil
 }
 
-func (n *bqNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, bigQueryJson string, _ notifiers.SecretGetter, br notifiers.BindingResolver) error {
+func (n *bqNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, bigQueryJson string, sg notifiers.SecretGetter, br notifiers.BindingResolver) error {
 	prd, err := notifiers.MakeCELPredicate(cfg.Spec.Notification.Filter)
 	if err != nil {
 		return fmt.Errorf("failed to make a CEL predicate: %v", err)
@@ -186,8 +187,16 @@ func (n *bqNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, bigQueryJ
 		return err
 	}
 
-	tmpl, err := template.New("bq_json_template").Parse(bigQueryJson)
+	tmpl, err := template.New("bq_json_template").Funcs(notifiers.TemplateFuncs()).Parse(bigQueryJson)
+	if err != nil {
+		return fmt.Errorf("failed to parse BigQuery JSON template: %w", err)
+	}
 	n.tmpl = tmpl
+	secrets, err := notifiers.NewTemplateSecrets(ctx, sg, cfg, tmpl)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets used by the template: %w", err)
+	}
+	n.secrets = secrets
 	n.br = br
 
 	return nil
@@ -203,17 +212,17 @@ func parsePBTime(time *timestamppb.Timestamp) (civil.DateTime, error) {
 
 func (n *bqNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
 	if !n.filter.Apply(ctx, build) {
-		log.V(2).Infof("not doing BQ write for build %v", build.Id)
+		notifiers.Debugf(ctx, "not doing BQ write for build %v", build.Id)
 		return nil
 	}
 	if build.BuildTriggerId == "" {
-		log.Warningf("build passes filter but does not have a trigger ID. Build id: %q, status: %v", build.Id, build.GetStatus())
+		notifiers.Warningf(ctx, "build passes filter but does not have a trigger ID. Build id: %q, status: %v", build.Id, build.GetStatus())
 	}
 	if !terminalStatusCodes[build.Status] {
-		log.Infof("not writing to BigQuery for non-terminal build status %v", build.Status.String())
+		notifiers.Infof(ctx, "not writing to BigQuery for non-terminal build status %v", build.Status.String())
 		return nil
 	}
-	log.Infof("sending Big Query write for build %q (status: %q)", build.Id, build.Status)
+	notifiers.Infof(ctx, "sending Big Query write for build %q (status: %q)", build.Id, build.Status)
 	if build.ProjectId == "" {
 		return fmt.Errorf("build missing project id")
 	}
@@ -289,13 +298,18 @@ func (n *bqNotifier) SendNotification(ctx context.Context, build *cbpb.Build) er
 			return fmt.Errorf("failed to resolve bindings: %w", err)
 		}
 	}
+	secrets, err := n.secrets.Get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets used by the template: %w", err)
+	}
 
 	n.tmplView = &notifiers.TemplateView{
-		Build:  &notifiers.BuildView{Build: build},
-		Params: bindings,
+		Build:   &notifiers.BuildView{Build: build},
+		Params:  bindings,
+		Secrets: secrets,
 	}
 	var buf bytes.Buffer
-	if err := n.tmpl.Execute(&buf, n.tmplView); err != nil {
+	if err := notifiers.ExecuteTemplate(ctx, n.tmpl, &buf, n.tmplView); err != nil {
 		return err
 	}
 
@@ -317,12 +331,25 @@ func (n *bqNotifier) SendNotification(ctx context.Context, build *cbpb.Build) er
 	}
 	return n.client.WriteRow(ctx, newRow)
 }
+
+// Close closes the BigQuery client, if the notifier was set up.
+func (n *bqNotifier) Close() error {
+	if c, ok := n.client.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (bq *actualBQ) Close() error {
+	return bq.client.Close()
+}
+
 func (bq *actualBQ) EnsureDataset(ctx context.Context, datasetName string) error {
 	// Check for existence of dataset, create if false
 	bq.dataset = bq.client.Dataset(datasetName)
 	_, err := bq.client.Dataset(datasetName).Metadata(ctx)
 	if err != nil {
-		log.Warningf("error obtaining dataset metadata: %v;Creating new BigQuery dataset: %q", err, datasetName)
+		notifiers.Warningf(ctx, "error obtaining dataset metadata: %v;Creating new BigQuery dataset: %q", err, datasetName)
 		if err := bq.dataset.Create(ctx, &bigquery.DatasetMetadata{
 			Name: datasetName, Description: "BigQuery Notifier Build Data",
 		}); err != nil {
@@ -341,13 +368,13 @@ func (bq *actualBQ) EnsureTable(ctx context.Context, tableName string) error {
 	}
 	metadata, err := bq.dataset.Table(tableName).Metadata(ctx)
 	if err != nil {
-		log.Warningf("Error obtaining table metadata: %q;Creating new BigQuery table: %q", err, tableName)
+		notifiers.Warningf(ctx, "Error obtaining table metadata: %q;Creating new BigQuery table: %q", err, tableName)
 		// Create table if it does not exist.
 		if err := bq.table.Create(ctx, &bigquery.TableMetadata{Name: tableName, Description: "BigQuery Notifier Build Data Table", Schema: schema}); err != nil {
 			return fmt.Errorf("failed to initialize table %v: ", err)
 		}
 	} else if len(metadata.Schema) == 0 {
-		log.Warningf("No schema found for table, writing new schema for table: %v", tableName)
+		notifiers.Warningf(ctx, "No schema found for table, writing new schema for table: %v", tableName)
 		update := bigquery.TableMetadataToUpdate{
 			Schema: schema,
 		}
@@ -361,7 +388,7 @@ func (bq *actualBQ) EnsureTable(ctx context.Context, tableName string) error {
 
 func (bq *actualBQ) WriteRow(ctx context.Context, row *bqRow) error {
 	ins := bq.table.Inserter()
-	log.V(2).Infof("Writing row: %v", row)
+	notifiers.Debugf(ctx, "Writing row: %v", row)
 	if err := ins.Put(ctx, row); err != nil {
 		return fmt.Errorf("error inserting row into BQ: %v", err)
 	}
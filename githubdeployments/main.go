@@ -12,7 +12,6 @@ import (
 	cloudbuild "cloud.google.com/go/cloudbuild/apiv1"
 	"cloud.google.com/go/cloudbuild/apiv1/v2/cloudbuildpb"
 	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
-	log "github.com/golang/glog"
 	// deprecated "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
 )
 
@@ -23,7 +22,7 @@ const (
 
 func main() {
 	if err := notifiers.Main(new(githubdeploymentsNotifier)); err != nil {
-		log.Fatalf("fatal error: %v", err)
+		notifiers.Fatalf(context.Background(), "fatal error: %v", err)
 	}
 }
 
@@ -80,16 +79,22 @@ func (g *githubdeploymentsNotifier) SetUp(ctx context.Context, cfg *notifiers.Co
 	return nil
 }
 
-func (g *githubdeploymentsNotifier) SendNotification(ctx context.Context, build *cloudbuildpb.Build) error {
-	log.V(1).Infof("[DEBUG] at SendNotification: %+v", build)
+// Close closes the Cloud Build client, if the notifier was set up.
+func (g *githubdeploymentsNotifier) Close() error {
+	if g.cloudbuildClient == nil {
+		return nil
+	}
+	return g.cloudbuildClient.Close()
+}
 
+func (g *githubdeploymentsNotifier) SendNotification(ctx context.Context, build *cloudbuildpb.Build) error {
 	if !g.filter.Apply(ctx, build) {
-		log.V(2).Infof("not sending response for event (build id = %s, status = %v)", build.Id, build.Status)
+		notifiers.Debugf(ctx, "not sending response for event (build id = %s, status = %v)", build.Id, build.Status)
 		return nil
 	}
 
 	if build.BuildTriggerId == "" {
-		log.Warningf("build passes filter but does not have a trigger ID. Build id: %q, status: %v", build.Id, build.GetStatus())
+		notifiers.Warningf(ctx, "build passes filter but does not have a trigger ID. Build id: %q, status: %v", build.Id, build.GetStatus())
 		return nil
 	}
 
@@ -99,8 +104,7 @@ func (g *githubdeploymentsNotifier) SendNotification(ctx context.Context, build
 		return fmt.Errorf("failed to get Build Trigger info: %w", err)
 	}
 	if triggerInfo.GetGithub() == nil {
-		log.V(2).Infof("Skipped due to build trigger without github connection settings")
-		log.V(2).Infof("not sending response for event (build id = %s, status = %v)", build.Id, build.Status)
+		notifiers.Debugf(ctx, "not sending response for event (build id = %s, status = %v) since its trigger has no GitHub connection settings", build.Id, build.Status)
 		return nil
 	}
 
@@ -144,8 +148,7 @@ func (g *githubdeploymentsNotifier) SendNotification(ctx context.Context, build
 		}
 	}
 
-	log.Infof("sending GitHub Deployment webhook for Build %q (status: %q) to url %q", build.Id, build.Status, webhookURL)
-	log.V(1).Infof("payload: %q", payload)
+	notifiers.Infof(ctx, "sending GitHub Deployment webhook for Build %q (status: %q) to url %q", build.Id, build.Status, webhookURL)
 
 	logURL, err := notifiers.AddUTMParams(build.LogUrl, notifiers.HTTPMedium)
 	if err != nil {
@@ -171,11 +174,11 @@ func (g *githubdeploymentsNotifier) SendNotification(ctx context.Context, build
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		b, _ := httputil.DumpResponse(resp, true)
-		log.Warningf("got a non-OK response status %q (%d) from %q. response = %q", resp.Status, resp.StatusCode, webhookURL, string(b))
+		notifiers.Warningf(ctx, "got a non-OK response status %q (%d) from %q. response = %q", resp.Status, resp.StatusCode, webhookURL, string(b))
 		return fmt.Errorf("failed to api request: %q", string(b))
 	}
 
-	log.V(1).Infoln("send HTTP request successfully")
+	notifiers.Debugf(ctx, "send HTTP request successfully")
 	return nil
 }
 
@@ -202,7 +205,7 @@ func (g *githubdeploymentsNotifier) getDeploymentId(ctx context.Context, owner,
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Warningf("got a non-OK response status %q (%d) from %q", resp.Status, resp.StatusCode, webhookURL)
+		notifiers.Warningf(ctx, "got a non-OK response status %q (%d) from %q", resp.Status, resp.StatusCode, webhookURL)
 		return 0, fmt.Errorf("failed to call list deployments api: response status=%q, url=%q", resp.Status, webhookURL)
 	}
 
@@ -211,8 +214,6 @@ func (g *githubdeploymentsNotifier) getDeploymentId(ctx context.Context, owner,
 		return 0, fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	log.V(2).Infof("list deployments response: %+v", string(respBody))
-
 	type Deployment struct {
 		ID int `json:"id"`
 	}
@@ -18,13 +18,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"text/template"
 
 	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
-	log "github.com/golang/glog"
 
 	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
 )
@@ -36,18 +36,19 @@ const (
 
 func main() {
 	if err := notifiers.Main(new(githubissuesNotifier)); err != nil {
-		log.Fatalf("fatal error: %v", err)
+		notifiers.Fatalf(context.Background(), "fatal error: %v", err)
 	}
 }
 
 type githubissuesNotifier struct {
 	filter      notifiers.EventFilter
 	tmpl        *template.Template
-	githubToken string
+	githubToken *notifiers.SecretHandle
 	githubRepo  string
 
 	br       notifiers.BindingResolver
 	tmplView *notifiers.TemplateView
+	secrets  *notifiers.TemplateSecrets
 }
 
 type githubissuesMessage struct {
@@ -69,11 +70,16 @@ func (g *githubissuesNotifier) SetUp(ctx context.Context, cfg *notifiers.Config,
 	}
 	g.githubRepo = repo
 
-	tmpl, err := template.New("issue_template").Parse(issueTemplate)
+	tmpl, err := template.New("issue_template").Funcs(notifiers.TemplateFuncs()).Parse(issueTemplate)
 	if err != nil {
 		return fmt.Errorf("failed to parse issue body template: %w", err)
 	}
 	g.tmpl = tmpl
+	secrets, err := notifiers.NewTemplateSecrets(ctx, sg, cfg, tmpl)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets used by the template: %w", err)
+	}
+	g.secrets = secrets
 
 	wuRef, err := notifiers.GetSecretRef(cfg.Spec.Notification.Delivery, githubTokenSecretName)
 	if err != nil {
@@ -83,32 +89,37 @@ func (g *githubissuesNotifier) SetUp(ctx context.Context, cfg *notifiers.Config,
 	if err != nil {
 		return fmt.Errorf("failed to find Secret for ref %q: %w", wuRef, err)
 	}
-	wu, err := sg.GetSecret(ctx, wuResource)
-	if err != nil {
+	// Fetched on every send, so that a rotated token is picked up without a redeploy.
+	g.githubToken = notifiers.NewSecretHandle(sg, wuResource)
+	if _, err := g.githubToken.Get(ctx); err != nil {
 		return fmt.Errorf("failed to get token secret: %w", err)
 	}
-	g.githubToken = wu
 
 	return nil
 }
 
 func (g *githubissuesNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
 	if !g.filter.Apply(ctx, build) {
-		log.V(2).Infof("not sending response for event (build id = %s, status = %v)", build.Id, build.Status)
+		notifiers.Debugf(ctx, "not sending response for event (build id = %s, status = %v)", build.Id, build.Status)
 		return nil
 	}
 
 	webhookURL := fmt.Sprintf("%s/%s/issues", githubApiEndpoint, g.githubRepo)
 
-	log.Infof("sending GitHub Issue webhook for Build %q (status: %q) to url %q", build.Id, build.Status, webhookURL)
+	notifiers.Infof(ctx, "sending GitHub Issue webhook for Build %q (status: %q) to url %q", build.Id, build.Status, webhookURL)
 
 	bindings, err := g.br.Resolve(ctx, nil, build)
 	if err != nil {
-		log.Errorf("failed to resolve bindings :%v", err)
+		return notifiers.Permanent(fmt.Errorf("failed to resolve bindings: %w", err))
+	}
+	secrets, err := g.secrets.Get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets used by the template: %w", err)
 	}
 	g.tmplView = &notifiers.TemplateView{
-		Build:  &notifiers.BuildView{Build: build},
-		Params: bindings,
+		Build:   &notifiers.BuildView{Build: build},
+		Params:  bindings,
+		Secrets: secrets,
 	}
 	logURL, err := notifiers.AddUTMParams(build.LogUrl, notifiers.HTTPMedium)
 	if err != nil {
@@ -118,7 +129,7 @@ func (g *githubissuesNotifier) SendNotification(ctx context.Context, build *cbpb
 
 	payload := new(bytes.Buffer)
 	var buf bytes.Buffer
-	if err := g.tmpl.Execute(&buf, g.tmplView); err != nil {
+	if err := notifiers.ExecuteTemplate(ctx, g.tmpl, &buf, g.tmplView); err != nil {
 		return err
 	}
 	err = json.NewEncoder(payload).Encode(buf)
@@ -126,25 +137,41 @@ func (g *githubissuesNotifier) SendNotification(ctx context.Context, build *cbpb
 		return fmt.Errorf("failed to encode payload: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, strings.NewReader(buf.String()))
-	if err != nil {
-		return fmt.Errorf("failed to create a new HTTP request: %w", err)
-	}
-
-	req.Header.Set("Accept", "application/vnd.github.v3+json")
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", g.githubToken))
-	req.Header.Set("User-Agent", "GCB-Notifier/0.1 (http)")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to make HTTP request: %w", err)
+	post := func(token string) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, strings.NewReader(buf.String()))
+		if err != nil {
+			return fmt.Errorf("failed to create a new HTTP request: %w", err)
+		}
+
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", token))
+		req.Header.Set("User-Agent", "GCB-Notifier/0.1 (http)")
+
+		resp, err := notifiers.HTTPClient().Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to make HTTP request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusUnauthorized {
+			return notifiers.Permanent(errBadCredentials)
+		}
+		if err := notifiers.ResponseError(resp); err != nil {
+			return fmt.Errorf("failed to create GitHub issue with %q: %w", webhookURL, err)
+		}
+		return nil
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Warningf("got a non-OK response status %q (%d) from %q", resp.Status, resp.StatusCode, webhookURL)
+	if err := g.githubToken.Use(ctx, post, isBadCredentials); err != nil {
+		return err
 	}
 
-	log.V(2).Infoln("send HTTP request successfully")
+	notifiers.Debugf(ctx, "send HTTP request successfully")
 	return nil
 }
+
+// errBadCredentials is returned when GitHub rejects the token, e.g. because it was revoked or rotated.
+var errBadCredentials = errors.New("GitHub rejected the token (401 Unauthorized)")
+
+func isBadCredentials(err error) bool {
+	return errors.Is(err, errBadCredentials)
+}
@@ -17,6 +17,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"strings"
 	"testing"
 	"text/template"
@@ -161,3 +162,21 @@ func TestConfigs(t *testing.T) {
 		})
 	}
 }
+
+type failingResolver struct{}
+
+func (failingResolver) Resolve(context.Context, notifiers.SecretGetter, *cbpb.Build) (map[string]string, error) {
+	return nil, errors.New("failed to resolve param \"branch\"")
+}
+
+func TestSendNotificationResolveError(t *testing.T) {
+	prd, err := notifiers.MakeCELPredicate("true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &githubissuesNotifier{filter: prd, br: failingResolver{}}
+	err = n.SendNotification(context.Background(), &cbpb.Build{Id: "some-id"})
+	if err == nil || !notifiers.IsPermanent(err) {
+		t.Errorf("SendNotification got error %v, want a permanent error", err)
+	}
+}
@@ -18,11 +18,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
-	log "github.com/golang/glog"
 	chat "google.golang.org/api/chat/v1"
 
 	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
@@ -34,14 +35,14 @@ const (
 
 func main() {
 	if err := notifiers.Main(new(googlechatNotifier)); err != nil {
-		log.Fatalf("fatal error: %v", err)
+		notifiers.Fatalf(context.Background(), "fatal error: %v", err)
 	}
 }
 
 type googlechatNotifier struct {
 	filter notifiers.EventFilter
 
-	webhookURL string
+	webhookURL *notifiers.SecretHandle
 }
 
 func (g *googlechatNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, _ string, sg notifiers.SecretGetter, _ notifiers.BindingResolver) error {
@@ -59,11 +60,11 @@ func (g *googlechatNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, _
 	if err != nil {
 		return fmt.Errorf("failed to find Secret for ref %q: %w", wuRef, err)
 	}
-	wu, err := sg.GetSecret(ctx, wuResource)
-	if err != nil {
+	// Fetched on every send, so that a rotated webhook URL is picked up without a redeploy.
+	g.webhookURL = notifiers.NewSecretHandle(sg, wuResource)
+	if _, err := g.webhookURL.Get(ctx); err != nil {
 		return fmt.Errorf("failed to get token secret: %w", err)
 	}
-	g.webhookURL = wu
 
 	return nil
 }
@@ -73,41 +74,57 @@ func (g *googlechatNotifier) SendNotification(ctx context.Context, build *cbpb.B
 		return nil
 	}
 
-	log.Infof("sending Google Chat webhook for Build %q (status: %q)", build.Id, build.Status)
-	msg, err := g.writeMessage(build)
+	notifiers.Infof(ctx, "sending Google Chat webhook for Build %q (status: %q)", build.Id, build.Status)
+	msg, err := g.writeMessage(ctx, build)
 	if err != nil {
 		return fmt.Errorf("failed to write Google Chat message: %w", err)
 	}
 
-	payload := new(bytes.Buffer)
-	err = json.NewEncoder(payload).Encode(msg)
+	payload, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("failed to encode payload: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.webhookURL, payload)
-	if err != nil {
-		return fmt.Errorf("failed to create a new HTTP request: %w", err)
-	}
+	post := func(webhookURL string) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("failed to create a new HTTP request: %w", err)
+		}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "GCB-Notifier/0.1 (http)")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "GCB-Notifier/0.1 (http)")
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to make HTTP request: %w", err)
-	}
-	defer resp.Body.Close()
+		resp, err := notifiers.HTTPClient().Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to make HTTP request: %w", err)
+		}
+		defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Warningf("got a non-OK response status %q (%d) from %q", resp.Status, resp.StatusCode, g.webhookURL)
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return notifiers.Permanent(errRevokedWebhook)
+		}
+		if err := notifiers.ResponseError(resp); err != nil {
+			return fmt.Errorf("failed to post to the Google Chat webhook: %w", err)
+		}
+		return nil
+	}
+	if err := g.webhookURL.Use(ctx, post, isRevokedWebhook); err != nil {
+		return err
 	}
 
-	log.V(2).Infoln("send HTTP request successfully")
+	notifiers.Debugf(ctx, "send HTTP request successfully")
 	return nil
 }
 
-func (g *googlechatNotifier) writeMessage(build *cbpb.Build) (*chat.Message, error) {
+// errRevokedWebhook is returned when Google Chat rejects the webhook URL's key or token, e.g. because it was rotated.
+var errRevokedWebhook = errors.New("Google Chat rejected the webhook URL")
+
+func isRevokedWebhook(err error) bool {
+	return errors.Is(err, errRevokedWebhook)
+}
+
+func (g *googlechatNotifier) writeMessage(ctx context.Context, build *cbpb.Build) (*chat.Message, error) {
+	bv := &notifiers.BuildView{Build: build}
 
 	var icon string
 
@@ -122,19 +139,18 @@ func (g *googlechatNotifier) writeMessage(build *cbpb.Build) (*chat.Message, err
 		icon = "https://www.gstatic.com/images/icons/material/system/2x/question_mark_black_48dp.png"
 	}
 
-	logURL, err := notifiers.AddUTMParams(build.LogUrl, notifiers.ChatMedium)
+	logURL, err := notifiers.AddUTMParams(bv.ConsoleURL(), notifiers.ChatMedium)
 	if err != nil {
 		return nil, fmt.Errorf("failed to add UTM params: %w", err)
 	}
 
 	// Basic card setup
-	duration := build.GetFinishTime().AsTime().Sub(build.GetStartTime().AsTime())
-	duration_min, duration_sec := int(duration.Minutes()), int(duration.Seconds())-int(duration.Minutes())*60
-	duration_fmt := fmt.Sprintf("%d min %d sec", duration_min, duration_sec)
+	duration := bv.Duration()
+	duration_fmt := fmt.Sprintf("%d min %d sec", int(duration.Minutes()), int(duration.Seconds())%60)
 
 	card := &chat.Card{
 		Header: &chat.CardHeader{
-			Title:    fmt.Sprintf("Build %s Status: %s", build.Id[:8], build.Status),
+			Title:    fmt.Sprintf("%s Build %s Status: %s", bv.StatusEmoji(), bv.ShortID(), build.Status),
 			Subtitle: build.ProjectId,
 			ImageUrl: icon,
 		},
@@ -155,7 +171,7 @@ func (g *googlechatNotifier) writeMessage(build *cbpb.Build) (*chat.Message, err
 	// Optional section: display trigger information
 	if build.BuildTriggerId != "" {
 
-		log.Infof("Detected a build trigger id: %s", build.BuildTriggerId)
+		notifiers.Infof(ctx, "Detected a build trigger id: %s", build.BuildTriggerId)
 
 		/*
 			//TODO(glasnt): Get trigger information for Uri links.
@@ -165,25 +181,22 @@ func (g *googlechatNotifier) writeMessage(build *cbpb.Build) (*chat.Message, err
 			ctx := context.Background()
 			cbapi, _ := cloudbuild.NewClient(ctx)
 			trigger_info := cbapi.GetBuildTrigger(ctx, &cbpb.GetBuildTriggerRequest{ProjectId: build.ProjectId, TriggerId: build.BuildTriggerId,})
-			log.Infof("Trigger Repo URI: %s", trigger_info.??)
+			notifiers.Infof(ctx, "Trigger Repo URI: %s", trigger_info.??)
 		*/
 
-		repo_name := build.Substitutions["REPO_NAME"]
-		trigger_name := build.Substitutions["TRIGGER_NAME"]
+		repo_name := bv.RepoName()
+		trigger_name := bv.TriggerName()
 		commit := build.Substitutions["SHORT_SHA"]
 
 		// Branch, Tag, or None.
 		branch_tag_label := "Branch"
-		branch_tag_value := build.Substitutions["BRANCH_NAME"]
-
-		if branch_tag_value == "" {
+		branch_tag_value := bv.BranchOrTag()
+		switch {
+		case branch_tag_value == "":
+			branch_tag_label = "Branch/Tag"
+			branch_tag_value = "[no branch or tag]"
+		case build.Substitutions["BRANCH_NAME"] == "":
 			branch_tag_label = "Tag"
-			branch_tag_value = build.Substitutions["TAG_NAME"]
-
-			if branch_tag_value == "" {
-				branch_tag_label = "Branch/Tag"
-				branch_tag_value = "[no branch or tag]"
-			}
 		}
 
 		card.Header.Subtitle = fmt.Sprintf("%s on %s", trigger_name, build.ProjectId)
@@ -222,16 +235,25 @@ func (g *googlechatNotifier) writeMessage(build *cbpb.Build) (*chat.Message, err
 	}
 
 	// Optional section: display information about errors
-	if build.FailureInfo != nil {
+	failed_steps := bv.FailedSteps()
+	if build.FailureInfo != nil || len(failed_steps) > 0 {
 		failure_info := &chat.Section{
 			Header: "Error information",
-			Widgets: []*chat.WidgetMarkup{
-				{
-					TextParagraph: &chat.TextParagraph{
-						Text: build.FailureInfo.GetDetail(),
-					},
+		}
+		if build.FailureInfo != nil {
+			failure_info.Widgets = append(failure_info.Widgets, &chat.WidgetMarkup{
+				TextParagraph: &chat.TextParagraph{
+					Text: build.FailureInfo.GetDetail(),
 				},
-			},
+			})
+		}
+		if len(failed_steps) > 0 {
+			failure_info.Widgets = append(failure_info.Widgets, &chat.WidgetMarkup{
+				KeyValue: &chat.KeyValue{
+					TopLabel: "Failed steps",
+					Content:  strings.Join(failed_steps, ", "),
+				},
+			})
 		}
 		card.Sections = append(card.Sections, failure_info)
 	}
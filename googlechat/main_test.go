@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	chat "google.golang.org/api/chat/v1"
 	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestWriteMessage(t *testing.T) {
@@ -18,7 +21,7 @@ func TestWriteMessage(t *testing.T) {
 		LogUrl:    "https://some.example.com/log/url?foo=bar",
 	}
 
-	got, err := n.writeMessage(b)
+	got, err := n.writeMessage(context.Background(), b)
 	if err != nil {
 		t.Fatalf("writeMessage failed: %v", err)
 	}
@@ -28,7 +31,7 @@ func TestWriteMessage(t *testing.T) {
 			Header: &chat.CardHeader{
 				ImageUrl: "https://www.gstatic.com/images/icons/material/system/2x/check_circle_googgreen_48dp.png",
 				Subtitle: "my-project-id",
-				Title:    "Build some-bui Status: SUCCESS",
+				Title:    "✅ Build some-bui Status: SUCCESS",
 			},
 			Sections: []*chat.Section{
 				{
@@ -50,7 +53,7 @@ func TestWriteMessage(t *testing.T) {
 										Text: "open logs",
 										OnClick: &chat.OnClick{
 											OpenLink: &chat.OpenLink{
-												Url: "https://some.example.com/log/url?foo=bar&utm_campaign=google-cloud-build-notifiers&utm_medium=chat&utm_source=google-cloud-build",
+												Url: "https://console.cloud.google.com/cloud-build/builds/some-build-id?project=my-project-id&utm_campaign=google-cloud-build-notifiers&utm_medium=chat&utm_source=google-cloud-build",
 											},
 										},
 									},
@@ -68,3 +71,62 @@ func TestWriteMessage(t *testing.T) {
 	}
 
 }
+
+func TestWriteMessageTriggeredFailure(t *testing.T) {
+	n := new(googlechatNotifier)
+	start := time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC)
+	b := &cbpb.Build{
+		ProjectId:      "my-project-id",
+		Id:             "some-build-id",
+		Status:         cbpb.Build_FAILURE,
+		LogUrl:         "https://some.example.com/log/url",
+		BuildTriggerId: "some-trigger-id",
+		StartTime:      timestamppb.New(start),
+		FinishTime:     timestamppb.New(start.Add(2*time.Minute + 5*time.Second)),
+		Substitutions: map[string]string{
+			"TAG_NAME":     "v1.0.0",
+			"TRIGGER_NAME": "release",
+			"REPO_NAME":    "my-repo",
+			"SHORT_SHA":    "abc1234",
+		},
+		Steps:       []*cbpb.BuildStep{{Id: "test", Status: cbpb.Build_FAILURE}},
+		FailureInfo: &cbpb.Build_FailureInfo{Detail: "step test failed"},
+	}
+
+	got, err := n.writeMessage(context.Background(), b)
+	if err != nil {
+		t.Fatalf("writeMessage failed: %v", err)
+	}
+
+	card := got.Cards[0]
+	if want := "release on my-project-id"; card.Header.Subtitle != want {
+		t.Errorf("got subtitle %q, want %q", card.Header.Subtitle, want)
+	}
+	if want := "2 min 5 sec"; card.Sections[0].Widgets[0].KeyValue.Content != want {
+		t.Errorf("got duration %q, want %q", card.Sections[0].Widgets[0].KeyValue.Content, want)
+	}
+
+	wantTrigger := &chat.Section{
+		Header: "Trigger information",
+		Widgets: []*chat.WidgetMarkup{
+			{KeyValue: &chat.KeyValue{TopLabel: "Trigger", Content: "release"}},
+			{KeyValue: &chat.KeyValue{TopLabel: "Repo", Content: "my-repo"}},
+			{KeyValue: &chat.KeyValue{TopLabel: "Tag", Content: "v1.0.0"}},
+			{KeyValue: &chat.KeyValue{TopLabel: "Commit", Content: "abc1234"}},
+		},
+	}
+	if diff := cmp.Diff(wantTrigger, card.Sections[1]); diff != "" {
+		t.Errorf("writeMessage got unexpected trigger section (want- got+):\n%s", diff)
+	}
+
+	wantFailure := &chat.Section{
+		Header: "Error information",
+		Widgets: []*chat.WidgetMarkup{
+			{TextParagraph: &chat.TextParagraph{Text: "step test failed"}},
+			{KeyValue: &chat.KeyValue{TopLabel: "Failed steps", Content: "test"}},
+		},
+	}
+	if diff := cmp.Diff(wantFailure, card.Sections[2]); diff != "" {
+		t.Errorf("writeMessage got unexpected failure section (want- got+):\n%s", diff)
+	}
+}
@@ -24,13 +24,12 @@ import (
 	"text/template"
 
 	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
-	log "github.com/golang/glog"
 	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
 )
 
 func main() {
 	if err := notifiers.Main(new(httpNotifier)); err != nil {
-		log.Fatalf("fatal error: %v", err)
+		notifiers.Fatalf(context.Background(), "fatal error: %v", err)
 	}
 }
 
@@ -40,9 +39,10 @@ type httpNotifier struct {
 	url      string
 	br       notifiers.BindingResolver
 	tmplView *notifiers.TemplateView
+	secrets  *notifiers.TemplateSecrets
 }
 
-func (h *httpNotifier) SetUp(_ context.Context, cfg *notifiers.Config, httpTemplate string, _ notifiers.SecretGetter, br notifiers.BindingResolver) error {
+func (h *httpNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, httpTemplate string, sg notifiers.SecretGetter, br notifiers.BindingResolver) error {
 	prd, err := notifiers.MakeCELPredicate(cfg.Spec.Notification.Filter)
 	if err != nil {
 		return fmt.Errorf("failed to create CELPredicate: %w", err)
@@ -55,42 +55,52 @@ func (h *httpNotifier) SetUp(_ context.Context, cfg *notifiers.Config, httpTempl
 		return fmt.Errorf("expected delivery config %v to have string field `url`", cfg.Spec.Notification.Delivery)
 	}
 	h.url = url
-	tmpl, err := template.New("http_template").Parse(httpTemplate)
+	tmpl, err := template.New("http_template").Funcs(notifiers.TemplateFuncs()).Parse(httpTemplate)
 	if err != nil {
 		return fmt.Errorf("failed to parse template: %v", err)
 	}
 	h.tmpl = tmpl
+	secrets, err := notifiers.NewTemplateSecrets(ctx, sg, cfg, tmpl)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets used by the template: %w", err)
+	}
+	h.secrets = secrets
 
 	return nil
 }
 
 func (h *httpNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
 	if !h.filter.Apply(ctx, build) {
-		log.V(2).Infof("not sending HTTP request for event (build id = %s, status = %v)", build.Id, build.Status)
+		notifiers.Debugf(ctx, "not sending HTTP request for event (build id = %s, status = %v)", build.Id, build.Status)
 		return nil
 	}
 
-	log.Infof("sending HTTP request for event (build id = %s, status = %s)", build.Id, build.Status)
+	notifiers.Infof(ctx, "sending HTTP request for event (build id = %s, status = %s)", build.Id, build.Status)
 
 	bindings, err := h.br.Resolve(ctx, nil, build)
 	if err != nil {
-		return fmt.Errorf("failed to resolve bindings: %w", err)
+		return notifiers.Permanent(fmt.Errorf("failed to resolve bindings: %w", err))
+	}
+	secrets, err := h.secrets.Get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets used by the template: %w", err)
 	}
 	h.tmplView = &notifiers.TemplateView{
-		Build:  &notifiers.BuildView{Build: build},
-		Params: bindings,
+		Build:   &notifiers.BuildView{Build: build},
+		Params:  bindings,
+		Secrets: secrets,
 	}
 
 	logURL, err := notifiers.AddUTMParams(build.LogUrl, notifiers.HTTPMedium)
 	if err != nil {
-		return fmt.Errorf("failed to add UTM params: %w", err)
+		return notifiers.Permanent(fmt.Errorf("failed to add UTM params: %w", err))
 	}
 	build.LogUrl = logURL
 
 	payload := new(bytes.Buffer)
 	var buf bytes.Buffer
-	if err := h.tmpl.Execute(&buf, h.tmplView); err != nil {
-		return err
+	if err := notifiers.ExecuteTemplate(ctx, h.tmpl, &buf, h.tmplView); err != nil {
+		return notifiers.Permanent(fmt.Errorf("failed to execute template: %w", err))
 	}
 	err = json.NewEncoder(payload).Encode(buf)
 	if err != nil {
@@ -102,16 +112,16 @@ func (h *httpNotifier) SendNotification(ctx context.Context, build *cbpb.Build)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "GCB-Notifier/0.1 (http)")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := notifiers.HTTPClient().Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to make HTTP request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Warningf("got a non-OK response status %q (%d) from %q", resp.Status, resp.StatusCode, h.url)
+	if err := notifiers.ResponseError(resp); err != nil {
+		return fmt.Errorf("failed to send HTTP request to %q: %w", h.url, err)
 	}
 
-	log.V(2).Infoln("send HTTP request successfully")
+	notifiers.Debugf(ctx, "send HTTP request successfully")
 	return nil
 }
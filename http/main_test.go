@@ -16,11 +16,20 @@ package main
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
 )
 
+type noParamsResolver struct{}
+
+func (noParamsResolver) Resolve(context.Context, notifiers.SecretGetter, *cbpb.Build) (map[string]string, error) {
+	return nil, nil
+}
+
 func TestSetUp(t *testing.T) {
 	const url = "https://some.example.com/notify"
 
@@ -113,3 +122,59 @@ func TestSetUp(t *testing.T) {
 		})
 	}
 }
+
+func TestSendNotificationResponseStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		code          int
+		wantErr       bool
+		wantPermanent bool
+	}{{
+		name: "ok",
+		code: http.StatusOK,
+	}, {
+		name: "accepted",
+		code: http.StatusAccepted,
+	}, {
+		name:          "bad request",
+		code:          http.StatusBadRequest,
+		wantErr:       true,
+		wantPermanent: true,
+	}, {
+		name:    "too many requests",
+		code:    http.StatusTooManyRequests,
+		wantErr: true,
+	}, {
+		name:    "server error",
+		code:    http.StatusBadGateway,
+		wantErr: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tc.code)
+			}))
+			defer srv.Close()
+
+			cfg := &notifiers.Config{
+				Spec: &notifiers.Spec{
+					Notification: &notifiers.Notification{
+						Filter:   `build.status == Build.Status.SUCCESS`,
+						Delivery: map[string]interface{}{"url": srv.URL},
+					},
+				},
+			}
+			n := new(httpNotifier)
+			if err := n.SetUp(context.Background(), cfg, `{"id": "{{.Build.Id}}"}`, nil, noParamsResolver{}); err != nil {
+				t.Fatalf("SetUp failed: %v", err)
+			}
+
+			err := n.SendNotification(context.Background(), &cbpb.Build{Id: "some-id", Status: cbpb.Build_SUCCESS})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("SendNotification got error %v, want error = %v", err, tc.wantErr)
+			}
+			if got := notifiers.IsPermanent(err); got != tc.wantPermanent {
+				t.Errorf("IsPermanent(%v) = %v, want %v", err, got, tc.wantPermanent)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+// shortBuildIDLength is the length of the IDs returned by ShortID, matching the Cloud Console.
+const shortBuildIDLength = 8
+
+// buildNamePattern matches regional Build resource names, capturing the region.
+var buildNamePattern = regexp.MustCompile(`^projects/[^/]+/locations/([^/]+)/builds/[^/]+$`)
+
+var statusEmojis = map[cbpb.Build_Status]string{
+	cbpb.Build_QUEUED:         "⏳",
+	cbpb.Build_WORKING:        "🔨",
+	cbpb.Build_SUCCESS:        "✅",
+	cbpb.Build_FAILURE:        "❌",
+	cbpb.Build_INTERNAL_ERROR: "💥",
+	cbpb.Build_TIMEOUT:        "⏰",
+	cbpb.Build_CANCELLED:      "🚫",
+	cbpb.Build_EXPIRED:        "⌛",
+}
+
+// Duration returns how long the Build ran, or zero if it has not started or finished.
+func (b *BuildView) Duration() time.Duration {
+	if b.StartTime == nil || b.FinishTime == nil {
+		return 0
+	}
+	return b.FinishTime.AsTime().Sub(b.StartTime.AsTime())
+}
+
+// QueueDuration returns how long the Build waited before it started, or zero if it has not started.
+func (b *BuildView) QueueDuration() time.Duration {
+	if b.CreateTime == nil || b.StartTime == nil {
+		return 0
+	}
+	return b.StartTime.AsTime().Sub(b.CreateTime.AsTime())
+}
+
+// ShortID returns the first 8 characters of the Build's ID.
+func (b *BuildView) ShortID() string {
+	return truncate(shortBuildIDLength, b.Id)
+}
+
+// BranchOrTag returns the branch or, for Builds of a tag, the tag that the Build's trigger ran for. It is empty for
+// Builds that were not triggered by a push.
+func (b *BuildView) BranchOrTag() string {
+	if br := b.Substitutions["BRANCH_NAME"]; br != "" {
+		return br
+	}
+	return b.Substitutions["TAG_NAME"]
+}
+
+// TriggerName returns the name of the trigger that started the Build, or the empty string if it was not triggered.
+func (b *BuildView) TriggerName() string {
+	return b.Substitutions["TRIGGER_NAME"]
+}
+
+// RepoName returns the name of the repository that the Build's source came from, if known.
+func (b *BuildView) RepoName() string {
+	if r := b.Substitutions["REPO_NAME"]; r != "" {
+		return r
+	}
+	return b.GetSource().GetRepoSource().GetRepoName()
+}
+
+// FailedSteps returns the IDs (or names, for steps without an ID) of the Build's failed or timed out steps.
+func (b *BuildView) FailedSteps() []string {
+	steps := []string{}
+	for _, s := range b.Steps {
+		switch s.Status {
+		case cbpb.Build_FAILURE, cbpb.Build_INTERNAL_ERROR, cbpb.Build_TIMEOUT:
+			if s.Id != "" {
+				steps = append(steps, s.Id)
+			} else {
+				steps = append(steps, s.Name)
+			}
+		}
+	}
+	return steps
+}
+
+// IsTerminal returns true iff the Build's status is the last one it will have.
+func (b *BuildView) IsTerminal() bool {
+	return isTerminalStatus(b.Status)
+}
+
+// StatusEmoji returns an emoji for the Build's status, e.g. ✅ for SUCCESS and ❌ for FAILURE.
+func (b *BuildView) StatusEmoji() string {
+	if e, ok := statusEmojis[b.Status]; ok {
+		return e
+	}
+	return "❔"
+}
+
+// ConsoleURL returns the URL of the Build's page in the Cloud Console.
+func (b *BuildView) ConsoleURL() string {
+	path := "/cloud-build/builds"
+	if m := buildNamePattern.FindStringSubmatch(b.Name); m != nil {
+		path += ";region=" + m[1]
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     "console.cloud.google.com",
+		Path:     fmt.Sprintf("%s/%s", path, b.Id),
+		RawQuery: url.Values{"project": {b.ProjectId}}.Encode(),
+	}
+	return u.String()
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestBuildView(t *testing.T) {
+	created := time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC)
+	failed := &BuildView{Build: &cbpb.Build{
+		Id:         "0123456789abcdef",
+		ProjectId:  "my-project",
+		Name:       "projects/my-project/locations/europe-west1/builds/0123456789abcdef",
+		Status:     cbpb.Build_FAILURE,
+		CreateTime: timestamppb.New(created),
+		StartTime:  timestamppb.New(created.Add(10 * time.Second)),
+		FinishTime: timestamppb.New(created.Add(2 * time.Minute)),
+		Substitutions: map[string]string{
+			"BRANCH_NAME":  "main",
+			"TRIGGER_NAME": "deploy",
+			"REPO_NAME":    "my-repo",
+		},
+		Steps: []*cbpb.BuildStep{
+			{Id: "build", Status: cbpb.Build_SUCCESS},
+			{Id: "test", Status: cbpb.Build_FAILURE},
+			{Name: "gcr.io/cloud-builders/docker", Status: cbpb.Build_TIMEOUT},
+		},
+	}}
+	queued := &BuildView{Build: &cbpb.Build{
+		Id:            "abc",
+		ProjectId:     "my-project",
+		Status:        cbpb.Build_QUEUED,
+		CreateTime:    timestamppb.New(created),
+		Substitutions: map[string]string{"TAG_NAME": "v1.0.0"},
+		Source: &cbpb.Source{Source: &cbpb.Source_RepoSource{RepoSource: &cbpb.RepoSource{
+			RepoName: "source-repo",
+		}}},
+	}}
+
+	for _, tc := range []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{name: "Duration", got: failed.Duration(), want: 110 * time.Second},
+		{name: "Duration unfinished", got: queued.Duration(), want: time.Duration(0)},
+		{name: "QueueDuration", got: failed.QueueDuration(), want: 10 * time.Second},
+		{name: "QueueDuration unstarted", got: queued.QueueDuration(), want: time.Duration(0)},
+		{name: "ShortID", got: failed.ShortID(), want: "01234567"},
+		{name: "ShortID of short ID", got: queued.ShortID(), want: "abc"},
+		{name: "BranchOrTag branch", got: failed.BranchOrTag(), want: "main"},
+		{name: "BranchOrTag tag", got: queued.BranchOrTag(), want: "v1.0.0"},
+		{name: "TriggerName", got: failed.TriggerName(), want: "deploy"},
+		{name: "TriggerName untriggered", got: queued.TriggerName(), want: ""},
+		{name: "RepoName substitution", got: failed.RepoName(), want: "my-repo"},
+		{name: "RepoName source", got: queued.RepoName(), want: "source-repo"},
+		{name: "FailedSteps", got: failed.FailedSteps(), want: []string{"test", "gcr.io/cloud-builders/docker"}},
+		{name: "FailedSteps none", got: queued.FailedSteps(), want: []string{}},
+		{name: "IsTerminal", got: failed.IsTerminal(), want: true},
+		{name: "IsTerminal queued", got: queued.IsTerminal(), want: false},
+		{name: "StatusEmoji", got: failed.StatusEmoji(), want: "❌"},
+		{name: "StatusEmoji unknown", got: (&BuildView{Build: new(cbpb.Build)}).StatusEmoji(), want: "❔"},
+		{
+			name: "ConsoleURL regional",
+			got:  failed.ConsoleURL(),
+			want: "https://console.cloud.google.com/cloud-build/builds;region=europe-west1/0123456789abcdef?project=my-project",
+		},
+		{
+			name: "ConsoleURL global",
+			got:  queued.ConsoleURL(),
+			want: "https://console.cloud.google.com/cloud-build/builds/abc?project=my-project",
+		},
+	} {
+		if diff := cmp.Diff(tc.want, tc.got); diff != "" {
+			t.Errorf("%s got unexpected result (want- got+):\n%s", tc.name, diff)
+		}
+	}
+}
+
+func TestBuildViewInTemplate(t *testing.T) {
+	tmpl, err := template.New("t").Funcs(TemplateFuncs()).Parse(
+		`{{.Build.StatusEmoji}} {{.Build.ShortID}} on {{.Build.BranchOrTag}} took {{.Build.Duration}}` +
+			`{{if .Build.IsTerminal}} (done){{end}}: {{toJson .Build.FailedSteps}}`)
+	if err != nil {
+		t.Fatalf("failed to parse template: %v", err)
+	}
+	start := time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC)
+	view := &TemplateView{Build: &BuildView{Build: &cbpb.Build{
+		Id:            "0123456789abcdef",
+		Status:        cbpb.Build_SUCCESS,
+		StartTime:     timestamppb.New(start),
+		FinishTime:    timestamppb.New(start.Add(time.Minute)),
+		Substitutions: map[string]string{"BRANCH_NAME": "main"},
+	}}}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, view); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if want := "✅ 01234567 on main took 1m0s (done): []"; buf.String() != want {
+		t.Errorf("Execute = %q, want %q", buf.String(), want)
+	}
+}
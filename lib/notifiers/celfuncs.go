@@ -0,0 +1,133 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+// celNow returns the current time for the CEL functions. Replaced in tests.
+var celNow = time.Now
+
+var celBuildType = decls.NewObjectType(cloudBuildProtoPkg + ".Build")
+
+// celFunctionDecls declares the custom functions that CEL filters can call. Their implementations are in
+// celFunctionOverloads.
+var celFunctionDecls = []*exprpb.Decl{
+	// buildDuration(build) is how long the Build ran, or zero if it has not started or finished.
+	decls.NewFunction("buildDuration",
+		decls.NewOverload("buildDuration_build", []*exprpb.Type{celBuildType}, decls.Duration)),
+	// queueDuration(build) is how long the Build waited before it started, or zero if it has not started.
+	decls.NewFunction("queueDuration",
+		decls.NewOverload("queueDuration_build", []*exprpb.Type{celBuildType}, decls.Duration)),
+	// sub(build, key, default) is the Build's substitution for the key, or the default if it is missing or empty.
+	decls.NewFunction("sub",
+		decls.NewOverload("sub_build_string_string", []*exprpb.Type{celBuildType, decls.String, decls.String}, decls.String)),
+	// hasTag(build, re) is true iff any of the Build's tags matches the regular expression.
+	decls.NewFunction("hasTag",
+		decls.NewOverload("hasTag_build_string", []*exprpb.Type{celBuildType, decls.String}, decls.Bool)),
+	// failedSteps(build) lists the IDs (or names, for steps without an ID) of the Build's failed or timed out steps.
+	decls.NewFunction("failedSteps",
+		decls.NewOverload("failedSteps_build", []*exprpb.Type{celBuildType}, decls.NewListType(decls.String))),
+	// hourOfDay(tz) is the current hour (0-23) in the IANA time zone, e.g. "Europe/Berlin".
+	decls.NewFunction("hourOfDay",
+		decls.NewOverload("hourOfDay_string", []*exprpb.Type{decls.String}, decls.Int)),
+}
+
+var celFunctionOverloads = []*functions.Overload{{
+	Operator: "buildDuration_build",
+	Unary: func(v ref.Val) ref.Val {
+		b, ok := v.Value().(*cbpb.Build)
+		if !ok {
+			return types.MaybeNoSuchOverloadErr(v)
+		}
+		return types.Duration{Duration: (&BuildView{b}).Duration()}
+	},
+}, {
+	Operator: "queueDuration_build",
+	Unary: func(v ref.Val) ref.Val {
+		b, ok := v.Value().(*cbpb.Build)
+		if !ok {
+			return types.MaybeNoSuchOverloadErr(v)
+		}
+		return types.Duration{Duration: (&BuildView{b}).QueueDuration()}
+	},
+}, {
+	Operator: "sub_build_string_string",
+	Function: func(args ...ref.Val) ref.Val {
+		if len(args) != 3 {
+			return types.NoSuchOverloadErr()
+		}
+		b, ok := args[0].Value().(*cbpb.Build)
+		key, kok := args[1].(types.String)
+		def, dok := args[2].(types.String)
+		if !ok || !kok || !dok {
+			return types.NoSuchOverloadErr()
+		}
+		if s := b.Substitutions[string(key)]; s != "" {
+			return types.String(s)
+		}
+		return def
+	},
+}, {
+	Operator: "hasTag_build_string",
+	Binary: func(lhs, rhs ref.Val) ref.Val {
+		b, ok := lhs.Value().(*cbpb.Build)
+		re, rok := rhs.(types.String)
+		if !ok || !rok {
+			return types.NoSuchOverloadErr()
+		}
+		r, err := regexp.Compile(string(re))
+		if err != nil {
+			return types.NewErr("failed to compile hasTag regular expression %q: %v", re, err)
+		}
+		for _, t := range b.Tags {
+			if r.MatchString(t) {
+				return types.True
+			}
+		}
+		return types.False
+	},
+}, {
+	Operator: "failedSteps_build",
+	Unary: func(v ref.Val) ref.Val {
+		b, ok := v.Value().(*cbpb.Build)
+		if !ok {
+			return types.MaybeNoSuchOverloadErr(v)
+		}
+		return types.NewStringList(types.DefaultTypeAdapter, (&BuildView{b}).FailedSteps())
+	},
+}, {
+	Operator: "hourOfDay_string",
+	Unary: func(v ref.Val) ref.Val {
+		tz, ok := v.(types.String)
+		if !ok {
+			return types.MaybeNoSuchOverloadErr(v)
+		}
+		loc, err := time.LoadLocation(string(tz))
+		if err != nil {
+			return types.NewErr("failed to load time zone %q: %v", tz, err)
+		}
+		return types.Int(celNow().In(loc).Hour())
+	},
+}}
@@ -0,0 +1,179 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// celFixtureBuilds are the Builds that the CEL function tests run against.
+var celFixtureBuilds = func() map[string]*cbpb.Build {
+	created := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	return map[string]*cbpb.Build{
+		"finished": {
+			Id:         "finished",
+			Status:     cbpb.Build_FAILURE,
+			CreateTime: timestamppb.New(created),
+			StartTime:  timestamppb.New(created.Add(30 * time.Second)),
+			FinishTime: timestamppb.New(created.Add(30*time.Second + 12*time.Minute)),
+			Tags:       []string{"team-infra", "release-1.2"},
+			Substitutions: map[string]string{
+				"BRANCH_NAME": "main",
+				"TAG_NAME":    "",
+			},
+			Steps: []*cbpb.BuildStep{
+				{Id: "fetch", Name: "gcr.io/cloud-builders/git", Status: cbpb.Build_SUCCESS},
+				{Id: "test", Name: "golang", Status: cbpb.Build_FAILURE},
+				{Name: "gcr.io/cloud-builders/docker", Status: cbpb.Build_TIMEOUT},
+				{Id: "deploy", Name: "gcloud", Status: cbpb.Build_CANCELLED},
+			},
+		},
+		"queued": {
+			Id:         "queued",
+			Status:     cbpb.Build_QUEUED,
+			CreateTime: timestamppb.New(created),
+		},
+	}
+}()
+
+func TestCELFunctions(t *testing.T) {
+	ctx := context.Background()
+	defer func(now func() time.Time) { celNow = now }(celNow)
+	celNow = func() time.Time { return time.Date(2020, 6, 1, 22, 30, 0, 0, time.UTC) }
+
+	for _, tc := range []struct {
+		name      string
+		filter    string
+		build     string // Key in celFixtureBuilds.
+		wantMatch bool
+	}{{
+		name:      "buildDuration",
+		filter:    `buildDuration(build) == duration("12m")`,
+		build:     "finished",
+		wantMatch: true,
+	}, {
+		name:      "buildDuration of unfinished build",
+		filter:    `buildDuration(build) == duration("0s")`,
+		build:     "queued",
+		wantMatch: true,
+	}, {
+		name:      "queueDuration",
+		filter:    `queueDuration(build) > duration("10s") && queueDuration(build) < duration("1m")`,
+		build:     "finished",
+		wantMatch: true,
+	}, {
+		name:      "queueDuration of unstarted build",
+		filter:    `queueDuration(build) == duration("0s")`,
+		build:     "queued",
+		wantMatch: true,
+	}, {
+		name:      "sub present",
+		filter:    `sub(build, "BRANCH_NAME", "none") == "main"`,
+		build:     "finished",
+		wantMatch: true,
+	}, {
+		name:      "sub empty",
+		filter:    `sub(build, "TAG_NAME", "none") == "none"`,
+		build:     "finished",
+		wantMatch: true,
+	}, {
+		name:      "sub missing",
+		filter:    `sub(build, "BRANCH_NAME", "none") == "none"`,
+		build:     "queued",
+		wantMatch: true,
+	}, {
+		name:      "hasTag match",
+		filter:    `hasTag(build, "^release-[0-9.]+$")`,
+		build:     "finished",
+		wantMatch: true,
+	}, {
+		name:      "hasTag mismatch",
+		filter:    `hasTag(build, "^team-web$")`,
+		build:     "finished",
+		wantMatch: false,
+	}, {
+		name:      "hasTag bad regex",
+		filter:    `hasTag(build, "(")`,
+		build:     "finished",
+		wantMatch: false,
+	}, {
+		name:      "failedSteps",
+		filter:    `failedSteps(build) == ["test", "gcr.io/cloud-builders/docker"]`,
+		build:     "finished",
+		wantMatch: true,
+	}, {
+		name:      "failedSteps none",
+		filter:    `size(failedSteps(build)) == 0`,
+		build:     "queued",
+		wantMatch: true,
+	}, {
+		name:      "hourOfDay",
+		filter:    `hourOfDay("UTC") == 22`,
+		build:     "finished",
+		wantMatch: true,
+	}, {
+		name:      "hourOfDay other zone",
+		filter:    `hourOfDay("Asia/Tokyo") == 7`,
+		build:     "finished",
+		wantMatch: true,
+	}, {
+		name:      "hourOfDay bad zone",
+		filter:    `hourOfDay("Mars/Olympus_Mons") >= 0`,
+		build:     "finished",
+		wantMatch: false,
+	}} {
+		pred, err := MakeCELPredicate(tc.filter)
+		if err != nil {
+			t.Fatalf("%s: MakeCELPredicate(%q) failed: %v", tc.name, tc.filter, err)
+		}
+		if got := pred.Apply(ctx, celFixtureBuilds[tc.build]); got != tc.wantMatch {
+			t.Errorf("%s: Apply(%q) = %v, want %v", tc.name, tc.build, got, tc.wantMatch)
+		}
+	}
+}
+
+func TestCELFunctionsNotFolded(t *testing.T) {
+	defer func(now func() time.Time) { celNow = now }(celNow)
+	hour := 9
+	celNow = func() time.Time { return time.Date(2020, 6, 1, hour, 0, 0, 0, time.UTC) }
+
+	pred, err := MakeCELPredicate(`hourOfDay("UTC") == 9`)
+	if err != nil {
+		t.Fatalf("MakeCELPredicate failed: %v", err)
+	}
+	hour = 10
+	if pred.Apply(context.Background(), new(cbpb.Build)) {
+		t.Error("hourOfDay was evaluated when the predicate was made instead of when it was applied")
+	}
+}
+
+func TestCELFunctionErrors(t *testing.T) {
+	for _, filter := range []string{
+		`buildDuration("abc") > duration("1m")`,
+		`sub(build, "BRANCH_NAME") == "main"`,
+		`hasTag(build, 1)`,
+		`hourOfDay(build) == 1`,
+		`failedSteps(build) == 1`,
+	} {
+		if _, err := MakeCELPredicate(filter); err == nil {
+			t.Errorf("MakeCELPredicate(%q) unexpectedly succeeded", filter)
+		}
+	}
+}
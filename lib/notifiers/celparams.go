@@ -0,0 +1,104 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// celParamPrefix marks a Notification.Params value as a CEL expression instead of a JSONPath.
+const celParamPrefix = "cel:"
+
+// isCELParam returns true iff the given param value is a CEL expression.
+func isCELParam(path string) bool {
+	return strings.HasPrefix(path, celParamPrefix)
+}
+
+// celParam is a param whose value is computed by a CEL expression.
+type celParam struct {
+	prg  cel.Program
+	expr string // The user-provided expression, without the prefix.
+}
+
+// newCELParam compiles the given `cel:`-prefixed param value in the same env as filters.
+func newCELParam(env *cel.Env, path string) (*celParam, error) {
+	expr := strings.TrimSpace(strings.TrimPrefix(path, celParamPrefix))
+	ast, issues := env.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("failed to compile CEL expression %q: %w", expr, issues.Err())
+	}
+	prg, err := newCELProgram(env, ast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL program from expression %q: %w", expr, err)
+	}
+	return &celParam{prg: prg, expr: expr}, nil
+}
+
+// eval evaluates the expression for the given Build and returns its result as a string. The `params` variable is
+// always empty since params cannot refer to each other.
+func (c *celParam) eval(ctx context.Context, build *cbpb.Build) (string, error) {
+	out, _, err := c.prg.Eval(celActivation(ctx, build, map[string]string{}))
+	if err != nil {
+		return "", fmt.Errorf("failed to evaluate CEL expression %q: %w", c.expr, err)
+	}
+	s, err := celValueString(out)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert result of CEL expression %q to a string: %w", c.expr, err)
+	}
+	return s, nil
+}
+
+var structpbValueType = reflect.TypeOf(&structpb.Value{})
+
+// celValueString formats a CEL value the way JSONPath results are formatted: strings as-is, scalars in their usual
+// format and lists, maps and messages as JSON.
+func celValueString(v ref.Val) (string, error) {
+	switch v := v.(type) {
+	case types.String:
+		return string(v), nil
+	case types.Bytes:
+		return string(v), nil
+	case types.Bool, types.Int, types.Uint, types.Double:
+		return fmt.Sprint(v.Value()), nil
+	case types.Null:
+		return "null", nil
+	case types.Timestamp:
+		return v.Time.Format(time.RFC3339Nano), nil
+	case types.Duration:
+		return v.Duration.String(), nil
+	}
+
+	native, err := v.ConvertToNative(structpbValueType)
+	if err != nil {
+		return "", err
+	}
+	// Not using protojson since its output is deliberately unstable.
+	b, err := json.Marshal(native.(*structpb.Value).AsInterface())
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
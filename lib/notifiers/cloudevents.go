@@ -0,0 +1,109 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+const (
+	// cloudEventsContentType is the content type of CloudEvents delivered in structured mode.
+	cloudEventsContentType = "application/cloudevents+json"
+	// messagePublishedType is the CloudEvent type that Eventarc uses for Pub/Sub messages.
+	messagePublishedType = "google.cloud.pubsub.topic.v1.messagePublished"
+)
+
+// cloudEvent is a CloudEvent in the structured-mode JSON format.
+type cloudEvent struct {
+	SpecVersion string          `json:"specversion"`
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Data        json.RawMessage `json:"data,omitempty"`
+	DataBase64  string          `json:"data_base64,omitempty"`
+}
+
+// messagePublishedData is the data of a `google.cloud.pubsub.topic.v1.messagePublished` CloudEvent.
+type messagePublishedData struct {
+	Message struct {
+		Data        []byte            `json:"data,omitempty"`
+		Attributes  map[string]string `json:"attributes,omitempty"`
+		MessageID   string            `json:"messageId"`
+		PublishTime string            `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// isCloudEvent returns true iff the request holds a CloudEvent in either binary mode (with `ce-*` headers) or
+// structured mode (with the CloudEvents content type).
+func isCloudEvent(r *http.Request) bool {
+	if r.Header.Get("Ce-Specversion") != "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == cloudEventsContentType
+}
+
+// decodeCloudEvent returns the Pub/Sub message carried by the CloudEvent in the given request and body.
+func decodeCloudEvent(r *http.Request, body []byte) (*pubSubPushWrapper, error) {
+	var ce cloudEvent
+	if specVersion := r.Header.Get("Ce-Specversion"); specVersion != "" {
+		// In binary mode, the body is the event data and the attributes are headers.
+		ce = cloudEvent{
+			SpecVersion: specVersion,
+			ID:          r.Header.Get("Ce-Id"),
+			Type:        r.Header.Get("Ce-Type"),
+			Data:        body,
+		}
+	} else if err := json.Unmarshal(body, &ce); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal structured CloudEvent: %w", err)
+	}
+
+	if ce.Type != messagePublishedType {
+		return nil, fmt.Errorf("got unsupported CloudEvent type %q (expected %q)", ce.Type, messagePublishedType)
+	}
+
+	data := []byte(ce.Data)
+	if ce.DataBase64 != "" {
+		d, err := base64.StdEncoding.DecodeString(ce.DataBase64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode CloudEvent data_base64: %w", err)
+		}
+		data = d
+	}
+
+	var mpd messagePublishedData
+	if err := json.Unmarshal(data, &mpd); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal CloudEvent data: %w", err)
+	}
+
+	id := mpd.Message.MessageID
+	if id == "" {
+		// Eventarc uses the Pub/Sub message ID as the event ID.
+		id = ce.ID
+	}
+	return &pubSubPushWrapper{
+		Message: pubSubPushMessage{
+			Data:        mpd.Message.Data,
+			Attributes:  mpd.Message.Attributes,
+			ID:          id,
+			PublishTime: mpd.Message.PublishTime,
+		},
+		Subscription: mpd.Subscription,
+	}, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func TestNewReceiverCloudEvents(t *testing.T) {
+	sentBuild := &cbpb.Build{
+		ProjectId: "some-project-id",
+		Id:        "some-build-id",
+		Status:    cbpb.Build_SUCCESS,
+	}
+	sentJSON, err := protojson.Marshal(proto.MessageV2(sentBuild))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"data":        sentJSON,
+			"messageId":   "some-message-id",
+			"publishTime": "2021-04-01T00:00:00Z",
+		},
+		"subscription": "projects/some-project-id/subscriptions/eventarc-sub",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	structured := func(fields map[string]interface{}) string {
+		ce := map[string]interface{}{
+			"specversion": "1.0",
+			"id":          "some-message-id",
+			"source":      "//pubsub.googleapis.com/projects/some-project-id/topics/cloud-builds",
+			"type":        messagePublishedType,
+		}
+		for k, v := range fields {
+			ce[k] = v
+		}
+		j, err := json.Marshal(ce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(j)
+	}
+	binaryHeaders := map[string]string{
+		"Content-Type":   "application/json",
+		"Ce-Specversion": "1.0",
+		"Ce-Id":          "some-message-id",
+		"Ce-Source":      "//pubsub.googleapis.com/projects/some-project-id/topics/cloud-builds",
+		"Ce-Type":        messagePublishedType,
+	}
+
+	for _, tc := range []struct {
+		name      string
+		headers   map[string]string
+		body      string
+		wantCode  int
+		wantBuild bool
+	}{{
+		name:      "binary mode",
+		headers:   binaryHeaders,
+		body:      string(data),
+		wantCode:  http.StatusOK,
+		wantBuild: true,
+	}, {
+		name:      "structured mode",
+		headers:   map[string]string{"Content-Type": "application/cloudevents+json; charset=utf-8"},
+		body:      structured(map[string]interface{}{"data": json.RawMessage(data)}),
+		wantCode:  http.StatusOK,
+		wantBuild: true,
+	}, {
+		name:      "structured mode with base64 data",
+		headers:   map[string]string{"Content-Type": "application/cloudevents+json"},
+		body:      structured(map[string]interface{}{"data_base64": base64.StdEncoding.EncodeToString(data)}),
+		wantCode:  http.StatusOK,
+		wantBuild: true,
+	}, {
+		name:     "unsupported type",
+		headers:  map[string]string{"Content-Type": "application/cloudevents+json"},
+		body:     structured(map[string]interface{}{"type": "google.cloud.storage.object.v1.finalized", "data": json.RawMessage(data)}),
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "bad structured event",
+		headers:  map[string]string{"Content-Type": "application/cloudevents+json"},
+		body:     "not json",
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "bad binary data",
+		headers:  binaryHeaders,
+		body:     "not json",
+		wantCode: http.StatusBadRequest,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			bc := make(chan *cbpb.Build, 1)
+			handler := newReceiver(&fakeNotifier{notifs: bc}, &receiverParams{})
+			req := httptest.NewRequest(http.MethodPost, "http://notifer.example.com/", strings.NewReader(tc.body))
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+
+			handler(w, req)
+			if w.Code != tc.wantCode {
+				t.Errorf("got response code %d, want %d", w.Code, tc.wantCode)
+			}
+
+			select {
+			case got := <-bc:
+				if !tc.wantBuild {
+					t.Fatalf("got unexpected Build %v", got)
+				}
+				if diff := cmp.Diff(sentBuild, got, protocmp.Transform()); diff != "" {
+					t.Errorf("unexpected difference between published Build and received Build:\n%s", diff)
+				}
+			default:
+				if tc.wantBuild {
+					t.Error("notifier was not sent a Build")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// defaultHTTPSConfigTimeout bounds fetching a config or template over HTTPS, including reading its body.
+const defaultHTTPSConfigTimeout = 30 * time.Second
+
+// ConfigSource fetches the contents of a config or template file from some location.
+type ConfigSource interface {
+	// Open returns a reader for the contents at the given URI.
+	Open(ctx context.Context, uri string) (io.ReadCloser, error)
+}
+
+// versionedConfigSource is implemented by ConfigSources that can report the version of the contents at a URI without
+// reading them.
+type versionedConfigSource interface {
+	// Version returns an opaque string that changes whenever the contents at the given URI change.
+	Version(ctx context.Context, uri string) (string, error)
+}
+
+// gcsGenerationGetter is implemented by gcsReaderFactories that can look up the generation of a GCS object.
+type gcsGenerationGetter interface {
+	Generation(ctx context.Context, bucket, object string) (int64, error)
+}
+
+// listingConfigSource is implemented by ConfigSources that can list the files under a prefix, such as a GCS "folder"
+// or a local directory.
+type listingConfigSource interface {
+	// List returns the URIs of the files directly under the given URI, which ends with a `/`.
+	List(ctx context.Context, uri string) ([]string, error)
+}
+
+// gcsObjectLister is implemented by gcsReaderFactories that can list the GCS objects directly under a prefix.
+type gcsObjectLister interface {
+	List(ctx context.Context, bucket, prefix string) ([]string, error)
+}
+
+// hashContents returns the SHA-256 hash of the contents at the given URI for use as a version.
+func hashContents(ctx context.Context, src ConfigSource, uri string) (string, error) {
+	r, err := src.Open(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("failed to read %q: %w", uri, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// multiConfigSource is a ConfigSource that dispatches to other ConfigSources based on the URI scheme.
+type multiConfigSource struct {
+	schemes map[string]ConfigSource // Map of URI scheme => its ConfigSource.
+}
+
+// newConfigSource returns a ConfigSource that supports the following URIs:
+// - `gs://bucket/path/to/object` for GCS objects, using the given gcsReaderFactory.
+// - `file:///path/to/file` for local files.
+// - `https://example.com/path` for files served over HTTPS.
+// - `env://SOME_VAR` for contents stored in the environment variable `SOME_VAR`.
+func newConfigSource(grf gcsReaderFactory) ConfigSource {
+	return &multiConfigSource{schemes: map[string]ConfigSource{
+		"gs":    &gcsConfigSource{grf: grf},
+		"file":  new(fileConfigSource),
+		"https": &httpsConfigSource{client: &http.Client{Timeout: defaultHTTPSConfigTimeout}},
+		"env":   new(envConfigSource),
+	}}
+}
+
+func (m *multiConfigSource) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URI %q: %w", uri, err)
+	}
+
+	src, ok := m.schemes[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("got unsupported scheme %q in URI %q (expected one of `gs://`, `file://`, `https://` or `env://`)", u.Scheme, uri)
+	}
+	return src.Open(ctx, uri)
+}
+
+// Version returns the version of the contents at the given URI, falling back to a hash of the contents for sources
+// that do not support versions.
+func (m *multiConfigSource) Version(ctx context.Context, uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse URI %q: %w", uri, err)
+	}
+
+	src, ok := m.schemes[u.Scheme]
+	if !ok {
+		return "", fmt.Errorf("got unsupported scheme %q in URI %q", u.Scheme, uri)
+	}
+	if vs, ok := src.(versionedConfigSource); ok {
+		return vs.Version(ctx, uri)
+	}
+	return hashContents(ctx, src, uri)
+}
+
+// List lists the files under the given URI, if its source supports it.
+func (m *multiConfigSource) List(ctx context.Context, uri string) ([]string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URI %q: %w", uri, err)
+	}
+
+	src, ok := m.schemes[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("got unsupported scheme %q in URI %q", u.Scheme, uri)
+	}
+	ls, ok := src.(listingConfigSource)
+	if !ok {
+		return nil, fmt.Errorf("cannot list the files under %q (only `gs://` and `file://` URIs can be listed)", uri)
+	}
+	return ls.List(ctx, uri)
+}
+
+// gcsConfigSource is a ConfigSource for `gs://bucket/path/to/object` URIs.
+type gcsConfigSource struct {
+	grf gcsReaderFactory
+}
+
+// splitGCSPath returns the bucket and object of the given `gs://bucket/path/to/object` URI.
+func splitGCSPath(uri string) (string, string, error) {
+	if !gcsConfigPattern.MatchString(uri) {
+		return "", "", fmt.Errorf("expected path %q to match pattern %v", uri, gcsConfigPattern)
+	}
+	split := gcsConfigPattern.FindStringSubmatch(uri)
+	if len(split) != 3 {
+		return "", "", fmt.Errorf("path has incorrect format (expected form: `[gs://]bucket/path/to/object`): %q => %s", uri, strings.Join(split, ", "))
+	}
+	return split[1], split[2], nil
+}
+
+func (g *gcsConfigSource) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	bucket, object, err := splitGCSPath(uri)
+	if err != nil {
+		return nil, err
+	}
+	r, err := g.grf.NewReader(ctx, bucket, object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reader for (bucket=%q, object=%q): %w", bucket, object, err)
+	}
+	return r, nil
+}
+
+// Version returns the GCS generation of the object, if the gcsReaderFactory supports it.
+func (g *gcsConfigSource) Version(ctx context.Context, uri string) (string, error) {
+	gg, ok := g.grf.(gcsGenerationGetter)
+	if !ok {
+		return hashContents(ctx, g, uri)
+	}
+	bucket, object, err := splitGCSPath(uri)
+	if err != nil {
+		return "", err
+	}
+	gen, err := gg.Generation(ctx, bucket, object)
+	if err != nil {
+		return "", fmt.Errorf("failed to get generation of (bucket=%q, object=%q): %w", bucket, object, err)
+	}
+	return strconv.FormatInt(gen, 10), nil
+}
+
+// List returns the URIs of the objects directly under the given `gs://bucket/prefix/` URI, but not in its
+// "subdirectories", like fileConfigSource.List.
+func (g *gcsConfigSource) List(ctx context.Context, uri string) ([]string, error) {
+	gl, ok := g.grf.(gcsObjectLister)
+	if !ok {
+		return nil, fmt.Errorf("cannot list the objects under %q", uri)
+	}
+	bucket, prefix, err := splitGCSPath(uri)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := gl.List(ctx, bucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects under (bucket=%q, prefix=%q): %w", bucket, prefix, err)
+	}
+
+	var uris []string
+	for _, o := range objects {
+		// Skip the placeholder objects that the Cloud Console creates for folders.
+		if !strings.HasSuffix(o, "/") {
+			uris = append(uris, fmt.Sprintf("gs://%s/%s", bucket, o))
+		}
+	}
+	return uris, nil
+}
+
+// fileConfigSource is a ConfigSource for `file:///path/to/file` URIs.
+type fileConfigSource struct{}
+
+func (f *fileConfigSource) Open(_ context.Context, uri string) (io.ReadCloser, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URI %q: %w", uri, err)
+	}
+	// Host is non-empty for relative paths like `file://path/to/file`.
+	return os.Open(u.Host + u.Path)
+}
+
+// Version returns the modification time and size of the file.
+func (f *fileConfigSource) Version(_ context.Context, uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse URI %q: %w", uri, err)
+	}
+	fi, err := os.Stat(u.Host + u.Path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%d", fi.ModTime().UnixNano(), fi.Size()), nil
+}
+
+// List returns the URIs of the files (but not subdirectories) in the directory at the given URI.
+func (f *fileConfigSource) List(_ context.Context, uri string) ([]string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URI %q: %w", uri, err)
+	}
+	fis, err := ioutil.ReadDir(u.Host + u.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var uris []string
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			uris = append(uris, uri+fi.Name())
+		}
+	}
+	return uris, nil
+}
+
+// httpsConfigSource is a ConfigSource for `https://` URIs.
+type httpsConfigSource struct {
+	client *http.Client
+}
+
+func (h *httpsConfigSource) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a new HTTP request: %w", err)
+	}
+	req.Header.Set("User-Agent", "GCB-Notifier/0.1 (http)")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make HTTP request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("got a non-OK response status %q (%d) from %q", resp.Status, resp.StatusCode, uri)
+	}
+	return resp.Body, nil
+}
+
+// envConfigSource is a ConfigSource for `env://SOME_VAR` URIs, whose contents are the value of the environment
+// variable `SOME_VAR`.
+type envConfigSource struct{}
+
+func (e *envConfigSource) Open(_ context.Context, uri string) (io.ReadCloser, error) {
+	name := strings.TrimPrefix(uri, "env://")
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %q is not set", name)
+	}
+	return ioutil.NopCloser(bytes.NewBufferString(val)), nil
+}
+
+// lazyGCSReaderFactory is a gcsReaderFactory that only creates a GCS client once it is first needed, so that
+// notifiers that do not read from GCS do not need GCS credentials.
+type lazyGCSReaderFactory struct {
+	once   sync.Once
+	client *storage.Client
+	err    error
+}
+
+func (l *lazyGCSReaderFactory) factory(_ context.Context) (*actualGCSReaderFactory, error) {
+	l.once.Do(func() {
+		// Not the caller's context since the client outlives it and stops working once its context is canceled.
+		l.client, l.err = storage.NewClient(context.Background())
+	})
+	if l.err != nil {
+		return nil, fmt.Errorf("failed to create new GCS client: %w", l.err)
+	}
+	return &actualGCSReaderFactory{l.client}, nil
+}
+
+func (l *lazyGCSReaderFactory) NewReader(ctx context.Context, bucket, object string) (io.ReadCloser, error) {
+	f, err := l.factory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return f.NewReader(ctx, bucket, object)
+}
+
+func (l *lazyGCSReaderFactory) Generation(ctx context.Context, bucket, object string) (int64, error) {
+	f, err := l.factory(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return f.Generation(ctx, bucket, object)
+}
+
+func (l *lazyGCSReaderFactory) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	f, err := l.factory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return f.List(ctx, bucket, prefix)
+}
+
+// Close closes the underlying GCS client, if one was created.
+func (l *lazyGCSReaderFactory) Close() error {
+	if l.client == nil {
+		return nil
+	}
+	return l.client.Close()
+}
+
+// getConfig fetches the YAML Config file from the given URI and returns the parsed Config.
+func getConfig(ctx context.Context, src ConfigSource, uri string) (*Config, error) {
+	r, err := src.Open(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cfg, err := decodeConfig(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse configuration from YAML at %q: %w", uri, err)
+	}
+
+	return cfg, nil
+}
+
+// getTemplate fetches the Template file from the given URI and returns its contents.
+func getTemplate(ctx context.Context, src ConfigSource, uri string) (string, error) {
+	r, err := src.Open(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	tmpl, err := decodeTemplate(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template at %q: %w", uri, err)
+	}
+
+	return tmpl, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGetConfigFromSources(t *testing.T) {
+	validYAML := strings.ReplaceAll(validConfigYAMLWithTabs, "\t", "    " /* 4 spaces */)
+
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(cfgFile, []byte(validYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, validYAML)
+	}))
+	defer ts.Close()
+
+	const envVar = "NOTIFIERS_TEST_CONFIG"
+	os.Setenv(envVar, validYAML)
+	defer os.Unsetenv(envVar)
+
+	src := newConfigSource(&fakeGCSReaderFactory{
+		data: map[string]string{"gs://bucket/config.yaml": validYAML},
+	}).(*multiConfigSource)
+	src.schemes["https"] = &httpsConfigSource{client: ts.Client()}
+
+	for _, tc := range []struct {
+		name      string
+		uri       string
+		wantError bool
+	}{{
+		name: "gcs",
+		uri:  "gs://bucket/config.yaml",
+	}, {
+		name: "file",
+		uri:  "file://" + cfgFile,
+	}, {
+		name: "https",
+		uri:  ts.URL + "/config.yaml",
+	}, {
+		name: "env",
+		uri:  "env://" + envVar,
+	}, {
+		name:      "missing file",
+		uri:       "file://" + filepath.Join(dir, "nowhere.yaml"),
+		wantError: true,
+	}, {
+		name:      "https not found",
+		uri:       ts.URL + "/nowhere.yaml",
+		wantError: true,
+	}, {
+		name:      "unset env var",
+		uri:       "env://NOTIFIERS_TEST_UNSET_VAR",
+		wantError: true,
+	}, {
+		name:      "plain http",
+		uri:       "http://example.com/config.yaml",
+		wantError: true,
+	}, {
+		name:      "no scheme",
+		uri:       "/path/to/config.yaml",
+		wantError: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getConfig(context.Background(), src, tc.uri)
+			if err != nil {
+				if tc.wantError {
+					t.Logf("got expected error: %v", err)
+					return
+				}
+				t.Fatalf("getConfig(%q) failed: %v", tc.uri, err)
+			}
+			if tc.wantError {
+				t.Fatalf("getConfig(%q) succeeded unexpectedly", tc.uri)
+			}
+
+			if diff := cmp.Diff(validConfig, got); diff != "" {
+				t.Errorf("getConfig(%q) produced unexpected Config diff: (want- got+)\n%s", tc.uri, diff)
+			}
+		})
+	}
+}
+
+func TestParseTemplateFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "template.json")
+	if err := ioutil.WriteFile(path, []byte("{{.Build.Status}}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parseTemplate(context.Background(), &Template{Type: "golang", URI: "file://" + path}, newConfigSource(nil))
+	if err != nil {
+		t.Fatalf("parseTemplate failed: %v", err)
+	}
+	if got != "{{.Build.Status}}" {
+		t.Errorf("parseTemplate = %q, want %q", got, "{{.Build.Status}}")
+	}
+}
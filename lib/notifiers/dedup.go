@@ -0,0 +1,400 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+const (
+	defaultDedupTTL        = time.Hour
+	defaultDedupMaxEntries = 10000
+)
+
+// DedupConfig is the data container for the `spec.dedup` section of the config, which configures dropping of
+// redelivered Pub/Sub messages and repeated Build statuses.
+type DedupConfig struct {
+	// Store is one of `memory` (the default) or `file`.
+	Store string `yaml:"store"`
+	// TTL is how long a message or Build status is remembered for, e.g. `30m`. Defaults to one hour.
+	TTL string `yaml:"ttl"`
+	// MaxEntries bounds the number of keys kept by the `memory` store. Defaults to 10000.
+	MaxEntries int `yaml:"maxEntries"`
+	// Path is the file used by the `file` store.
+	Path string `yaml:"path"`
+}
+
+// DedupStore remembers keys for some amount of time.
+type DedupStore interface {
+	// Contains returns true iff the given key was added and has not expired yet.
+	Contains(ctx context.Context, key string) (bool, error)
+	// Add records the given key.
+	Add(ctx context.Context, key string) error
+}
+
+// deduper drops Pub/Sub messages that have already been handled, either because the message itself was redelivered or
+// because Cloud Build published the same status for a Build more than once.
+type deduper struct {
+	store DedupStore
+
+	mtx      sync.Mutex
+	reserved map[string]bool // Keys of the messages that are being handled.
+}
+
+// newDeduper returns a deduper for the given config, or nil if the config is nil.
+func newDeduper(cfg *DedupConfig) (*deduper, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	ttl := defaultDedupTTL
+	if cfg.TTL != "" {
+		d, err := time.ParseDuration(cfg.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse dedup TTL %q: %w", cfg.TTL, err)
+		}
+		ttl = d
+	}
+
+	switch cfg.Store {
+	case "", "memory":
+		maxEntries := defaultDedupMaxEntries
+		if cfg.MaxEntries > 0 {
+			maxEntries = cfg.MaxEntries
+		}
+		return &deduper{store: NewMemoryDedupStore(maxEntries, ttl)}, nil
+	case "file":
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("expected dedup config %+v to have a `path` for the file store", cfg)
+		}
+		s, err := NewFileDedupStore(cfg.Path, ttl)
+		if err != nil {
+			return nil, err
+		}
+		return &deduper{store: s}, nil
+	default:
+		return nil, fmt.Errorf("got unknown dedup store %q", cfg.Store)
+	}
+}
+
+// keys returns the dedup keys for the given Pub/Sub message ID and Build. Empty IDs do not produce a key.
+func (d *deduper) keys(msgID string, build *cbpb.Build) []string {
+	var keys []string
+	if msgID != "" {
+		keys = append(keys, "message/"+msgID)
+	}
+	if build.Id != "" {
+		keys = append(keys, fmt.Sprintf("build/%s/%s", build.Id, build.Status))
+	}
+	return keys
+}
+
+// dedupState is the state of a Pub/Sub message according to a deduper.
+type dedupState int
+
+const (
+	dedupNew      dedupState = iota // Not handled yet. Its keys are now reserved until released.
+	dedupHandled                    // The message or its Build status was already handled.
+	dedupInFlight                   // The message or its Build status is being handled by another call.
+)
+
+// reserve returns the state of the given message and Build status. If it is new, its keys are reserved so that
+// concurrent deliveries of the same message or Build status see it as in flight until release is called. Checking and
+// reserving is atomic within this process. If the store fails, the message is reserved and treated as new along with
+// the error.
+func (d *deduper) reserve(ctx context.Context, msgID string, build *cbpb.Build) (dedupState, error) {
+	keys := d.keys(msgID, build)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, k := range keys {
+		if d.reserved[k] {
+			return dedupInFlight, nil
+		}
+	}
+
+	var err error
+	for _, k := range keys {
+		ok, cerr := d.store.Contains(ctx, k)
+		if cerr != nil {
+			err = fmt.Errorf("failed to look up dedup key %q: %w", k, cerr)
+			break
+		}
+		if ok {
+			return dedupHandled, nil
+		}
+	}
+
+	if d.reserved == nil {
+		d.reserved = map[string]bool{}
+	}
+	for _, k := range keys {
+		d.reserved[k] = true
+	}
+	return dedupNew, err
+}
+
+// release drops the reservation made by reserve. Messages that were not marked as handled first can be handled again,
+// e.g. when they are redelivered after a retryable failure.
+func (d *deduper) release(msgID string, build *cbpb.Build) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, k := range d.keys(msgID, build) {
+		delete(d.reserved, k)
+	}
+}
+
+// Close closes the store if it implements io.Closer.
+func (d *deduper) Close() error {
+	if c, ok := d.store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// markHandled records the given message and Build status as handled.
+func (d *deduper) markHandled(ctx context.Context, msgID string, build *cbpb.Build) error {
+	for _, k := range d.keys(msgID, build) {
+		if err := d.store.Add(ctx, k); err != nil {
+			return fmt.Errorf("failed to add dedup key %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+type memoryDedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+// memoryDedupStore is an in-memory LRU DedupStore whose keys also expire after a TTL.
+type memoryDedupStore struct {
+	mtx        sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	lru        *list.List               // Most recently used entries first.
+	entries    map[string]*list.Element // Map of key => its element in lru.
+	now        func() time.Time
+}
+
+// NewMemoryDedupStore returns an in-memory DedupStore that keeps at most maxEntries keys, each for at most the given TTL.
+func NewMemoryDedupStore(maxEntries int, ttl time.Duration) DedupStore {
+	return &memoryDedupStore{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+		now:        time.Now,
+	}
+}
+
+func (m *memoryDedupStore) Contains(_ context.Context, key string) (bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return false, nil
+	}
+	if m.now().After(el.Value.(*memoryDedupEntry).expires) {
+		m.lru.Remove(el)
+		delete(m.entries, key)
+		return false, nil
+	}
+	m.lru.MoveToFront(el)
+	return true, nil
+}
+
+func (m *memoryDedupStore) Add(_ context.Context, key string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	expires := m.now().Add(m.ttl)
+	if el, ok := m.entries[key]; ok {
+		el.Value.(*memoryDedupEntry).expires = expires
+		m.lru.MoveToFront(el)
+		return nil
+	}
+
+	m.entries[key] = m.lru.PushFront(&memoryDedupEntry{key: key, expires: expires})
+	for m.lru.Len() > m.maxEntries {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryDedupEntry).key)
+	}
+	return nil
+}
+
+type fileDedupEntry struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+// minDedupCompactionLines is the number of lines the dedup file needs to have before it is compacted while open.
+const minDedupCompactionLines = 1000
+
+// fileDedupStore is a DedupStore that appends its keys to a file as JSON lines so that they survive restarts.
+// Expired and overwritten keys are dropped from the file when the store is opened and, once the file has grown past
+// minDedupCompactionLines, whenever it holds more than twice as many lines as keys or a TTL passed since the last
+// compaction.
+type fileDedupStore struct {
+	mtx       sync.Mutex
+	path      string
+	ttl       time.Duration
+	f         *os.File
+	lines     int                  // The number of lines in f.
+	compacted time.Time            // When f was last compacted.
+	entries   map[string]time.Time // Map of key => expiration time.
+	now       func() time.Time
+}
+
+// NewFileDedupStore returns a DedupStore backed by the file at the given path, which is created if it does not exist.
+// The returned store implements io.Closer.
+func NewFileDedupStore(path string, ttl time.Duration) (DedupStore, error) {
+	return newFileDedupStore(path, ttl, time.Now)
+}
+
+func newFileDedupStore(path string, ttl time.Duration, now func() time.Time) (*fileDedupStore, error) {
+	entries := map[string]time.Time{}
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var e fileDedupEntry
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				Warningf(context.Background(), "skipping bad dedup entry %q in %q: %v", sc.Text(), path, err)
+				continue
+			}
+			if e.Expires.After(now()) {
+				entries[e.Key] = e.Expires
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read dedup file %q: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open dedup file %q: %w", path, err)
+	}
+
+	s := &fileDedupStore{
+		path:    path,
+		ttl:     ttl,
+		entries: entries,
+		now:     now,
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compact drops the expired entries and rewrites the file down to the remaining ones. It must be called with the
+// lock held (or before the store is shared).
+func (s *fileDedupStore) compact() error {
+	for k, exp := range s.entries {
+		if !exp.After(s.now()) {
+			delete(s.entries, k)
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary dedup file: %w", err)
+	}
+	enc := json.NewEncoder(tmp)
+	for k, exp := range s.entries {
+		if err := enc.Encode(&fileDedupEntry{Key: k, Expires: exp}); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return fmt.Errorf("failed to write dedup entry: %w", err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to close temporary dedup file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace dedup file %q: %w", s.path, err)
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open dedup file %q for appending: %w", s.path, err)
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f, s.lines, s.compacted = f, len(s.entries), s.now()
+	return nil
+}
+
+func (s *fileDedupStore) Contains(_ context.Context, key string) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	exp, ok := s.entries[key]
+	if !ok {
+		return false, nil
+	}
+	if s.now().After(exp) {
+		delete(s.entries, key)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *fileDedupStore) Add(ctx context.Context, key string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	exp := s.now().Add(s.ttl)
+	b, err := json.Marshal(&fileDedupEntry{Key: key, Expires: exp})
+	if err != nil {
+		return fmt.Errorf("failed to encode dedup entry: %w", err)
+	}
+	if _, err := s.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write dedup entry: %w", err)
+	}
+	s.entries[key] = exp
+	s.lines++
+
+	if s.lines >= minDedupCompactionLines && (s.lines > 2*len(s.entries) || s.now().Sub(s.compacted) >= s.ttl) {
+		// The key was already written, so failing to compact only means the file stays large for now.
+		if err := s.compact(); err != nil {
+			Warningf(ctx, "failed to compact dedup file %q: %v", s.path, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the file. The store must not be used afterwards.
+func (s *fileDedupStore) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.f.Close()
+}
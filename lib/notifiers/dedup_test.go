@@ -0,0 +1,303 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// fakeClock is a settable time source for tests.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func mustContain(t *testing.T, s DedupStore, key string, want bool) {
+	t.Helper()
+	got, err := s.Contains(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Contains(%q) failed: %v", key, err)
+	}
+	if got != want {
+		t.Errorf("Contains(%q) = %v, want %v", key, got, want)
+	}
+}
+
+func mustAdd(t *testing.T, s DedupStore, key string) {
+	t.Helper()
+	if err := s.Add(context.Background(), key); err != nil {
+		t.Fatalf("Add(%q) failed: %v", key, err)
+	}
+}
+
+func TestMemoryDedupStore(t *testing.T) {
+	clk := &fakeClock{t: time.Unix(1000, 0)}
+	s := NewMemoryDedupStore(2, time.Minute).(*memoryDedupStore)
+	s.now = clk.now
+
+	mustContain(t, s, "a", false)
+	mustAdd(t, s, "a")
+	mustAdd(t, s, "b")
+	mustContain(t, s, "a", true)
+
+	// "b" is now the least recently used key, so it is evicted.
+	mustAdd(t, s, "c")
+	mustContain(t, s, "b", false)
+	mustContain(t, s, "a", true)
+	mustContain(t, s, "c", true)
+
+	clk.t = clk.t.Add(2 * time.Minute)
+	mustContain(t, s, "a", false)
+	mustContain(t, s, "c", false)
+}
+
+func TestFileDedupStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.jsonl")
+	clk := &fakeClock{t: time.Unix(1000, 0)}
+
+	s, err := newFileDedupStore(path, time.Minute, clk.now)
+	if err != nil {
+		t.Fatalf("newFileDedupStore failed: %v", err)
+	}
+	mustContain(t, s, "a", false)
+	mustAdd(t, s, "a")
+	clk.t = clk.t.Add(30 * time.Second)
+	mustAdd(t, s, "b")
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Reopening the store should keep the unexpired keys.
+	clk.t = clk.t.Add(45 * time.Second)
+	s, err = newFileDedupStore(path, time.Minute, clk.now)
+	if err != nil {
+		t.Fatalf("newFileDedupStore failed: %v", err)
+	}
+	defer s.Close()
+	mustContain(t, s, "a", false)
+	mustContain(t, s, "b", true)
+
+	if len(s.entries) != 1 {
+		t.Errorf("expected expired entries to be compacted away, got %v", s.entries)
+	}
+}
+
+func TestFileDedupStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.jsonl")
+	clk := &fakeClock{t: time.Unix(1000, 0)}
+
+	s, err := newFileDedupStore(path, time.Minute, clk.now)
+	if err != nil {
+		t.Fatalf("newFileDedupStore failed: %v", err)
+	}
+	defer s.Close()
+
+	// Overwriting the same keys should compact the file once it has more than twice as many lines as keys.
+	for i := 0; i < minDedupCompactionLines; i++ {
+		mustAdd(t, s, fmt.Sprintf("key-%d", i%10))
+	}
+	if s.lines >= minDedupCompactionLines {
+		t.Errorf("expected overwritten keys to be compacted away, got %d lines", s.lines)
+	}
+
+	// Unique keys should be compacted away once they expire.
+	for i := 0; i < minDedupCompactionLines; i++ {
+		mustAdd(t, s, fmt.Sprintf("unique-%d", i))
+	}
+	clk.t = clk.t.Add(2 * time.Minute)
+	mustAdd(t, s, "last")
+	if s.lines != 1 {
+		t.Errorf("expected expired keys to be compacted away, got %d lines", s.lines)
+	}
+	mustContain(t, s, "last", true)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(b), "\n"); got != 1 {
+		t.Errorf("dedup file has %d lines after compaction, want 1", got)
+	}
+}
+
+func TestDeduperReserve(t *testing.T) {
+	ctx := context.Background()
+	dd := &deduper{store: NewMemoryDedupStore(100, time.Hour)}
+	build := &cbpb.Build{Id: "build-1", Status: cbpb.Build_SUCCESS}
+
+	mustReserve := func(msgID string, want dedupState) {
+		t.Helper()
+		got, err := dd.reserve(ctx, msgID, build)
+		if err != nil {
+			t.Fatalf("reserve(%q) failed: %v", msgID, err)
+		}
+		if got != want {
+			t.Errorf("reserve(%q) = %v, want %v", msgID, got, want)
+		}
+	}
+
+	mustReserve("1", dedupNew)
+	// Both a concurrent redelivery and a different message for the same Build status are in flight.
+	mustReserve("1", dedupInFlight)
+	mustReserve("2", dedupInFlight)
+
+	// Releasing without marking the message as handled (e.g. after a retryable failure) lets it be handled again.
+	dd.release("1", build)
+	mustReserve("1", dedupNew)
+
+	if err := dd.markHandled(ctx, "1", build); err != nil {
+		t.Fatalf("markHandled failed: %v", err)
+	}
+	dd.release("1", build)
+	mustReserve("1", dedupHandled)
+	mustReserve("2", dedupHandled)
+}
+
+func TestNewDeduper(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cfg     *DedupConfig
+		wantNil bool
+		wantErr bool
+	}{{
+		name:    "no config",
+		wantNil: true,
+	}, {
+		name: "default memory store",
+		cfg:  &DedupConfig{},
+	}, {
+		name: "memory store",
+		cfg:  &DedupConfig{Store: "memory", TTL: "10m", MaxEntries: 5},
+	}, {
+		name: "file store",
+		cfg:  &DedupConfig{Store: "file", Path: filepath.Join(t.TempDir(), "dedup.jsonl")},
+	}, {
+		name:    "file store without path",
+		cfg:     &DedupConfig{Store: "file"},
+		wantErr: true,
+	}, {
+		name:    "bad ttl",
+		cfg:     &DedupConfig{TTL: "forever"},
+		wantErr: true,
+	}, {
+		name:    "unknown store",
+		cfg:     &DedupConfig{Store: "memcache"},
+		wantErr: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			dd, err := newDeduper(tc.cfg)
+			if err != nil {
+				if tc.wantErr {
+					t.Logf("got expected error: %v", err)
+					return
+				}
+				t.Fatalf("newDeduper(%+v) failed: %v", tc.cfg, err)
+			}
+			if tc.wantErr {
+				t.Fatalf("newDeduper(%+v) unexpectedly succeeded", tc.cfg)
+			}
+			if (dd == nil) != tc.wantNil {
+				t.Errorf("newDeduper(%+v) = %v, want nil: %v", tc.cfg, dd, tc.wantNil)
+			}
+		})
+	}
+}
+
+func TestReceiverDedup(t *testing.T) {
+	errSplines := errors.New("failed to reticulate splines")
+	n := &flakyNotifier{errs: []error{nil, nil, errSplines}}
+	handler := newReceiver(n, &receiverParams{
+		dedup: &deduper{store: NewMemoryDedupStore(100, time.Hour)},
+	})
+
+	for _, tc := range []struct {
+		name      string
+		msgID     string
+		build     *cbpb.Build
+		wantCode  int
+		wantCalls int
+	}{{
+		name:      "first message",
+		msgID:     "1",
+		build:     &cbpb.Build{Id: "build-1", Status: cbpb.Build_WORKING},
+		wantCode:  http.StatusOK,
+		wantCalls: 1,
+	}, {
+		name:      "redelivered message",
+		msgID:     "1",
+		build:     &cbpb.Build{Id: "build-1", Status: cbpb.Build_WORKING},
+		wantCode:  http.StatusOK,
+		wantCalls: 1,
+	}, {
+		name:      "repeated build status",
+		msgID:     "2",
+		build:     &cbpb.Build{Id: "build-1", Status: cbpb.Build_WORKING},
+		wantCode:  http.StatusOK,
+		wantCalls: 1,
+	}, {
+		name:      "new build status",
+		msgID:     "3",
+		build:     &cbpb.Build{Id: "build-1", Status: cbpb.Build_SUCCESS},
+		wantCode:  http.StatusOK,
+		wantCalls: 2,
+	}, {
+		name:      "failed message",
+		msgID:     "4",
+		build:     &cbpb.Build{Id: "build-2", Status: cbpb.Build_SUCCESS},
+		wantCode:  http.StatusInternalServerError,
+		wantCalls: 3,
+	}, {
+		name:      "redelivered failed message",
+		msgID:     "4",
+		build:     &cbpb.Build{Id: "build-2", Status: cbpb.Build_SUCCESS},
+		wantCode:  http.StatusOK,
+		wantCalls: 4,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			j, err := protojson.Marshal(proto.MessageV2(tc.build))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := wrapperToBuffer(t, &pubSubPushWrapper{Message: pubSubPushMessage{ID: tc.msgID, Data: j}})
+			req := httptest.NewRequest(http.MethodPost, "http://notifer.example.com/", body)
+			w := httptest.NewRecorder()
+
+			handler(w, req)
+
+			if s := w.Result().StatusCode; s != tc.wantCode {
+				t.Errorf("result.StatusCode = %d, expected %d", s, tc.wantCode)
+			}
+			if n.calls != tc.wantCalls {
+				t.Errorf("SendNotification was called %d times in total, expected %d", n.calls, tc.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// PermanentError is an error returned from SendNotification that will not go away by trying again, e.g. a template
+// that fails to render or a 4xx response from the delivery endpoint. Pub/Sub messages that fail with a PermanentError
+// are acked so that they are not redelivered.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// RetryableError is an error returned from SendNotification that might go away by trying again, e.g. a timeout or a
+// 5xx response from the delivery endpoint. Errors that are neither a PermanentError nor a RetryableError are treated
+// as retryable.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent marks the given error as a PermanentError. It returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// Retryable marks the given error as a RetryableError. It returns nil if err is nil.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &RetryableError{Err: err}
+}
+
+// IsPermanent returns true iff the given error is (or wraps) a PermanentError. If the error chain contains both a
+// PermanentError and a RetryableError, the outermost one wins.
+func IsPermanent(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		switch err.(type) {
+		case *PermanentError:
+			return true
+		case *RetryableError:
+			return false
+		}
+	}
+	return false
+}
+
+// ResponseError returns nil if the given response has a 2xx status. Otherwise it returns an error for the status that
+// is permanent for 4xx statuses (other than 429 Too Many Requests) and retryable for everything else.
+func ResponseError(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err := fmt.Errorf("got a non-2xx response status %q", resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return Retryable(err)
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestIsPermanent(t *testing.T) {
+	base := errors.New("failed to reticulate splines")
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{{
+		name: "nil",
+		err:  nil,
+		want: false,
+	}, {
+		name: "unmarked",
+		err:  base,
+		want: false,
+	}, {
+		name: "permanent",
+		err:  Permanent(base),
+		want: true,
+	}, {
+		name: "wrapped permanent",
+		err:  fmt.Errorf("failed to send: %w", Permanent(base)),
+		want: true,
+	}, {
+		name: "retryable",
+		err:  Retryable(base),
+		want: false,
+	}, {
+		name: "retryable wrapping permanent",
+		err:  Retryable(fmt.Errorf("failed to send: %w", Permanent(base))),
+		want: false,
+	}, {
+		name: "permanent wrapping retryable",
+		err:  Permanent(Retryable(base)),
+		want: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := IsPermanent(tc.err); got != tc.want {
+				t.Errorf("IsPermanent(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMarkersUnwrap(t *testing.T) {
+	base := errors.New("failed to reticulate splines")
+	if err := Permanent(base); !errors.Is(err, base) {
+		t.Errorf("errors.Is(%v, %v) = false, want true", err, base)
+	}
+	if err := Retryable(base); !errors.Is(err, base) {
+		t.Errorf("errors.Is(%v, %v) = false, want true", err, base)
+	}
+	if Permanent(nil) != nil || Retryable(nil) != nil {
+		t.Error("expected marking a nil error to return nil")
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	for _, tc := range []struct {
+		code          int
+		wantErr       bool
+		wantPermanent bool
+	}{{
+		code: http.StatusOK,
+	}, {
+		code: http.StatusNoContent,
+	}, {
+		code:          http.StatusBadRequest,
+		wantErr:       true,
+		wantPermanent: true,
+	}, {
+		code:          http.StatusNotFound,
+		wantErr:       true,
+		wantPermanent: true,
+	}, {
+		code:    http.StatusTooManyRequests,
+		wantErr: true,
+	}, {
+		code:    http.StatusInternalServerError,
+		wantErr: true,
+	}, {
+		code:    http.StatusServiceUnavailable,
+		wantErr: true,
+	}} {
+		resp := &http.Response{StatusCode: tc.code, Status: fmt.Sprintf("%d %s", tc.code, http.StatusText(tc.code))}
+		err := ResponseError(resp)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ResponseError(%d) = %v, want error = %v", tc.code, err, tc.wantErr)
+			continue
+		}
+		if got := IsPermanent(err); got != tc.wantPermanent {
+			t.Errorf("IsPermanent(ResponseError(%d)) = %v, want %v", tc.code, got, tc.wantPermanent)
+		}
+	}
+}
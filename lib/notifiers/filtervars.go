@@ -0,0 +1,123 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+type messageAttributesContextKey struct{}
+
+// withMessageAttributes returns a child context carrying the Pub/Sub message attributes for use by CELPredicate.
+func withMessageAttributes(ctx context.Context, attrs map[string]string) context.Context {
+	return context.WithValue(ctx, messageAttributesContextKey{}, attrs)
+}
+
+// messageAttributesFromContext returns the Pub/Sub message attributes carried by the context, or an empty map if
+// there are none.
+func messageAttributesFromContext(ctx context.Context) map[string]string {
+	if attrs, ok := ctx.Value(messageAttributesContextKey{}).(map[string]string); ok && attrs != nil {
+		return attrs
+	}
+	return map[string]string{}
+}
+
+type resolvedParamsContextKey struct{}
+
+// resolvedParams are the params that a route's resolver resolved for a Build before its filter was applied.
+type resolvedParams struct {
+	resolver BindingResolver
+	build    *cbpb.Build
+	params   *ResolvedParams
+}
+
+// withResolvedParams returns a child context carrying the params that the given resolver resolved for the given
+// Build. CELPredicate exposes them as `params`, and the route's instrumentedResolver returns them instead of
+// resolving them again when the notifier calls it with the same Build.
+func withResolvedParams(ctx context.Context, resolver BindingResolver, build *cbpb.Build, params *ResolvedParams) context.Context {
+	return context.WithValue(ctx, resolvedParamsContextKey{}, &resolvedParams{resolver: resolver, build: build, params: params})
+}
+
+// paramsFromContext returns the resolved params carried by the context, or an empty map if there are none.
+func paramsFromContext(ctx context.Context) map[string]string {
+	if rp, ok := ctx.Value(resolvedParamsContextKey{}).(*resolvedParams); ok && rp.params != nil && rp.params.Values != nil {
+		return rp.params.Values
+	}
+	return map[string]string{}
+}
+
+// resolvedParamsFor returns a copy of the params carried by the context iff they were resolved by the given resolver
+// for the given Build.
+func resolvedParamsFor(ctx context.Context, resolver BindingResolver, build *cbpb.Build) (*ResolvedParams, bool) {
+	rp, ok := ctx.Value(resolvedParamsContextKey{}).(*resolvedParams)
+	if !ok || rp.resolver != resolver || rp.build != build || rp.params == nil {
+		return nil, false
+	}
+	// Notifiers are free to modify the params they get.
+	params := &ResolvedParams{
+		Values:    make(map[string]string, len(rp.params.Values)),
+		Defaulted: append([]string(nil), rp.params.Defaulted...),
+	}
+	for k, v := range rp.params.Values {
+		params.Values[k] = v
+	}
+	return params, true
+}
+
+// usesIdent returns true iff the given CEL expression refers to the identifier with the given name anywhere, e.g. as
+// in `params.env == "prod"`.
+func usesIdent(e *exprpb.Expr, name string) bool {
+	if e == nil {
+		return false
+	}
+	switch k := e.ExprKind.(type) {
+	case *exprpb.Expr_IdentExpr:
+		return k.IdentExpr.GetName() == name
+	case *exprpb.Expr_SelectExpr:
+		return usesIdent(k.SelectExpr.GetOperand(), name)
+	case *exprpb.Expr_CallExpr:
+		if usesIdent(k.CallExpr.GetTarget(), name) {
+			return true
+		}
+		for _, arg := range k.CallExpr.GetArgs() {
+			if usesIdent(arg, name) {
+				return true
+			}
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, el := range k.ListExpr.GetElements() {
+			if usesIdent(el, name) {
+				return true
+			}
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range k.StructExpr.GetEntries() {
+			if usesIdent(entry.GetMapKey(), name) || usesIdent(entry.GetValue(), name) {
+				return true
+			}
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		c := k.ComprehensionExpr
+		for _, sub := range []*exprpb.Expr{c.GetIterRange(), c.GetAccuInit(), c.GetLoopCondition(), c.GetLoopStep(), c.GetResult()} {
+			if usesIdent(sub, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,259 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+func TestCELPredicateWithFilterVariables(t *testing.T) {
+	defer func(now func() time.Time) { celNow = now }(celNow)
+	celNow = func() time.Time { return time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC) }
+
+	build := new(cbpb.Build)
+	withParams := withResolvedParams(context.Background(), nil, build, &ResolvedParams{Values: map[string]string{"env": "prod"}})
+	withAttrs := withMessageAttributes(context.Background(), map[string]string{"status": "FAILURE"})
+
+	for _, tc := range []struct {
+		name      string
+		filter    string
+		ctx       context.Context
+		wantMatch bool
+	}{{
+		name:      "params match",
+		filter:    `params.env == "prod"`,
+		ctx:       withParams,
+		wantMatch: true,
+	}, {
+		name:      "params mismatch",
+		filter:    `params.env == "staging"`,
+		ctx:       withParams,
+		wantMatch: false,
+	}, {
+		name:      "no params",
+		filter:    `params.env == "prod"`,
+		ctx:       context.Background(),
+		wantMatch: false,
+	}, {
+		name:      "optional param",
+		filter:    `!("region" in params) || params.region == "us"`,
+		ctx:       withParams,
+		wantMatch: true,
+	}, {
+		name:      "attributes match",
+		filter:    `attributes.status == "FAILURE"`,
+		ctx:       withAttrs,
+		wantMatch: true,
+	}, {
+		name:      "no attributes",
+		filter:    `size(attributes) == 0`,
+		ctx:       context.Background(),
+		wantMatch: true,
+	}, {
+		name:      "now",
+		filter:    `now > timestamp("2020-05-31T00:00:00Z") && now.getHours() == 12`,
+		ctx:       context.Background(),
+		wantMatch: true,
+	}} {
+		pred, err := MakeCELPredicate(tc.filter)
+		if err != nil {
+			t.Fatalf("%s: MakeCELPredicate(%q) failed: %v", tc.name, tc.filter, err)
+		}
+		if got := pred.Apply(tc.ctx, build); got != tc.wantMatch {
+			t.Errorf("%s: Apply = %v, want %v", tc.name, got, tc.wantMatch)
+		}
+	}
+}
+
+func TestRouterFilterParams(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: "cloud-build-notifiers/v1",
+		Spec: &Spec{
+			Notifications: []*Notification{{
+				Filter:   `params.env == "prod"`,
+				Delivery: map[string]interface{}{"name": "prod"},
+				Params:   map[string]string{"env": "$(build.substitutions._ENV)"},
+			}, {
+				Filter:   `build.status == Build.Status.FAILURE`,
+				Delivery: map[string]interface{}{"name": "failures"},
+			}},
+		},
+	}
+	rec := new(routeRecorder)
+	r, err := newRouter(ctx, &recordingNotifier{rec: rec}, cfg, new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+
+	for _, b := range []*cbpb.Build{
+		{Id: "prod", Substitutions: map[string]string{"_ENV": "prod"}},
+		{Id: "staging", Substitutions: map[string]string{"_ENV": "staging"}},
+		// The params of the first route do not resolve, so it just does not match.
+		{Id: "no-env", Status: cbpb.Build_FAILURE},
+	} {
+		if err := r.SendNotification(ctx, b); err != nil {
+			t.Fatalf("SendNotification(%v) failed: %v", b, err)
+		}
+	}
+
+	if diff := cmp.Diff([]string{"prod/prod", "failures/no-env"}, rec.sent); diff != "" {
+		t.Errorf("unexpected routed notifications (want- got+):\n%s", diff)
+	}
+}
+
+func TestInstrumentedResolverReusesParams(t *testing.T) {
+	ctx := context.Background()
+	jr, err := newResolver(&Config{Spec: &Spec{Notification: &Notification{
+		Params: map[string]string{"id": "$(build.id)"},
+	}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := &instrumentedResolver{BindingResolver: jr, labels: newMetricLabels(nil, new(Config))}
+	build := &cbpb.Build{Id: "resolved"}
+
+	for _, tc := range []struct {
+		name  string
+		ctx   context.Context
+		build *cbpb.Build
+		want  string
+	}{{
+		name:  "reused",
+		ctx:   withResolvedParams(ctx, br, build, &ResolvedParams{Values: map[string]string{"id": "reused"}}),
+		build: build,
+		want:  "reused",
+	}, {
+		name:  "other build",
+		ctx:   withResolvedParams(ctx, br, new(cbpb.Build), &ResolvedParams{Values: map[string]string{"id": "reused"}}),
+		build: build,
+		want:  "resolved",
+	}, {
+		name:  "other resolver",
+		ctx:   withResolvedParams(ctx, jr, build, &ResolvedParams{Values: map[string]string{"id": "reused"}}),
+		build: build,
+		want:  "resolved",
+	}} {
+		got, err := br.Resolve(tc.ctx, nil, tc.build)
+		if err != nil {
+			t.Fatalf("%s: Resolve failed: %v", tc.name, err)
+		}
+		if got["id"] != tc.want {
+			t.Errorf("%s: Resolve got id = %q, want %q", tc.name, got["id"], tc.want)
+		}
+	}
+
+	// The names of the defaulted params are reused along with their values.
+	rctx := withResolvedParams(ctx, br, build, &ResolvedParams{Values: map[string]string{}, Defaulted: []string{"id"}})
+	rp, err := ResolveParams(rctx, br, nil, build)
+	if err != nil {
+		t.Fatalf("ResolveParams failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"id"}, rp.Defaulted); diff != "" {
+		t.Errorf("ResolveParams got unexpected defaulted params (want- got+):\n%s", diff)
+	}
+}
+
+// countingResolver is a BindingResolver that counts its calls.
+type countingResolver struct {
+	calls int
+}
+
+func (c *countingResolver) Resolve(_ context.Context, _ SecretGetter, build *cbpb.Build) (map[string]string, error) {
+	c.calls++
+	return map[string]string{"env": build.Substitutions["_ENV"]}, nil
+}
+
+// resolvingNotifier is a Notifier that resolves its params on every call and fails the first one.
+type resolvingNotifier struct {
+	br    BindingResolver
+	calls int
+}
+
+func (n *resolvingNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (n *resolvingNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	if _, err := n.br.Resolve(ctx, nil, build); err != nil {
+		return err
+	}
+	n.calls++
+	if n.calls == 1 {
+		return errors.New("failed to reticulate splines")
+	}
+	return nil
+}
+
+func TestRouterResolvesParamsOnce(t *testing.T) {
+	ctx := context.Background()
+	labels := newMetricLabels(nil, new(Config))
+	var routes []*route
+	var resolvers []*countingResolver
+	for _, filter := range []string{`params.env == "prod"`, `build.id != ""`} {
+		prd, err := MakeCELPredicate(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cr := new(countingResolver)
+		br := &instrumentedResolver{BindingResolver: cr, labels: labels}
+		routes = append(routes, &route{filter: prd, resolver: br, notifier: &resolvingNotifier{br: br}})
+		resolvers = append(resolvers, cr)
+	}
+	r := &router{routes: routes}
+
+	build := &cbpb.Build{Id: "some-id", Substitutions: map[string]string{"_ENV": "prod"}}
+	if err := r.sendWithRetries(ctx, "", build, &receiverParams{maxSendAttempts: 2}); err != nil {
+		t.Fatalf("sendWithRetries failed: %v", err)
+	}
+
+	// The params of the first route are only resolved for its filter and then reused on every attempt, while the ones
+	// of the second route are not resolved for its filter since it does not use them.
+	if got := resolvers[0].calls; got != 1 {
+		t.Errorf("params of the route whose filter uses them were resolved %d times, want 1", got)
+	}
+	if got := resolvers[1].calls; got != 2 {
+		t.Errorf("params of the route whose filter does not use them were resolved %d times, want 2 (once per attempt)", got)
+	}
+}
+
+func TestUsesIdent(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		want   bool
+	}{
+		{filter: `params.env == "prod"`, want: true},
+		{filter: `"env" in params`, want: true},
+		{filter: `build.tags.exists(t, t == params.tag)`, want: true},
+		{filter: `[params.a, "b"].size() == 2`, want: true},
+		{filter: `{"a": params.a}.size() == 1`, want: true},
+		{filter: `build.status == Build.Status.SUCCESS`, want: false},
+		{filter: `build.substitutions["params"] == "x"`, want: false},
+	} {
+		prd, err := MakeCELPredicate(tc.filter)
+		if err != nil {
+			t.Fatalf("MakeCELPredicate(%q) failed: %v", tc.filter, err)
+		}
+		if prd.usesParams != tc.want {
+			t.Errorf("MakeCELPredicate(%q) usesParams = %v, want %v", tc.filter, prd.usesParams, tc.want)
+		}
+	}
+}
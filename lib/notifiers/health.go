@@ -0,0 +1,168 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"gopkg.in/yaml.v2"
+)
+
+// redacted replaces secret values in the config served by /configz.
+const redacted = "[REDACTED]"
+
+// livezHandler responds with a 200 as long as the server is able to handle requests at all.
+func livezHandler(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler responds with a 200 iff the notifier was set up and the config it uses is current, i.e. the last
+// attempt to reload it did not fail. Otherwise it responds with a 503 and the reason.
+func (r *reloader) readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	r.mtx.RLock()
+	setUp, lastErr := r.current != nil, r.lastErr
+	r.mtx.RUnlock()
+
+	switch {
+	case !setUp:
+		http.Error(w, "notifier is not set up", http.StatusServiceUnavailable)
+	case lastErr != nil:
+		http.Error(w, fmt.Sprintf("config is stale since it failed to reload: %v", lastErr), http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// configView is the config served by /configz.
+type configView struct {
+	Config *Config `yaml:"config"`
+	// TemplateHashes are the SHA-256 hashes of the templates that each route was set up with, in route order.
+	// A route without a template has an empty hash.
+	TemplateHashes []string `yaml:"templateHashes"`
+}
+
+// configzHandler serves the loaded config as YAML, with secrets redacted, along with the hashes of the active
+// templates.
+func (r *reloader) configzHandler(w http.ResponseWriter, req *http.Request) {
+	r.mtx.RLock()
+	v := &configView{Config: redactConfig(r.cfg)}
+	for _, rt := range r.current.routes {
+		v.TemplateHashes = append(v.TemplateHashes, rt.templateHash)
+	}
+	r.mtx.RUnlock()
+
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		Errorf(req.Context(), "failed to encode config: %v", err)
+		http.Error(w, "failed to encode config", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(out)
+}
+
+// templateHash returns the hex-encoded SHA-256 hash of the given template, or the empty string if it is empty.
+func templateHash(tmpl string) string {
+	if tmpl == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(tmpl))
+	return hex.EncodeToString(h[:])
+}
+
+// redactConfig returns a copy of the given config whose Secret resource names and `secretRef` values are redacted.
+// The given config is not modified.
+func redactConfig(cfg *Config) *Config {
+	if cfg == nil || cfg.Spec == nil {
+		return cfg
+	}
+	rcfg := *cfg
+	spec := *cfg.Spec
+	rcfg.Spec = &spec
+
+	if spec.Notification != nil {
+		spec.Notification = redactNotification(spec.Notification)
+	}
+	spec.Notifications = nil
+	for _, n := range cfg.Spec.Notifications {
+		spec.Notifications = append(spec.Notifications, redactNotification(n))
+	}
+
+	spec.Secrets = nil
+	for _, s := range cfg.Spec.Secrets {
+		spec.Secrets = append(spec.Secrets, &Secret{LocalName: s.LocalName, ResourceName: redacted})
+	}
+	return &rcfg
+}
+
+func redactNotification(n *Notification) *Notification {
+	rn := *n
+	if n.Delivery != nil {
+		rn.Delivery = redactValue(n.Delivery).(map[string]interface{})
+	}
+	if n.ParamOptions != nil {
+		rn.ParamOptions = map[string]*Param{}
+		for name, p := range n.ParamOptions {
+			if p == nil {
+				rn.ParamOptions[name] = nil
+				continue
+			}
+			rp := *p
+			if rp.SecretRef != "" {
+				rp.SecretRef = redacted
+			}
+			rn.ParamOptions[name] = &rp
+		}
+	}
+	return &rn
+}
+
+// redactValue returns a deep copy of the given decoded YAML value in which the value of every `secretRef` key is
+// redacted.
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			if k == secretRef {
+				m[k] = redacted
+			} else {
+				m[k] = redactValue(e)
+			}
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := map[interface{}]interface{}{}
+		for k, e := range v {
+			if k == secretRef {
+				m[k] = redacted
+			} else {
+				m[k] = redactValue(e)
+			}
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = redactValue(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v2"
+)
+
+func TestReadyz(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		rl         *reloader
+		wantStatus int
+	}{{
+		name:       "ready",
+		rl:         &reloader{current: new(router)},
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "not set up",
+		rl:         new(reloader),
+		wantStatus: http.StatusServiceUnavailable,
+	}, {
+		name:       "stale config",
+		rl:         &reloader{current: new(router), lastErr: errors.New("bad config")},
+		wantStatus: http.StatusServiceUnavailable,
+	}} {
+		w := httptest.NewRecorder()
+		tc.rl.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: readyz got status %d, want %d", tc.name, w.Code, tc.wantStatus)
+		}
+	}
+}
+
+func TestConfigz(t *testing.T) {
+	cfg, err := decodeConfig(strings.NewReader(`
+apiVersion: cloud-build-notifiers/v1
+kind: SlackNotifier
+metadata:
+  name: my-slack-notifier
+spec:
+  notifications:
+  - filter: build.status == Build.Status.FAILURE
+    delivery:
+      webhookUrl:
+        secretRef: webhook-url
+    params:
+      id: $(build.id)
+      token:
+        secretRef: webhook-url
+  - filter: build.status == Build.Status.SUCCESS
+    delivery:
+      channel: builds
+  secrets:
+  - name: webhook-url
+    value: projects/my-project/secrets/my-webhook/versions/latest
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := &reloader{
+		cfg: cfg,
+		current: &router{routes: []*route{
+			{templateHash: templateHash("{{.Build.Id}}")},
+			{},
+		}},
+	}
+
+	w := httptest.NewRecorder()
+	rl.configzHandler(w, httptest.NewRequest(http.MethodGet, "/configz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("configz got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	got := new(configView)
+	if err := yaml.Unmarshal(w.Body.Bytes(), got); err != nil {
+		t.Fatalf("failed to decode configz response: %v", err)
+	}
+	if body := w.Body.String(); strings.Contains(body, "my-webhook") {
+		t.Errorf("configz response contains secrets:\n%s", body)
+	}
+	if diff := cmp.Diff([]*Secret{{LocalName: "webhook-url", ResourceName: redacted}}, got.Config.Spec.Secrets); diff != "" {
+		t.Errorf("configz got unexpected secrets: (want- got+)\n%s", diff)
+	}
+	wantDelivery := map[interface{}]interface{}{"secretRef": redacted}
+	if diff := cmp.Diff(wantDelivery, got.Config.Spec.Notifications[0].Delivery["webhookUrl"]); diff != "" {
+		t.Errorf("configz got unexpected delivery: (want- got+)\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{"id": "$(build.id)"}, got.Config.Spec.Notifications[0].Params); diff != "" {
+		t.Errorf("configz got unexpected params: (want- got+)\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]*Param{"token": {SecretRef: redacted}}, got.Config.Spec.Notifications[0].ParamOptions); diff != "" {
+		t.Errorf("configz got unexpected param options: (want- got+)\n%s", diff)
+	}
+	if diff := cmp.Diff("builds", got.Config.Spec.Notifications[1].Delivery["channel"]); diff != "" {
+		t.Errorf("configz got unexpected delivery: (want- got+)\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{templateHash("{{.Build.Id}}"), ""}, got.TemplateHashes); diff != "" {
+		t.Errorf("configz got unexpected template hashes: (want- got+)\n%s", diff)
+	}
+
+	// The loaded config itself must not be redacted.
+	if s := cfg.Spec.Secrets[0].ResourceName; s == redacted {
+		t.Errorf("configz redacted the loaded config")
+	}
+	if ref, err := GetSecretRef(cfg.Spec.Notifications[0].Delivery, "webhookUrl"); err != nil || ref != "webhook-url" {
+		t.Errorf("configz redacted the loaded config: GetSecretRef = (%q, %v)", ref, err)
+	}
+	if ref := cfg.Spec.Notifications[0].ParamOptions["token"].SecretRef; ref != "webhook-url" {
+		t.Errorf("configz redacted the loaded config: param secretRef = %q", ref)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+// historyEntry is the last terminal Build seen for a history key along with the entry it replaced, which is needed
+// to handle the same Build being seen more than once.
+type historyEntry struct {
+	build  *cbpb.Build
+	streak int64 // Number of consecutive terminal Builds (ending with this one) that have this Build's status.
+	before *historyEntry
+}
+
+// buildHistory keeps the last terminal Build per trigger and branch (or tag) so that filters can compare a Build's
+// outcome against the previous one, e.g. to only notify when a trigger goes from green to red.
+type buildHistory struct {
+	mtx     sync.Mutex
+	entries map[string]*historyEntry // Map of history key => its last terminal Build.
+}
+
+func newBuildHistory() *buildHistory {
+	return &buildHistory{entries: map[string]*historyEntry{}}
+}
+
+// historyKey returns the key that the Build's history is tracked under, or the empty string if it is not tracked.
+// Only triggered Builds are tracked.
+func historyKey(build *cbpb.Build) string {
+	if build.BuildTriggerId == "" {
+		return ""
+	}
+	ref := build.Substitutions["BRANCH_NAME"]
+	if ref == "" {
+		ref = build.Substitutions["TAG_NAME"]
+	}
+	return build.BuildTriggerId + "/" + ref
+}
+
+// observe returns the previous terminal Build for the given Build's history key (or an empty Build if there is none)
+// and the streak of the given Build, i.e. the number of consecutive terminal Builds with the given Build's status,
+// including the given Build. The streak is zero for non-terminal Builds. Terminal Builds are then recorded as the
+// latest Build for their key. Observing the same Build more than once (e.g. due to a redelivered Pub/Sub message)
+// gives the same result every time. A Build that was created before the latest Build for its key arrived late, so it
+// is not recorded and gets an empty previous Build since its actual predecessor is not known.
+func (h *buildHistory) observe(build *cbpb.Build) (*cbpb.Build, int64) {
+	terminal := isTerminalStatus(build.Status)
+	key := historyKey(build)
+	if key == "" {
+		if terminal {
+			return new(cbpb.Build), 1
+		}
+		return new(cbpb.Build), 0
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	prev := h.entries[key]
+	if prev != nil && prev.build.Id == build.Id {
+		prev = prev.before
+	} else if prev != nil && createdBefore(build, prev.build) {
+		if terminal {
+			return new(cbpb.Build), 1
+		}
+		return new(cbpb.Build), 0
+	}
+
+	var streak int64
+	if terminal {
+		streak = 1
+		if prev != nil && prev.build.Status == build.Status {
+			streak = prev.streak + 1
+		}
+		h.entries[key] = &historyEntry{
+			build:  proto.Clone(build).(*cbpb.Build),
+			streak: streak,
+			before: shallowHistoryEntry(prev),
+		}
+	}
+
+	if prev == nil {
+		return new(cbpb.Build), streak
+	}
+	return prev.build, streak
+}
+
+// createdBefore returns true iff both Builds have a create time and a was created before b.
+func createdBefore(a, b *cbpb.Build) bool {
+	if a.CreateTime == nil || b.CreateTime == nil {
+		return false
+	}
+	return a.CreateTime.AsTime().Before(b.CreateTime.AsTime())
+}
+
+// shallowHistoryEntry returns a copy of the given entry without its own previous entry so that history does not grow
+// without bound.
+func shallowHistoryEntry(e *historyEntry) *historyEntry {
+	if e == nil {
+		return nil
+	}
+	return &historyEntry{build: e.build, streak: e.streak}
+}
+
+type buildHistoryContextKey struct{}
+
+type buildHistoryValues struct {
+	previous *cbpb.Build
+	streak   int64
+}
+
+// withBuildHistory returns a child context carrying the given previous Build and streak for use by CELPredicate.
+func withBuildHistory(ctx context.Context, previous *cbpb.Build, streak int64) context.Context {
+	return context.WithValue(ctx, buildHistoryContextKey{}, &buildHistoryValues{previous: previous, streak: streak})
+}
+
+// buildHistoryFromContext returns the previous Build and streak carried by the context, or an empty Build and zero if
+// there are none.
+func buildHistoryFromContext(ctx context.Context) (*cbpb.Build, int64) {
+	v, ok := ctx.Value(buildHistoryContextKey{}).(*buildHistoryValues)
+	if !ok {
+		return new(cbpb.Build), 0
+	}
+	return v.previous, v.streak
+}
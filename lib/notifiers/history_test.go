@@ -0,0 +1,189 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"testing"
+
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func triggeredBuild(id, branch string, status cbpb.Build_Status) *cbpb.Build {
+	return &cbpb.Build{
+		Id:             id,
+		BuildTriggerId: "some-trigger",
+		Status:         status,
+		Substitutions:  map[string]string{"BRANCH_NAME": branch},
+	}
+}
+
+func TestBuildHistory(t *testing.T) {
+	h := newBuildHistory()
+	for _, tc := range []struct {
+		name       string
+		build      *cbpb.Build
+		wantPrevID string
+		wantStreak int64
+	}{{
+		name:       "first build",
+		build:      triggeredBuild("1", "main", cbpb.Build_SUCCESS),
+		wantStreak: 1,
+	}, {
+		name:       "second success",
+		build:      triggeredBuild("2", "main", cbpb.Build_SUCCESS),
+		wantPrevID: "1",
+		wantStreak: 2,
+	}, {
+		name:       "non-terminal build",
+		build:      triggeredBuild("3", "main", cbpb.Build_WORKING),
+		wantPrevID: "2",
+		wantStreak: 0,
+	}, {
+		name:       "broken",
+		build:      triggeredBuild("3", "main", cbpb.Build_FAILURE),
+		wantPrevID: "2",
+		wantStreak: 1,
+	}, {
+		name:       "redelivered broken",
+		build:      triggeredBuild("3", "main", cbpb.Build_FAILURE),
+		wantPrevID: "2",
+		wantStreak: 1,
+	}, {
+		name:       "other branch",
+		build:      triggeredBuild("4", "dev", cbpb.Build_FAILURE),
+		wantStreak: 1,
+	}, {
+		name:       "still broken",
+		build:      triggeredBuild("5", "main", cbpb.Build_FAILURE),
+		wantPrevID: "3",
+		wantStreak: 2,
+	}, {
+		name:       "fixed",
+		build:      triggeredBuild("6", "main", cbpb.Build_SUCCESS),
+		wantPrevID: "5",
+		wantStreak: 1,
+	}, {
+		name:       "untriggered build",
+		build:      &cbpb.Build{Id: "7", Status: cbpb.Build_FAILURE},
+		wantStreak: 1,
+	}} {
+		prev, streak := h.observe(tc.build)
+		if prev.Id != tc.wantPrevID {
+			t.Errorf("%s: observe(%v) previous ID = %q, want %q", tc.name, tc.build, prev.Id, tc.wantPrevID)
+		}
+		if streak != tc.wantStreak {
+			t.Errorf("%s: observe(%v) streak = %d, want %d", tc.name, tc.build, streak, tc.wantStreak)
+		}
+	}
+}
+
+func TestBuildHistoryOutOfOrder(t *testing.T) {
+	h := newBuildHistory()
+	build := func(id string, created int64, status cbpb.Build_Status) *cbpb.Build {
+		b := triggeredBuild(id, "main", status)
+		b.CreateTime = &timestamppb.Timestamp{Seconds: created}
+		return b
+	}
+
+	for _, tc := range []struct {
+		name       string
+		build      *cbpb.Build
+		wantPrevID string
+		wantStreak int64
+	}{{
+		name:       "first build",
+		build:      build("1", 100, cbpb.Build_SUCCESS),
+		wantStreak: 1,
+	}, {
+		name:       "third build",
+		build:      build("3", 300, cbpb.Build_FAILURE),
+		wantPrevID: "1",
+		wantStreak: 1,
+	}, {
+		name:       "late second build",
+		build:      build("2", 200, cbpb.Build_FAILURE),
+		wantStreak: 1,
+	}, {
+		name:       "fourth build",
+		build:      build("4", 400, cbpb.Build_FAILURE),
+		wantPrevID: "3",
+		wantStreak: 2,
+	}} {
+		prev, streak := h.observe(tc.build)
+		if prev.Id != tc.wantPrevID {
+			t.Errorf("%s: observe(%v) previous ID = %q, want %q", tc.name, tc.build, prev.Id, tc.wantPrevID)
+		}
+		if streak != tc.wantStreak {
+			t.Errorf("%s: observe(%v) streak = %d, want %d", tc.name, tc.build, streak, tc.wantStreak)
+		}
+	}
+}
+
+func TestCELPredicateWithHistory(t *testing.T) {
+	const brokenOrFixed = `build.status != previous.status && ` +
+		`build.status in [Build.Status.SUCCESS, Build.Status.FAILURE] && ` +
+		`previous.status in [Build.Status.SUCCESS, Build.Status.FAILURE]`
+
+	for _, tc := range []struct {
+		name      string
+		filter    string
+		ctx       context.Context
+		build     *cbpb.Build
+		wantMatch bool
+	}{{
+		name:      "fixed",
+		filter:    `build.status == Build.Status.SUCCESS && previous.status == Build.Status.FAILURE`,
+		ctx:       withBuildHistory(context.Background(), &cbpb.Build{Status: cbpb.Build_FAILURE}, 1),
+		build:     &cbpb.Build{Status: cbpb.Build_SUCCESS},
+		wantMatch: true,
+	}, {
+		name:      "broken",
+		filter:    brokenOrFixed,
+		ctx:       withBuildHistory(context.Background(), &cbpb.Build{Status: cbpb.Build_SUCCESS}, 1),
+		build:     &cbpb.Build{Status: cbpb.Build_FAILURE},
+		wantMatch: true,
+	}, {
+		name:      "still green",
+		filter:    brokenOrFixed,
+		ctx:       withBuildHistory(context.Background(), &cbpb.Build{Status: cbpb.Build_SUCCESS}, 2),
+		build:     &cbpb.Build{Status: cbpb.Build_SUCCESS},
+		wantMatch: false,
+	}, {
+		name:      "no history",
+		filter:    brokenOrFixed,
+		ctx:       context.Background(),
+		build:     &cbpb.Build{Status: cbpb.Build_FAILURE},
+		wantMatch: false,
+	}, {
+		name:      "third failure in a row",
+		filter:    `build.status == Build.Status.FAILURE && streak == 3`,
+		ctx:       withBuildHistory(context.Background(), &cbpb.Build{Status: cbpb.Build_FAILURE}, 3),
+		build:     &cbpb.Build{Status: cbpb.Build_FAILURE},
+		wantMatch: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			pred, err := MakeCELPredicate(tc.filter)
+			if err != nil {
+				t.Fatalf("MakeCELPredicate(%q): %v", tc.filter, err)
+			}
+
+			if pred.Apply(tc.ctx, tc.build) != tc.wantMatch {
+				t.Errorf("CELPredicate(%+v) != %v", tc.build, tc.wantMatch)
+			}
+		})
+	}
+}
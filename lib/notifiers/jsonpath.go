@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 
+	"github.com/google/cel-go/cel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
 	"k8s.io/client-go/third_party/forked/golang/template"
 	"k8s.io/client-go/util/jsonpath"
@@ -27,14 +32,68 @@ type inputAndJSONPath struct {
 }
 
 type jpResolver struct {
-	mtx sync.RWMutex
-	jps map[string]*inputAndJSONPath // Map of _SOME_SUBST_NAME => its inputAndJSONPath.
-	cfg *Config
+	mtx    sync.RWMutex
+	jps    map[string]*inputAndJSONPath // Map of _SOME_SUBST_NAME => its inputAndJSONPath.
+	cels   map[string]*celParam         // Map of _SOME_SUBST_NAME => its CEL expression, for `cel:` params.
+	params map[string]*Param            // Map of _SOME_SUBST_NAME => its declaration, for its options.
+	names  []string                     // The sorted param names, so that params are resolved in a stable order.
+	cfg    *Config
+	sg     SecretGetter // Used for `secretRef` params if Resolve is not given a SecretGetter.
 }
 
-func newResolver(cfg *Config) (BindingResolver, error) {
+// newResolver returns a BindingResolver for the params of the config's Notification. The given SecretGetter, which may
+// be nil, is used to get the secrets of `secretRef` params unless Resolve is given another one.
+func newResolver(cfg *Config, sg SecretGetter) (BindingResolver, error) {
 	jps := map[string]*inputAndJSONPath{}
-	for name, path := range cfg.Spec.Notification.Params {
+	cels := map[string]*celParam{}
+	params := map[string]*Param{}
+	var names []string
+	var env *cel.Env
+	all, err := cfg.Spec.Notification.allParams()
+	if err != nil {
+		return nil, err
+	}
+	for name, param := range all {
+		if param == nil {
+			return nil, fmt.Errorf("expected param %q to have a value", name)
+		}
+		if param.Default != nil {
+			if _, err := coerceParam(*param.Default, param.Type); err != nil {
+				return nil, fmt.Errorf("got invalid default for param %q: %w", name, err)
+			}
+		} else if _, err := coerceParam("0", param.Type); err != nil {
+			// Every type accepts "0", so this only fails for unknown types.
+			return nil, fmt.Errorf("got invalid type for param %q: %w", name, err)
+		}
+		params[name] = param
+		names = append(names, name)
+
+		if param.SecretRef != "" {
+			if param.Value != "" {
+				return nil, fmt.Errorf("expected only one of `value` and `secretRef` for param %q", name)
+			}
+			if _, err := FindSecretResourceName(cfg.Spec.Secrets, param.SecretRef); err != nil {
+				return nil, fmt.Errorf("failed to find Secret for param %q: %w", name, err)
+			}
+			continue
+		}
+
+		path := param.Value
+		if isCELParam(path) {
+			if env == nil {
+				var err error
+				if env, err = newCELEnv(); err != nil {
+					return nil, err
+				}
+			}
+			c, err := newCELParam(env, path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to make CEL param %q: %w", name, err)
+			}
+			cels[name] = c
+			continue
+		}
+
 		p, err := makeJSONPath(path)
 		if err != nil {
 			return nil, fmt.Errorf("failed to derive substitution path from %q: %v", path, err)
@@ -49,13 +108,46 @@ func newResolver(cfg *Config) (BindingResolver, error) {
 			p: path, // Use the user-provided path so error messages are easier to understand.
 		}
 	}
+	sort.Strings(names)
 	return &jpResolver{
-		jps: jps,
-		cfg: cfg,
+		jps:    jps,
+		cels:   cels,
+		params: params,
+		names:  names,
+		cfg:    cfg,
+		sg:     sg,
 	}, nil
 }
 
+// Resolve resolves every param for the given Build. Params that do not resolve (or cannot be coerced to their type)
+// get their default, are left out if they are optional and fail the whole resolution otherwise.
 func (j *jpResolver) Resolve(ctx context.Context, sg SecretGetter, build *cbpb.Build) (map[string]string, error) {
+	rp, err := j.resolveParams(ctx, sg, build)
+	if err != nil {
+		return nil, err
+	}
+	return rp.Values, nil
+}
+
+// resolveParams is like Resolve but also returns which params were defaulted or left out, which it also logs and adds
+// to the current span.
+func (j *jpResolver) resolveParams(ctx context.Context, sg SecretGetter, build *cbpb.Build) (*ResolvedParams, error) {
+	if sg == nil {
+		sg = j.sg
+	}
+	ret, defaulted, err := j.resolve(ctx, sg, build)
+	if err != nil {
+		return nil, err
+	}
+	if len(defaulted) > 0 {
+		Infof(ctx, "params %q did not resolve, using their defaults (or leaving them out if optional)", defaulted)
+		trace.SpanFromContext(ctx).SetAttributes(attribute.StringSlice("params.defaulted", defaulted))
+	}
+	return &ResolvedParams{Values: ret, Defaulted: defaulted}, nil
+}
+
+// resolve returns the resolved params along with the names of the params that were defaulted or left out.
+func (j *jpResolver) resolve(ctx context.Context, sg SecretGetter, build *cbpb.Build) (map[string]string, []string, error) {
 	j.mtx.RLock()
 	defer j.mtx.RUnlock()
 
@@ -66,25 +158,72 @@ func (j *jpResolver) Resolve(ctx context.Context, sg SecretGetter, build *cbpb.B
 	}
 
 	ret := map[string]string{}
-	for name, jp := range j.jps {
-		fullResults, err := jp.j.FindResults(pld)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse %q with path %q from payload: %v", name, jp.p, err)
+	var defaulted []string
+	for _, name := range j.names {
+		param := j.params[name]
+		s, err := j.resolveParam(ctx, name, pld, sg, build)
+		if err == nil {
+			s, err = coerceParam(s, param.Type)
 		}
-
-		if len(fullResults) == 0 {
-			return nil, fmt.Errorf("failed to get JSONPath query results for %q with path %q", name, jp.p)
+		switch {
+		case err == nil:
+			ret[name] = s
+		case param.Default != nil:
+			// Cannot fail since the default was checked by newResolver.
+			ret[name], _ = coerceParam(*param.Default, param.Type)
+			defaulted = append(defaulted, name)
+		case param.Optional:
+			defaulted = append(defaulted, name)
+		default:
+			return nil, nil, fmt.Errorf("failed to resolve param %q: %w", name, err)
 		}
+	}
+	return ret, defaulted, nil
+}
 
-		buf := new(bytes.Buffer)
-		for _, r := range fullResults {
-			if err := printResults(buf, r); err != nil {
-				return nil, err
-			}
+// resolveParam returns the uncoerced value of the named param.
+func (j *jpResolver) resolveParam(ctx context.Context, name string, pld map[string]interface{}, sg SecretGetter, build *cbpb.Build) (string, error) {
+	if ref := j.params[name].SecretRef; ref != "" {
+		return j.resolveSecret(ctx, sg, ref)
+	}
+	if c, ok := j.cels[name]; ok {
+		return c.eval(ctx, build)
+	}
+
+	jp := j.jps[name]
+	fullResults, err := jp.j.FindResults(pld)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %q with path %q from payload: %v", name, jp.p, err)
+	}
+
+	if len(fullResults) == 0 {
+		return "", fmt.Errorf("failed to get JSONPath query results for %q with path %q", name, jp.p)
+	}
+
+	buf := new(bytes.Buffer)
+	for _, r := range fullResults {
+		if err := printResults(buf, r); err != nil {
+			return "", err
 		}
-		ret[name] = buf.String()
 	}
-	return ret, nil
+	return buf.String(), nil
+}
+
+// resolveSecret returns the value of the Secret with the given local name, which it makes the logger redact.
+func (j *jpResolver) resolveSecret(ctx context.Context, sg SecretGetter, ref string) (string, error) {
+	if sg == nil {
+		return "", errors.New("no SecretGetter to get secrets with")
+	}
+	resource, err := FindSecretResourceName(j.cfg.Spec.Secrets, ref)
+	if err != nil {
+		return "", err
+	}
+	s, err := sg.GetSecret(ctx, resource)
+	if err != nil {
+		return "", fmt.Errorf("failed to get Secret %q: %w", ref, err)
+	}
+	stdLogger.redactSecret(s)
+	return s, nil
 }
 
 func makeJSONPath(path string) (string, error) {
@@ -23,8 +23,8 @@ func TestNewResolver(t *testing.T) {
 		},
 	}
 
-	if _, err := newResolver(cfg); err != nil {
-		t.Fatalf("newResolver(%v) failed unexpectedly: %v", cfg, err)
+	if _, err := newResolver(cfg, nil); err != nil {
+		t.Fatalf("newResolver(%v, nil) failed unexpectedly: %v", cfg, err)
 	}
 }
 
@@ -45,6 +45,12 @@ func TestNewResolverErrors(t *testing.T) {
 				"PIZZA": "hello.goodbye",
 			},
 		},
+		{
+			name: "bad CEL",
+			substs: map[string]string{
+				"PIZZA": "cel: build.pineapple",
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			cfg := &Config{
@@ -55,8 +61,8 @@ func TestNewResolverErrors(t *testing.T) {
 				},
 			}
 
-			if _, err := newResolver(cfg); err == nil {
-				t.Errorf("newResolver(%v) unexpectedly succeeded", cfg)
+			if _, err := newResolver(cfg, nil); err == nil {
+				t.Errorf("newResolver(%v, nil) unexpectedly succeeded", cfg)
 			} else {
 				t.Logf("got expected error %v", err)
 			}
@@ -107,7 +113,7 @@ func TestResolve(t *testing.T) {
 		},
 	}
 
-	r, err := newResolver(cfg)
+	r, err := newResolver(cfg, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -193,9 +199,9 @@ func TestResolveErrors(t *testing.T) {
 					Secrets: tc.secrets,
 				},
 			}
-			r, err := newResolver(cfg)
+			r, err := newResolver(cfg, nil)
 			if err != nil {
-				t.Fatalf("newResolver(...) failed unexpectedly: %v", err)
+				t.Fatalf("newResolver(..., nil) failed unexpectedly: %v", err)
 			}
 
 			// Any secrets we try to look up will result in errors.
@@ -209,3 +215,66 @@ func TestResolveErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveCEL(t *testing.T) {
+	build := &cbpb.Build{
+		Id:     "some-build",
+		Status: cbpb.Build_FAILURE,
+		Tags:   []string{"a", "b"},
+		Substitutions: map[string]string{
+			"_ENV": "prod",
+		},
+	}
+
+	for _, tc := range []struct {
+		name string
+		path string
+		want string
+	}{{
+		name: "conditional",
+		path: `cel: build.substitutions["_ENV"] == "prod" ? "#prod-alerts" : "#dev"`,
+		want: "#prod-alerts",
+	}, {
+		name: "default",
+		path: `cel: sub(build, "BRANCH_NAME", "no-branch")`,
+		want: "no-branch",
+	}, {
+		name: "string ops",
+		path: `cel: build.id + "@" + build.substitutions["_ENV"] + (build.id.startsWith("some") ? "!" : "")`,
+		want: "some-build@prod!",
+	}, {
+		name: "enum",
+		path: `cel: build.status`,
+		want: "4",
+	}, {
+		name: "bool",
+		path: `cel: build.status == Build.Status.FAILURE`,
+		want: "true",
+	}, {
+		name: "list",
+		path: `cel: build.tags`,
+		want: `["a","b"]`,
+	}, {
+		name: "map",
+		path: `cel: build.substitutions`,
+		want: `{"_ENV":"prod"}`,
+	}, {
+		name: "duration",
+		path: `cel: buildDuration(build)`,
+		want: "0s",
+	}} {
+		r, err := newResolver(&Config{Spec: &Spec{Notification: &Notification{
+			Params: map[string]string{"_PARAM": tc.path},
+		}}}, nil)
+		if err != nil {
+			t.Fatalf("%s: newResolver failed: %v", tc.name, err)
+		}
+		got, err := r.Resolve(context.Background(), nil, build)
+		if err != nil {
+			t.Fatalf("%s: Resolve failed: %v", tc.name, err)
+		}
+		if got["_PARAM"] != tc.want {
+			t.Errorf("%s: Resolve got %q, want %q", tc.name, got["_PARAM"], tc.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	glog "github.com/golang/glog"
+	"go.opentelemetry.io/otel/trace"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+// logSeverity is the severity of a log entry. The names match Cloud Logging's LogSeverity.
+type logSeverity int
+
+const (
+	severityDebug logSeverity = iota
+	severityInfo
+	severityWarning
+	severityError
+	severityCritical
+)
+
+var severityNames = map[logSeverity]string{
+	severityDebug:    "DEBUG",
+	severityInfo:     "INFO",
+	severityWarning:  "WARNING",
+	severityError:    "ERROR",
+	severityCritical: "CRITICAL",
+}
+
+// logger writes log entries as JSON lines that Cloud Logging parses into structured entries.
+type logger struct {
+	mtx      sync.Mutex
+	out      io.Writer
+	level    logSeverity // Entries below this severity are dropped.
+	project  string      // Used to build the full trace name. Only the trace ID is logged if empty.
+	now      func() time.Time
+	secrets  map[string]bool   // Secret values that are redacted from every message.
+	redactor *strings.Replacer // Replaces the secrets. Rebuilt whenever a new secret is added.
+}
+
+var stdLogger = &logger{
+	out:     os.Stderr,
+	level:   severityInfo,
+	project: os.Getenv("GOOGLE_CLOUD_PROJECT"),
+	now:     time.Now,
+}
+
+// setLogLevelFromEnv sets the minimum severity that is logged from LOG_LEVEL (one of `debug`, `info`, `warning` or
+// `error`). If LOG_LEVEL is not set, debug entries are only logged if the `--v` flag is at least 2.
+func setLogLevelFromEnv() error {
+	v, ok := GetEnv("LOG_LEVEL")
+	if !ok {
+		if glog.V(2) {
+			stdLogger.setLevel(severityDebug)
+		}
+		return nil
+	}
+
+	for s, name := range severityNames {
+		if strings.EqualFold(v, name) {
+			stdLogger.setLevel(s)
+			return nil
+		}
+	}
+	return fmt.Errorf("got unknown LOG_LEVEL %q (expected one of `debug`, `info`, `warning` or `error`)", v)
+}
+
+// redactSecret makes the logger replace the given secret value in every message it logs from now on.
+func (l *logger) redactSecret(value string) {
+	if value == "" {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.secrets[value] {
+		return
+	}
+	if l.secrets == nil {
+		l.secrets = map[string]bool{}
+	}
+	l.secrets[value] = true
+	l.redactor = newRedactor(l.secrets)
+}
+
+// newRedactor returns a Replacer that redacts the given secrets. Longer secrets are tried first so that a secret
+// containing another one is redacted as a whole.
+func newRedactor(secrets map[string]bool) *strings.Replacer {
+	var values []string
+	for s := range secrets {
+		values = append(values, s)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	var oldnew []string
+	for _, v := range values {
+		oldnew = append(oldnew, v, redacted)
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+func (l *logger) setLevel(s logSeverity) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.level = s
+}
+
+// logEntry is a structured log entry. See https://cloud.google.com/logging/docs/structured-logging.
+type logEntry struct {
+	Severity        string `json:"severity"`
+	Message         string `json:"message"`
+	Time            string `json:"time"`
+	BuildID         string `json:"buildId,omitempty"`
+	Status          string `json:"status,omitempty"`
+	TriggerID       string `json:"triggerId,omitempty"`
+	PubSubMessageID string `json:"pubsubMessageId,omitempty"`
+	Trace           string `json:"logging.googleapis.com/trace,omitempty"`
+	SpanID          string `json:"logging.googleapis.com/spanId,omitempty"`
+}
+
+func (l *logger) log(ctx context.Context, s logSeverity, format string, args ...interface{}) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if s < l.level {
+		return
+	}
+
+	e := &logEntry{
+		Severity: severityNames[s],
+		Message:  fmt.Sprintf(format, args...),
+		Time:     l.now().Format(time.RFC3339Nano),
+	}
+	if l.redactor != nil {
+		e.Message = l.redactor.Replace(e.Message)
+	}
+	if f, ok := ctx.Value(logFieldsContextKey{}).(*logFields); ok {
+		e.BuildID, e.Status, e.TriggerID, e.PubSubMessageID = f.buildID, f.status, f.triggerID, f.messageID
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		e.Trace = sc.TraceID().String()
+		if l.project != "" {
+			e.Trace = fmt.Sprintf("projects/%s/traces/%s", l.project, e.Trace)
+		}
+		e.SpanID = sc.SpanID().String()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		// Should never happen since every field is a string.
+		b = []byte(fmt.Sprintf(`{"severity":"ERROR","message":%q}`, "failed to encode log entry: "+err.Error()))
+	}
+	l.out.Write(append(b, '\n'))
+}
+
+// Debugf logs a debug entry with the Build, Pub/Sub message and trace fields carried by the context.
+func Debugf(ctx context.Context, format string, args ...interface{}) {
+	stdLogger.log(ctx, severityDebug, format, args...)
+}
+
+// Infof logs an info entry with the Build, Pub/Sub message and trace fields carried by the context.
+func Infof(ctx context.Context, format string, args ...interface{}) {
+	stdLogger.log(ctx, severityInfo, format, args...)
+}
+
+// Warningf logs a warning entry with the Build, Pub/Sub message and trace fields carried by the context.
+func Warningf(ctx context.Context, format string, args ...interface{}) {
+	stdLogger.log(ctx, severityWarning, format, args...)
+}
+
+// Errorf logs an error entry with the Build, Pub/Sub message and trace fields carried by the context.
+func Errorf(ctx context.Context, format string, args ...interface{}) {
+	stdLogger.log(ctx, severityError, format, args...)
+}
+
+// Fatalf logs a critical entry with the Build, Pub/Sub message and trace fields carried by the context and exits.
+func Fatalf(ctx context.Context, format string, args ...interface{}) {
+	stdLogger.log(ctx, severityCritical, format, args...)
+	os.Exit(1)
+}
+
+type logFieldsContextKey struct{}
+
+// logFields are the fields that every entry logged with a context carries.
+type logFields struct {
+	buildID   string
+	status    string
+	triggerID string
+	messageID string
+}
+
+func logFieldsFromContext(ctx context.Context) logFields {
+	if f, ok := ctx.Value(logFieldsContextKey{}).(*logFields); ok {
+		return *f
+	}
+	return logFields{}
+}
+
+// withLogBuild returns a child context whose log entries carry the Build's ID, status and trigger ID.
+func withLogBuild(ctx context.Context, build *cbpb.Build) context.Context {
+	f := logFieldsFromContext(ctx)
+	f.buildID, f.status, f.triggerID = build.Id, build.Status.String(), build.BuildTriggerId
+	return context.WithValue(ctx, logFieldsContextKey{}, &f)
+}
+
+// withLogMessageID returns a child context whose log entries carry the given Pub/Sub message ID.
+func withLogMessageID(ctx context.Context, id string) context.Context {
+	f := logFieldsFromContext(ctx)
+	f.messageID = id
+	return context.WithValue(ctx, logFieldsContextKey{}, &f)
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/trace"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+func TestLogger(t *testing.T) {
+	traceID, err := trace.TraceIDFromHex("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spanID, err := trace.SpanIDFromHex("0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spanCtx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	build := &cbpb.Build{Id: "some-build", Status: cbpb.Build_FAILURE, BuildTriggerId: "some-trigger"}
+	fullCtx := withLogBuild(withLogMessageID(spanCtx, "some-message"), build)
+
+	for _, tc := range []struct {
+		name    string
+		ctx     context.Context
+		project string
+		log     func(context.Context, *logger)
+		want    *logEntry // Nil if nothing should be logged.
+	}{{
+		name: "no fields",
+		ctx:  context.Background(),
+		log:  func(ctx context.Context, l *logger) { l.log(ctx, severityInfo, "hello %s", "world") },
+		want: &logEntry{Severity: "INFO", Message: "hello world"},
+	}, {
+		name:    "all fields",
+		ctx:     fullCtx,
+		project: "my-project",
+		log:     func(ctx context.Context, l *logger) { l.log(ctx, severityError, "oh no") },
+		want: &logEntry{
+			Severity:        "ERROR",
+			Message:         "oh no",
+			BuildID:         "some-build",
+			Status:          "FAILURE",
+			TriggerID:       "some-trigger",
+			PubSubMessageID: "some-message",
+			Trace:           "projects/my-project/traces/0123456789abcdef0123456789abcdef",
+			SpanID:          "0123456789abcdef",
+		},
+	}, {
+		name: "trace without project",
+		ctx:  spanCtx,
+		log:  func(ctx context.Context, l *logger) { l.log(ctx, severityWarning, "hmm") },
+		want: &logEntry{
+			Severity: "WARNING",
+			Message:  "hmm",
+			Trace:    "0123456789abcdef0123456789abcdef",
+			SpanID:   "0123456789abcdef",
+		},
+	}, {
+		name: "below level",
+		ctx:  fullCtx,
+		log:  func(ctx context.Context, l *logger) { l.log(ctx, severityDebug, "details") },
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			now := time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+			l := &logger{out: &buf, level: severityInfo, project: tc.project, now: func() time.Time { return now }}
+
+			tc.log(tc.ctx, l)
+			if tc.want == nil {
+				if buf.Len() != 0 {
+					t.Fatalf("got unexpected log output %q", buf.String())
+				}
+				return
+			}
+
+			got := new(logEntry)
+			if err := json.Unmarshal(buf.Bytes(), got); err != nil {
+				t.Fatalf("failed to unmarshal log output %q: %v", buf.String(), err)
+			}
+			tc.want.Time = "2021-04-01T00:00:00Z"
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("got unexpected log entry: (want- got+)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoggerRedactSecret(t *testing.T) {
+	var buf bytes.Buffer
+	l := &logger{out: &buf, level: severityInfo, now: time.Now}
+	l.redactSecret("")
+	l.redactSecret("abc")
+	l.redactSecret("abcdef")
+
+	l.log(context.Background(), severityInfo, "token=%s short=%s", "abcdef", "abc")
+	got := new(logEntry)
+	if err := json.Unmarshal(buf.Bytes(), got); err != nil {
+		t.Fatalf("failed to unmarshal log output %q: %v", buf.String(), err)
+	}
+	if want := "token=[REDACTED] short=[REDACTED]"; got.Message != want {
+		t.Errorf("got log message %q, want %q", got.Message, want)
+	}
+}
+
+func TestSetLogLevelFromEnv(t *testing.T) {
+	defer stdLogger.setLevel(severityInfo)
+	defer os.Unsetenv("LOG_LEVEL")
+
+	for _, tc := range []struct {
+		value     string
+		want      logSeverity
+		wantError bool
+	}{
+		{value: "debug", want: severityDebug},
+		{value: "WARNING", want: severityWarning},
+		{value: "error", want: severityError},
+		{value: "loud", wantError: true},
+	} {
+		os.Setenv("LOG_LEVEL", tc.value)
+		err := setLogLevelFromEnv()
+		if (err != nil) != tc.wantError {
+			t.Errorf("setLogLevelFromEnv() with LOG_LEVEL=%q got error %v, want error = %v", tc.value, err, tc.wantError)
+		}
+		if !tc.wantError && stdLogger.level != tc.want {
+			t.Errorf("setLogLevelFromEnv() with LOG_LEVEL=%q set level %v, want %v", tc.value, stdLogger.level, tc.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+const metricsNamespace = "cloud_build_notifier"
+
+// metricLabelNames are the labels of every metric: the notifier's Go type and the config's `metadata.name`.
+var metricLabelNames = []string{"notifier", "config"}
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	messagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_received_total",
+		Help:      "Number of Pub/Sub messages received.",
+	}, metricLabelNames)
+	badMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bad_messages_total",
+		Help:      "Number of received messages that could not be decoded into a Build, including ignored ones.",
+	}, metricLabelNames)
+	filterMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "filter_matches_total",
+		Help:      "Number of Builds that matched a notification route's filter.",
+	}, metricLabelNames)
+	filterMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "filter_misses_total",
+		Help:      "Number of Builds that did not match a notification route's filter.",
+	}, metricLabelNames)
+	bindingFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "binding_resolution_failures_total",
+		Help:      "Number of times the params of a notification route could not be resolved for a Build.",
+	}, metricLabelNames)
+	sendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "send_errors_total",
+		Help:      "Number of SendNotification calls that returned an error.",
+	}, metricLabelNames)
+	sendLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "send_notification_duration_seconds",
+		Help:      "Latency of SendNotification calls, whether or not they succeeded.",
+		Buckets:   prometheus.DefBuckets,
+	}, metricLabelNames)
+
+	// Secrets are shared by every route, so their metrics are labeled by the secret's local name instead. Unlike its
+	// resource name, it is not redacted from `/configz`.
+	secretFetchFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_fetch_failures_total",
+		Help:      "Number of times a secret could not be fetched, including background refreshes.",
+	}, []string{"secret"})
+	secretAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "secret_age_seconds"),
+		"Time since a cached secret was last fetched successfully.",
+		[]string{"secret"}, nil)
+)
+
+func init() {
+	metricsRegistry.MustRegister(messagesReceived, badMessages, filterMatches, filterMisses, bindingFailures, sendErrors, sendLatency, secretFetchFailures)
+}
+
+// metricsHandler serves all of the notifier metrics in the Prometheus exposition format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// newMetricLabels returns the labels for metrics about the given notifier set up with the given config.
+func newMetricLabels(notifier Notifier, cfg *Config) prometheus.Labels {
+	var name string
+	if cfg.Metadata != nil {
+		name = cfg.Metadata.Name
+	}
+	return prometheus.Labels{"notifier": fmt.Sprintf("%T", notifier), "config": name}
+}
+
+// metricLabeler is implemented by Notifiers that wrap the user's notifier, so that their metrics are labeled with the
+// user's notifier type instead of their own.
+type metricLabeler interface {
+	metricLabels() prometheus.Labels
+}
+
+// metricLabelsFor returns the labels for metrics about the given notifier.
+func metricLabelsFor(notifier Notifier) prometheus.Labels {
+	if ml, ok := notifier.(metricLabeler); ok {
+		return ml.metricLabels()
+	}
+	return prometheus.Labels{"notifier": fmt.Sprintf("%T", notifier), "config": ""}
+}
+
+// instrumentedResolver is a BindingResolver that traces resolution and counts failures. It returns the params that the
+// router already resolved for the route's filter instead of resolving them again.
+type instrumentedResolver struct {
+	BindingResolver
+	labels prometheus.Labels
+}
+
+func (i *instrumentedResolver) Resolve(ctx context.Context, sg SecretGetter, build *cbpb.Build) (map[string]string, error) {
+	rp, err := i.resolveParams(ctx, sg, build)
+	if err != nil {
+		return nil, err
+	}
+	return rp.Values, nil
+}
+
+func (i *instrumentedResolver) resolveParams(ctx context.Context, sg SecretGetter, build *cbpb.Build) (*ResolvedParams, error) {
+	ctx, span := startSpan(ctx, "BindingResolver.Resolve")
+	defer span.End()
+	setBuildAttributes(span, build)
+
+	if rp, ok := resolvedParamsFor(ctx, i, build); ok {
+		span.SetAttributes(attribute.Bool("params.reused", true))
+		return rp, nil
+	}
+
+	rp, err := ResolveParams(ctx, i.BindingResolver, sg, build)
+	if err != nil {
+		bindingFailures.With(i.labels).Inc()
+	}
+	return rp, endSpan(span, err)
+}
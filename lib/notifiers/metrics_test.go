@@ -0,0 +1,115 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+type failingResolver struct{}
+
+func (failingResolver) Resolve(_ context.Context, _ SecretGetter, _ *cbpb.Build) (map[string]string, error) {
+	return nil, errors.New("no such path")
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: "cloud-build-notifiers/v1",
+		Metadata:   &Metadata{Name: "metrics-test"},
+		Spec: &Spec{
+			Notifications: []*Notification{{
+				Filter:   "build.status == Build.Status.FAILURE",
+				Delivery: map[string]interface{}{"name": "failures"},
+			}, {
+				Filter:   "build.status == Build.Status.SUCCESS",
+				Delivery: map[string]interface{}{"name": "successes"},
+			}},
+		},
+	}
+	rtr, err := newRouter(ctx, &recordingNotifier{rec: new(routeRecorder), sendErr: Permanent(errors.New("nope"))}, cfg, new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+
+	labels := prometheus.Labels{"notifier": "*notifiers.recordingNotifier", "config": "metrics-test"}
+	if got := rtr.metricLabels(); got["notifier"] != labels["notifier"] || got["config"] != labels["config"] {
+		t.Fatalf("router has metric labels %v, want %v", got, labels)
+	}
+
+	data, err := protojson.Marshal(proto.MessageV2(&cbpb.Build{Id: "1", Status: cbpb.Build_FAILURE}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := json.Marshal(&pubSubPushWrapper{Message: pubSubPushMessage{Data: data, ID: "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := newReceiver(rtr, &receiverParams{ignoreBadMessages: true, maxSendAttempts: 1})
+	for _, body := range []string{
+		string(good),
+		`{"message": {"data": "bm90IGEgYnVpbGQ=", "id": "2"}}`,
+		`not json`,
+	} {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	}
+
+	br := &instrumentedResolver{BindingResolver: failingResolver{}, labels: labels}
+	if _, err := br.Resolve(ctx, nil, new(cbpb.Build)); err == nil {
+		t.Error("Resolve succeeded unexpectedly")
+	}
+
+	for _, tc := range []struct {
+		name string
+		c    prometheus.Collector
+		want float64
+	}{
+		{"messages received", messagesReceived.With(labels), 3},
+		{"bad messages", badMessages.With(labels), 2},
+		{"filter matches", filterMatches.With(labels), 1},
+		{"filter misses", filterMisses.With(labels), 1},
+		{"binding failures", bindingFailures.With(labels), 1},
+		{"send errors", sendErrors.With(labels), 1},
+	} {
+		if got := testutil.ToFloat64(tc.c); got != tc.want {
+			t.Errorf("%s = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, err := ioutil.ReadAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const wantLine = `cloud_build_notifier_send_notification_duration_seconds_count{config="metrics-test",notifier="*notifiers.recordingNotifier"} 1`
+	if !strings.Contains(string(body), wantLine) {
+		t.Errorf("/metrics output does not contain %q:\n%s", wantLine, body)
+	}
+}
@@ -24,19 +24,25 @@ import (
 	"html/template"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
-	"strings"
+	"strconv"
+	"syscall"
 	"time"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/storage"
-	log "github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/checker/decls"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/api/iterator"
 	smpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
 	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -48,6 +54,10 @@ const (
 	cloudBuildTopic    = "cloud-builds"
 	defaultHTTPPort    = "8080"
 	secretRef          = "secretRef"
+
+	// Defaults for the in-process retries of retryable SendNotification errors.
+	defaultMaxSendAttempts = 3
+	defaultRetryBackoff    = time.Second
 )
 
 var (
@@ -84,23 +94,108 @@ type Metadata struct {
 }
 
 // Spec is the data container for the fields that are relevant to the functionality of the notifier.
+// Exactly one of Notification or Notifications must be set.
 type Spec struct {
-	Notification *Notification `yaml:"notification"`
-	Secrets      []*Secret     `yaml:"secrets"`
+	Notification  *Notification   `yaml:"notification"`
+	Notifications []*Notification `yaml:"notifications"`
+	Secrets       []*Secret       `yaml:"secrets"`
+	Dedup         *DedupConfig    `yaml:"dedup"`
+	// AllowOutOfOrderStatuses disables dropping Build statuses that arrive after a later status for the same Build.
+	AllowOutOfOrderStatuses bool `yaml:"allowOutOfOrderStatuses"`
+}
+
+// routes returns the list of notification routes in the Spec, regardless of whether it was configured with the singular
+// `notification` field or the `notifications` list.
+func (s *Spec) routes() []*Notification {
+	if s.Notification != nil {
+		return []*Notification{s.Notification}
+	}
+	return s.Notifications
 }
 
 // Notification is the data container for the fields that are relevant to the configuration of sending the notification.
 type Notification struct {
 	Filter   string                 `yaml:"filter"`
 	Delivery map[string]interface{} `yaml:"delivery"`
-	Params   map[string]string      `yaml:"params"`
+	// Params maps the names of params to their values (JSONPaths or `cel:` expressions). In YAML, they are the entries
+	// of `params` that are just a value.
+	Params map[string]string `yaml:"-"`
+	// ParamOptions maps the names of params declared with options (e.g. a `default`) to their declarations. In YAML,
+	// they are the entries of `params` that are a map. A param must not be in both Params and ParamOptions.
+	ParamOptions map[string]*Param `yaml:"-"`
+	Template     *Template         `yaml:"template"`
+}
+
+// notificationYAML is the YAML encoding of a Notification, in which Params and ParamOptions share the `params` map.
+type notificationYAML struct {
+	Filter   string                 `yaml:"filter"`
+	Delivery map[string]interface{} `yaml:"delivery"`
+	Params   map[string]*Param      `yaml:"params"`
 	Template *Template              `yaml:"template"`
 }
 
+// UnmarshalYAML decodes a Notification, splitting its `params` between Params and ParamOptions.
+func (n *Notification) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var ny notificationYAML
+	if err := unmarshal(&ny); err != nil {
+		return err
+	}
+	*n = Notification{Filter: ny.Filter, Delivery: ny.Delivery, Template: ny.Template}
+	for name, p := range ny.Params {
+		if p != nil && p.hasOptions() {
+			if n.ParamOptions == nil {
+				n.ParamOptions = map[string]*Param{}
+			}
+			n.ParamOptions[name] = p
+			continue
+		}
+		if n.Params == nil {
+			n.Params = map[string]string{}
+		}
+		if p != nil {
+			n.Params[name] = p.Value
+		} else {
+			n.Params[name] = ""
+		}
+	}
+	return nil
+}
+
+// MarshalYAML encodes a Notification with its Params and ParamOptions merged into `params`.
+func (n *Notification) MarshalYAML() (interface{}, error) {
+	ny := &notificationYAML{Filter: n.Filter, Delivery: n.Delivery, Template: n.Template}
+	params, err := n.allParams()
+	if err != nil {
+		return nil, err
+	}
+	if len(params) > 0 {
+		ny.Params = params
+	}
+	return ny, nil
+}
+
+// allParams returns the declarations of all of the Notification's params, whether they are in Params or ParamOptions.
+func (n *Notification) allParams() (map[string]*Param, error) {
+	params := map[string]*Param{}
+	for name, value := range n.Params {
+		params[name] = &Param{Value: value}
+	}
+	for name, p := range n.ParamOptions {
+		if _, ok := params[name]; ok {
+			return nil, fmt.Errorf("expected param %q to be in only one of Params and ParamOptions", name)
+		}
+		params[name] = p
+	}
+	return params, nil
+}
+
 type Template struct {
 	Type    string `yaml:"type"`
 	URI     string `yaml:"uri"`
 	Content string `yaml:"content"`
+	// Partials are the URIs of templates that the template can use with `{{template "name" .}}`, where the name is the
+	// file name without its extension. URIs that end with a `/` include every file directly under them.
+	Partials []string `yaml:"partials,omitempty"`
 }
 
 // TemplateView is the data container for the fields relevant to rendering a template
@@ -108,9 +203,13 @@ type Template struct {
 type TemplateView struct {
 	Build  *BuildView        `json:"Build"`
 	Params map[string]string `json:"Params"`
+	// Secrets are the values of the `spec.secrets` entries that the template uses, as returned by TemplateSecrets.Get.
+	// They are never encoded.
+	Secrets map[string]string `json:"-"`
 }
 
-// BuildView is the data container that contains the build
+// BuildView is the data container that contains the build, along with helper methods such as Duration and BranchOrTag
+// that templates and notifiers can use to describe it.
 type BuildView struct {
 	*cbpb.Build
 }
@@ -128,14 +227,17 @@ type Secret struct {
 
 // Copied from https://cloud.google.com/run/docs/tutorials/pubsub#looking_at_the_code.
 type pubSubPushMessage struct {
-	Data        []byte `json:"data,omitempty"`
-	ID          string `json:"id"`
-	PublishTime string `json:"publishTime"`
+	Data        []byte            `json:"data,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	ID          string            `json:"id"`
+	PublishTime string            `json:"publishTime"`
 }
 
 type pubSubPushWrapper struct {
 	Message      pubSubPushMessage
 	Subscription string `json:"subscription"`
+	// DeliveryAttempt is only set by Pub/Sub if the subscription has a dead-letter policy.
+	DeliveryAttempt int `json:"deliveryAttempt,omitempty"`
 }
 
 // Notifier is the interface type that users should implement for usage in Cloud Build notifiers.
@@ -158,23 +260,34 @@ type EventFilter interface {
 // CELPredicate is an EventFilter that uses a CEL program to determine if
 // notifications should be sent for a given Pub/Sub message.
 type CELPredicate struct {
-	prg cel.Program
+	prg        cel.Program
+	usesParams bool // Whether the filter refers to `params`.
 }
 
 // Apply returns true iff the underlying CEL program returns true for the given Build.
-func (c *CELPredicate) Apply(_ context.Context, build *cbpb.Build) bool {
-	out, _, err := c.prg.Eval(map[string]interface{}{"build": build})
+// The `previous`, `streak` and `attributes` variables are taken from the context, as set by the Pub/Sub receiver in
+// Main, and so are the `params`, as resolved by the router.
+func (c *CELPredicate) Apply(ctx context.Context, build *cbpb.Build) bool {
+	_, span := startSpan(ctx, "CELPredicate.Apply")
+	defer span.End()
+	setBuildAttributes(span, build)
+
+	out, _, err := c.prg.Eval(celActivation(ctx, build, paramsFromContext(ctx)))
 	if err != nil {
-		log.Errorf("failed to evaluate the CEL filter: %v", err)
+		Errorf(ctx, "failed to evaluate the CEL filter: %v", err)
+		endSpan(span, err)
 		return false
 	}
 
 	match, ok := out.Value().(bool)
 	if !ok {
-		log.Errorf("failed to convert output %v of CEL filter program to a boolean: %v", out, err)
+		err := fmt.Errorf("failed to convert output %v of CEL filter program to a boolean", out)
+		Errorf(ctx, "%v", err)
+		endSpan(span, err)
 		return false
 	}
 
+	span.SetAttributes(attribute.Bool("cel.match", match))
 	return match
 }
 
@@ -186,38 +299,37 @@ func Main(notifier Notifier) error {
 	if !flag.Parsed() {
 		flag.Parse()
 	}
+	if err := setLogLevelFromEnv(); err != nil {
+		return err
+	}
 	if *smoketest {
-		log.V(0).Infof("notifier smoketest: %T", notifier)
+		Infof(ctx, "notifier smoketest: %T", notifier)
 		return nil
 	}
 
 	if *setupCheck {
-		log.V(2).Info("starting setup check")
+		Debugf(ctx, "starting setup check")
 		cfg, err := decodeConfig(os.Stdin)
 		if err != nil {
 			return fmt.Errorf("failed to decode YAML config from stdin: %w", err)
 		}
 
 		if out, err := yaml.Marshal(cfg); err != nil {
-			log.Warningf("failed to re-encode config YAML: %v", err)
+			Warningf(ctx, "failed to re-encode config YAML: %v", err)
 		} else {
-			log.V(2).Infof("got re-encoded YAML from stdin:\n%s", string(out))
+			Debugf(ctx, "got re-encoded YAML from stdin:\n%s", string(out))
 		}
 
 		if err := validateConfig(cfg); err != nil {
 			return fmt.Errorf("failed to validate config during setup check: %w", err)
 		}
 
-		br, err := newResolver(cfg)
-		if err != nil {
-			return fmt.Errorf("failed to create BindingResolver during setup check: %w", err)
-		}
-
-		if err := notifier.SetUp(ctx, cfg, "", new(setupCheckSecretGetter), br); err != nil {
-			return fmt.Errorf("failed to run notifier.SetUp during setup check: %w", err)
+		// Templates are not fetched during the setup check since there is no GCS access.
+		if _, err := newRouter(ctx, notifier, cfg, new(setupCheckSecretGetter), nil); err != nil {
+			return fmt.Errorf("failed to set up notification routes during setup check: %w", err)
 		}
 
-		log.V(2).Infof("setup check successful")
+		Debugf(ctx, "setup check successful")
 		return nil
 	}
 
@@ -226,50 +338,100 @@ func Main(notifier Notifier) error {
 		return errors.New("expected CONFIG_PATH to be non-empty")
 	}
 
-	sc, err := storage.NewClient(ctx)
+	shutdownTracing, err := setUpTracing(ctx, notifier)
 	if err != nil {
-		return fmt.Errorf("failed to create new GCS client: %w", err)
+		return fmt.Errorf("failed to set up tracing: %w", err)
 	}
-	defer sc.Close()
+	defer func() {
+		if err := shutdownTracing(ctx); err != nil {
+			Warningf(ctx, "failed to shut down tracing: %v", err)
+		}
+	}()
+
+	// Canceled on SIGTERM (e.g. when Cloud Run scales down) or SIGINT to start a graceful shutdown. Only the receivers
+	// and background polling use it: the notifiers are set up with ctx, which is never canceled, since they might hold
+	// on to it (e.g. in their clients) and must keep working while in-flight notifications are drained.
+	sigCtx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	grf := new(lazyGCSReaderFactory)
+	defer grf.Close()
+	src := newConfigSource(grf)
 
-	smc, err := secretmanager.NewClient(ctx)
+	smc := new(lazySecretManager)
+	defer smc.Close()
+
+	secretTTL, err := durationFromEnv("SECRET_CACHE_TTL", defaultSecretCacheTTL)
 	if err != nil {
-		return fmt.Errorf("failed to create new SecretManager client: %w", err)
+		return err
+	}
+	secretRefresh, err := durationFromEnv("SECRET_REFRESH_INTERVAL", defaultSecretRefreshInterval)
+	if err != nil {
+		return err
+	}
+	// Every secret value is redacted from the logs once it has been fetched.
+	sm := newCachingSecretGetter(&redactingSecretGetter{newSecretGetter(smc)}, secretTTL)
+	metricsRegistry.MustRegister(sm)
+	if secretRefresh > 0 {
+		go sm.poll(sigCtx, secretRefresh)
 	}
-	defer smc.Close()
 
-	cfg, err := getGCSConfig(ctx, &actualGCSReaderFactory{sc}, cfgPath)
+	rl, err := newReloader(ctx, notifier, cfgPath, src, sm)
 	if err != nil {
-		return fmt.Errorf("failed to get config from GCS: %w", err)
+		return err
 	}
+	// Only the notification routes are reloaded; the settings below are read once at startup.
+	cfg := rl.cfg
 
-	if err := validateConfig(cfg); err != nil {
-		return fmt.Errorf("got invalid config from path %q: %w", cfgPath, err)
+	if v, ok := GetEnv("CONFIG_POLL_INTERVAL"); ok {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse CONFIG_POLL_INTERVAL %q: %w", v, err)
+		}
+		if interval > 0 {
+			Debugf(ctx, "polling %q for changes every %v", cfgPath, interval)
+			go rl.poll(sigCtx, interval)
+		}
 	}
-	log.V(2).Infof("got config from GCS (%q): %+v\n", cfgPath, cfg)
 
-	tmpl, err := parseTemplate(ctx, cfg.Spec.Notification.Template, &actualGCSReaderFactory{sc})
+	rp, err := receiverParamsFromEnv()
 	if err != nil {
-		return fmt.Errorf("failed to parse template from notiifer spec %q: %w", cfg.Spec.Notification.Template, err)
+		return fmt.Errorf("failed to get receiver params: %w", err)
 	}
 
-	sm := &actualSecretManager{client: smc}
-
-	br, err := newResolver(cfg)
+	rp.dedup, err = newDeduper(cfg.Spec.Dedup)
 	if err != nil {
-		return fmt.Errorf("failed to construct a binding resolver: %v", err)
+		return fmt.Errorf("failed to set up dedup: %w", err)
 	}
 
-	if err := notifier.SetUp(ctx, cfg, tmpl, sm, br); err != nil {
-		return fmt.Errorf("failed to call SetUp on notifier: %w", err)
+	if !cfg.Spec.AllowOutOfOrderStatuses {
+		rp.statuses = newStatusTracker(defaultStatusTrackerMaxEntries, defaultStatusTrackerTTL)
 	}
+	rp.history = newBuildHistory()
 
-	_, ignoreBadMessages := GetEnv("IGNORE_BAD_MESSAGES")
+	// Messages are pulled from a subscription instead of pushed to "/" if one is given.
+	subName, pull := GetEnv("PUBSUB_SUBSCRIPTION")
 
-	log.V(2).Infoln("starting HTTP server...")
+	Debugf(ctx, "starting HTTP server...")
 
-	// Our Pub/Sub push receiver.
-	http.HandleFunc("/", newReceiver(notifier, &receiverParams{ignoreBadMessages}))
+	if !pull {
+		// Our Pub/Sub push receiver.
+		http.HandleFunc("/", newReceiver(rl, rp))
+	}
+
+	// Serves Prometheus metrics about received messages and sent notifications.
+	http.Handle("/metrics", metricsHandler())
+
+	// Reports the loaded config and template versions and the error of the last reload, if any. Like /configz, it
+	// requires the same token as push requests if they are verified.
+	http.HandleFunc("/statusz", requireAuth(rp.auth, rl.statusHandler))
+
+	// Liveness and readiness probes. The notifier is only ready if it uses the current config.
+	http.HandleFunc("/livez", livezHandler)
+	http.HandleFunc("/readyz", rl.readyzHandler)
+
+	// Serves the loaded config, with secrets redacted, and the hashes of the active templates.
+	http.HandleFunc("/configz", requireAuth(rp.auth, rl.configzHandler))
 
 	// An auxilliary, healthz-style receiver.
 	// You can call this endpoint using the curl command here:
@@ -284,32 +446,62 @@ func Main(notifier Notifier) error {
 	if p, ok := GetEnv("PORT"); ok {
 		port = p
 	} else {
-		log.Warningf("PORT environment variable was not present, using %s instead", defaultHTTPPort)
+		Warningf(ctx, "PORT environment variable was not present, using %s instead", defaultHTTPPort)
 		port = defaultHTTPPort
 	}
 
-	// Block on the HTTP's health.
-	return http.ListenAndServe(":"+port, nil)
+	srv, shutdownTimeout, err := newServerFromEnv(":" + port)
+	if err != nil {
+		return fmt.Errorf("failed to set up HTTP server: %w", err)
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %w", srv.Addr, err)
+	}
+	if pull {
+		err = runPull(sigCtx, subName, srv, ln, shutdownTimeout, rl, rp)
+	} else {
+		// Block on the HTTP's health.
+		err = serve(sigCtx, srv, ln, shutdownTimeout)
+	}
+
+	// Pushed notifications that were still in flight after the shutdown timeout might still be using the notifier.
+	if errors.Is(err, errShutdownTimeout) && !pull {
+		Warningf(ctx, "not closing the notifier since notifications are still in flight")
+		return err
+	}
+	closeNotifier(ctx, rl, rp)
+	return err
 }
 
-func parseTemplate(ctx context.Context, tmpl *Template, grf gcsReaderFactory) (string, error) {
+func parseTemplate(ctx context.Context, tmpl *Template, src ConfigSource) (string, error) {
 	templateString := ""
 	if tmpl != nil {
 		if _, ok := allowedTemplateTypes[tmpl.Type]; !ok {
 			return "", fmt.Errorf("got invalid Template Type: %v", tmpl.Type)
 		}
 		if tmpl.URI != "" {
-			parsed, err := getGCSTemplate(ctx, grf, tmpl.URI)
+			parsed, err := getTemplate(ctx, src, tmpl.URI)
 			if err != nil {
-				return "", fmt.Errorf("failed to get template from GCS: %w", err)
+				return "", fmt.Errorf("failed to get template from %q: %w", tmpl.URI, err)
 			}
 			templateString = parsed
 		} else {
 			templateString = tmpl.Content
 		}
+		if len(tmpl.Partials) > 0 {
+			withP, err := withPartials(ctx, src, templateString, tmpl.Partials)
+			if err != nil {
+				return "", err
+			}
+			templateString = withP
+		}
 		if err := validateTemplate(templateString); err != nil {
 			return "", fmt.Errorf("got invalid template from path %q: %w", tmpl.URI, err)
 		}
+		if err := checkTemplateRefs(templateString); err != nil {
+			return "", fmt.Errorf("got invalid template from path %q: %w", tmpl.URI, err)
+		}
 	}
 	return templateString, nil
 
@@ -327,9 +519,36 @@ func (a *actualGCSReaderFactory) NewReader(ctx context.Context, bucket, object s
 	return a.client.Bucket(bucket).Object(object).NewReader(ctx)
 }
 
+func (a *actualGCSReaderFactory) Generation(ctx context.Context, bucket, object string) (int64, error) {
+	attrs, err := a.client.Bucket(bucket).Object(object).Attrs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Generation, nil
+}
+
+// List returns the names of the objects directly under the given prefix, leaving out the ones in "subdirectories".
+func (a *actualGCSReaderFactory) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	var objects []string
+	it := a.client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// With a Delimiter, the "subdirectories" are listed as synthetic entries that only have a Prefix.
+		if attrs.Prefix != "" {
+			continue
+		}
+		objects = append(objects, attrs.Name)
+	}
+}
+
 type actualSecretManager struct {
 	client *secretmanager.Client
-	// TODO(ljr): Do we want any sort of timed cache here?
 }
 
 func (a *actualSecretManager) GetSecret(ctx context.Context, name string) (string, error) {
@@ -349,71 +568,6 @@ func (c *setupCheckSecretGetter) GetSecret(_ context.Context, name string) (stri
 	return fmt.Sprintf("[SECRET VALUE FOR %q]", name), nil
 }
 
-// getGCSConfig fetches the YAML Config file from the given GCS path and returns the parsed Config.
-func getGCSConfig(ctx context.Context, grf gcsReaderFactory, path string) (*Config, error) {
-	if !gcsConfigPattern.MatchString(path) {
-		return nil, fmt.Errorf("expected path %q to match pattern %v", path, gcsConfigPattern)
-	}
-	// if trm := strings.TrimPrefix(path, "gs://"); trm != path {
-	// 	// path started with the prefix
-	// 	path = trm
-	// } else {
-	// 	return nil, fmt.Errorf("expected %q to start with `gs://`", path)
-	// }
-
-	// split := strings.SplitN(path, "/", 2)
-	// log.V(2).Infof("got path split: %+v", split)
-	// if len(split) != 2 {
-	// 	return nil, fmt.Errorf("path has incorrect format (expected form: `[gs://]bucket/path/to/object`): %q => %s", path, strings.Join(split, ", "))
-	// }
-	split := gcsConfigPattern.FindStringSubmatch(path)
-	if len(split) != 3 {
-		return nil, fmt.Errorf("path has incorrect format (expected form: `[gs://]bucket/path/to/object`): %q => %s", path, strings.Join(split, ", "))
-	}
-	bucket, object := split[1], split[2]
-	r, err := grf.NewReader(ctx, bucket, object)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get reader for (bucket=%q, object=%q): %w", bucket, object, err)
-	}
-	defer r.Close()
-
-	cfg, err := decodeConfig(r)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse configuration from YAML at %q: %w", path, err)
-	}
-
-	return cfg, nil
-}
-
-// getGCSConfig fetches the Template file from the given GCS path and returns the parsed Config.
-func getGCSTemplate(ctx context.Context, grf gcsReaderFactory, path string) (string, error) {
-	if trm := strings.TrimPrefix(path, "gs://"); trm != path {
-		// path started with the prefix
-		path = trm
-	} else {
-		return "", fmt.Errorf("expected %q to start with `gs://`", path)
-	}
-
-	split := strings.SplitN(path, "/", 2)
-	log.V(2).Infof("got path split: %+v", split)
-	if len(split) != 2 {
-		return "", fmt.Errorf("path has incorrect format (expected form: `[gs://]bucket/path/to/object`): %q => %s", path, strings.Join(split, ", "))
-	}
-
-	bucket, object := split[0], split[1]
-	r, err := grf.NewReader(ctx, bucket, object)
-	if err != nil {
-		return "", fmt.Errorf("failed to get reader for (bucket=%q, object=%q): %w", bucket, object, err)
-	}
-	defer r.Close()
-	tmpl, err := decodeTemplate(r)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse template at %q: %w", path, err)
-	}
-
-	return tmpl, nil
-}
-
 func decodeConfig(r io.Reader) (*Config, error) {
 	cfg := new(Config)
 	dcd := yaml.NewDecoder(r)
@@ -432,6 +586,7 @@ func decodeTemplate(r io.Reader) (string, error) {
 
 // validateConfig checks the following (or errors):
 // - apiVersion is one of allowedYAMLAPIVersions.
+// - exactly one of spec.notification or spec.notifications is present.
 // - user substitution names match the subNamePattern regexp.
 func validateConfig(cfg *Config) error {
 	if allowed := allowedYAMLAPIVersions[cfg.APIVersion]; !allowed {
@@ -443,23 +598,47 @@ func validateConfig(cfg *Config) error {
 		return errors.New("expected config.spec to be present")
 	}
 
-	if cfg.Spec.Notification == nil {
-		return errors.New("expected config.spec.notification to be present")
+	if cfg.Spec.Notification != nil && len(cfg.Spec.Notifications) > 0 {
+		return errors.New("expected only one of config.spec.notification and config.spec.notifications to be present")
+	}
+
+	if cfg.Spec.Notification == nil && len(cfg.Spec.Notifications) == 0 {
+		return errors.New("expected config.spec.notification or config.spec.notifications to be present")
+	}
+
+	for i, n := range cfg.Spec.Notifications {
+		if n == nil {
+			return fmt.Errorf("expected config.spec.notifications[%d] to be non-empty", i)
+		}
 	}
 
 	return nil
 }
 
 func validateTemplate(s string) error {
-	_, err := template.New("").Parse(s)
+	_, err := template.New("").Funcs(template.FuncMap(TemplateFuncs())).Parse(s)
 	return err
 }
 
-// MakeCELPredicate returns a CELPredicate for the given filter string of CEL code.
-func MakeCELPredicate(filter string) (*CELPredicate, error) {
+// newCELEnv returns the env that CEL filters and `cel:` params are compiled in.
+func newCELEnv() (*cel.Env, error) {
 	env, err := cel.NewEnv(
-		// Declare the `build` variable for useage in CEL programs.
-		cel.Declarations(decls.NewIdent("build", decls.NewObjectType(cloudBuildProtoPkg+".Build"), nil)),
+		// Declare the `build` variable for useage in CEL programs, along with the `previous` terminal Build for the same
+		// trigger and branch (or tag) and the `streak` of consecutive terminal Builds with the same status as `build`.
+		cel.Declarations(
+			decls.NewIdent("build", decls.NewObjectType(cloudBuildProtoPkg+".Build"), nil),
+			decls.NewIdent("previous", decls.NewObjectType(cloudBuildProtoPkg+".Build"), nil),
+			decls.NewIdent("streak", decls.Int, nil),
+		),
+		// Declare the `params` resolved from the route's Notification.Params, the `attributes` of the Pub/Sub message
+		// and the current time as `now`.
+		cel.Declarations(
+			decls.NewIdent("params", decls.NewMapType(decls.String, decls.String), nil),
+			decls.NewIdent("attributes", decls.NewMapType(decls.String, decls.String), nil),
+			decls.NewIdent("now", decls.Timestamp, nil),
+		),
+		// Declare the custom functions in celfuncs.go.
+		cel.Declarations(celFunctionDecls...),
 		// Register the `Build` type in the environment.
 		cel.Types(new(cbpb.Build)),
 		// `Container` is necessary for better (enum) scoping
@@ -469,6 +648,36 @@ func MakeCELPredicate(filter string) (*CELPredicate, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create a CEL env: %w", err)
 	}
+	return env, nil
+}
+
+// newCELProgram returns a program for the given checked AST that can call the custom functions in celfuncs.go.
+func newCELProgram(env *cel.Env, ast *cel.Ast) (cel.Program, error) {
+	// Not using cel.OptOptimize since it would evaluate calls with constant arguments (e.g. `hourOfDay("UTC")`) only
+	// once, when the program is created.
+	return env.Program(ast, cel.Functions(celFunctionOverloads...))
+}
+
+// celActivation returns the variables that a CEL program is evaluated with for the given Build and params. The
+// other variables are taken from the context.
+func celActivation(ctx context.Context, build *cbpb.Build, params map[string]string) map[string]interface{} {
+	previous, streak := buildHistoryFromContext(ctx)
+	return map[string]interface{}{
+		"build":      build,
+		"previous":   previous,
+		"streak":     streak,
+		"params":     params,
+		"attributes": messageAttributesFromContext(ctx),
+		"now":        celNow(),
+	}
+}
+
+// MakeCELPredicate returns a CELPredicate for the given filter string of CEL code.
+func MakeCELPredicate(filter string) (*CELPredicate, error) {
+	env, err := newCELEnv()
+	if err != nil {
+		return nil, err
+	}
 
 	ast, issues := env.Compile(filter)
 	if issues != nil && issues.Err() != nil {
@@ -479,79 +688,279 @@ func MakeCELPredicate(filter string) (*CELPredicate, error) {
 		return nil, fmt.Errorf("expected CEL filter %q to have a boolean result type, but was %v", filter, ast.ResultType())
 	}
 
-	prg, err := env.Program(ast, cel.EvalOptions(cel.OptOptimize))
+	prg, err := newCELProgram(env, ast)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create CEL program from filter %q: %w", filter, err)
 	}
 
-	return &CELPredicate{prg}, nil
+	return &CELPredicate{prg: prg, usesParams: usesIdent(ast.Expr(), "params")}, nil
 }
 
 // GetEnv fetches, logs, and returns the given environment variable. The returned boolean is true iff the value is non-empty.
 func GetEnv(name string) (string, bool) {
 	val := os.Getenv(name)
 	if val == "" {
-		log.V(2).Infof("env var %q is empty", name)
+		Debugf(context.Background(), "env var %q is empty", name)
 	} else {
-		log.V(2).Infof("env var %q is %q", name, val)
+		Debugf(context.Background(), "env var %q is %q", name, val)
 	}
 	return val, val != ""
 }
 
 type receiverParams struct {
 	ignoreBadMessages bool
+	// maxSendAttempts is the number of times SendNotification is called for a message that keeps failing with
+	// retryable errors before the message is nacked. Values less than 1 are treated as 1.
+	maxSendAttempts int
+	// retryBackoff is the delay before the first in-process retry. It is doubled after every retry.
+	retryBackoff time.Duration
+	// maxDeliveryAttempts, if positive, is the Pub/Sub delivery attempt on which a message that still fails with a
+	// retryable error is acked instead of nacked.
+	maxDeliveryAttempts int
+	// dedup, if non-nil, is used to drop messages and Build statuses that have already been handled.
+	dedup *deduper
+	// statuses, if non-nil, is used to drop Build statuses that arrive after a later status for the same Build.
+	statuses *statusTracker
+	// history, if non-nil, provides the `previous` and `streak` CEL variables.
+	history *buildHistory
+	// auth, if non-nil, is used to verify the OIDC token of every push request.
+	auth *pushVerifier
+}
+
+// receiverParamsFromEnv returns the receiverParams configured by the following environment variables:
+// - IGNORE_BAD_MESSAGES: if non-empty, Pub/Sub messages that are not Builds are acked.
+// - MAX_SEND_ATTEMPTS: the number of in-process SendNotification attempts for retryable errors.
+// - SEND_RETRY_BACKOFF: the delay before the first in-process retry (e.g. `500ms`).
+// - MAX_DELIVERY_ATTEMPTS: the Pub/Sub delivery attempt on which retryable errors are given up on.
+func receiverParamsFromEnv() (*receiverParams, error) {
+	_, ignoreBadMessages := GetEnv("IGNORE_BAD_MESSAGES")
+	params := &receiverParams{
+		ignoreBadMessages: ignoreBadMessages,
+		maxSendAttempts:   defaultMaxSendAttempts,
+		retryBackoff:      defaultRetryBackoff,
+	}
+
+	if v, ok := GetEnv("MAX_SEND_ATTEMPTS"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse MAX_SEND_ATTEMPTS %q: %w", v, err)
+		}
+		params.maxSendAttempts = n
+	}
+
+	if v, ok := GetEnv("SEND_RETRY_BACKOFF"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SEND_RETRY_BACKOFF %q: %w", v, err)
+		}
+		params.retryBackoff = d
+	}
+
+	if v, ok := GetEnv("MAX_DELIVERY_ATTEMPTS"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse MAX_DELIVERY_ATTEMPTS %q: %w", v, err)
+		}
+		params.maxDeliveryAttempts = n
+	}
+
+	params.auth = pushVerifierFromEnv()
+
+	return params, nil
+}
+
+// retryingNotifier is implemented by Notifiers that retry each part of a notification on their own, so that the
+// parts that already succeeded are not sent again.
+type retryingNotifier interface {
+	sendWithRetries(ctx context.Context, msgID string, build *cbpb.Build, params *receiverParams) error
+}
+
+// sendWithRetries sends a notification for the Build in the Pub/Sub message with the given ID, retrying retryable
+// errors within the in-process attempt budget. It returns the last error.
+func sendWithRetries(ctx context.Context, notifier Notifier, msgID string, build *cbpb.Build, params *receiverParams) error {
+	if rn, ok := notifier.(retryingNotifier); ok {
+		return rn.sendWithRetries(ctx, msgID, build, params)
+	}
+	return retrySend(ctx, params, func() error { return notifier.SendNotification(ctx, build) })
+}
+
+// retrySend calls send until it succeeds, fails with a PermanentError, or the in-process attempt budget is used up.
+// It returns the last error.
+func retrySend(ctx context.Context, params *receiverParams, send func() error) error {
+	backoff := params.retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || IsPermanent(err) || attempt >= params.maxSendAttempts {
+			return err
+		}
+
+		Warningf(ctx, "attempt %d of SendNotification failed with retryable error, retrying in %v: %v", attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
 }
 
 // newReceiver returns a Pub/Sub push HTTP receiving http.HandlerFunc that calls the given notifier.
 func newReceiver(notifier Notifier, params *receiverParams) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		var pspw pubSubPushWrapper
+		// Continue any trace that the sender propagated, e.g. in a CloudEvent's `traceparent` header.
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		if params.auth != nil {
+			if err := params.auth.verifyRequest(r); err != nil {
+				Errorf(ctx, "rejecting push request with an invalid token: %v", err)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		labels := metricLabelsFor(notifier)
+		messagesReceived.With(labels).Inc()
+
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Errorf("failed to read request message: %v", err)
+			badMessages.With(labels).Inc()
+			Errorf(ctx, "failed to read request message: %v", err)
 			http.Error(w, "Bad request body", http.StatusBadRequest)
 			return
 		}
 
-		if err := json.Unmarshal(body, &pspw); err != nil {
-			log.Errorf("failed to unmarshal body %q: %v", body, err)
+		pspw := new(pubSubPushWrapper)
+		if isCloudEvent(r) {
+			// Eventarc delivers Pub/Sub messages as CloudEvents instead of the Pub/Sub push envelope.
+			if pspw, err = decodeCloudEvent(r, body); err != nil {
+				badMessages.With(labels).Inc()
+				Errorf(ctx, "failed to decode CloudEvent with body %q: %v", body, err)
+				http.Error(w, "Bad CloudEvent", http.StatusBadRequest)
+				return
+			}
+		} else if err := json.Unmarshal(body, pspw); err != nil {
+			badMessages.With(labels).Inc()
+			Errorf(ctx, "failed to unmarshal body %q: %v", body, err)
 			http.Error(w, "Bad pubsub.Message JSON", http.StatusBadRequest)
 			return
 		}
 
-		log.V(2).Infof("got PubSub message with ID %q from subscription %q", pspw.Message.ID, pspw.Subscription)
+		switch handleMessage(ctx, notifier, params, pspw) {
+		case rejectMessage:
+			http.Error(w, "Bad Cloud Build Pub/Sub data", http.StatusBadRequest)
+		case nackMessage:
+			http.Error(w, "failed to send notification", http.StatusInternalServerError)
+		}
+	}
+}
+
+// messageOutcome is what a receiver should tell Pub/Sub once a message has been handled.
+type messageOutcome int
+
+const (
+	ackMessage    messageOutcome = iota
+	nackMessage                  // The message should be redelivered.
+	rejectMessage                // The message does not hold a Build. It is also redelivered unless acked by a receiver.
+)
+
+// handleMessage decodes the Build in the given Pub/Sub message and sends a notification for it. It is shared by the
+// push and pull receivers, which only differ in how they receive messages and report the outcome.
+func handleMessage(ctx context.Context, notifier Notifier, params *receiverParams, pspw *pubSubPushWrapper) messageOutcome {
+	ctx, span := startSpan(ctx, "HandleMessage")
+	defer span.End()
+	span.SetAttributes(attribute.String("messaging.message_id", pspw.Message.ID))
+	ctx = withLogMessageID(ctx, pspw.Message.ID)
+	ctx = withMessageAttributes(ctx, pspw.Message.Attributes)
+
+	Debugf(ctx, "got PubSub message from subscription %q (delivery attempt %d)", pspw.Subscription, pspw.DeliveryAttempt)
+
+	build := new(cbpb.Build)
+	// Be as lenient as possible in unmarshalling.
+	// `Unmarshal` will fail if we get a payload with a field that is unknown to the current proto version unless `DiscardUnknown` is set.
+	uo := protojson.UnmarshalOptions{
+		AllowPartial:   true,
+		DiscardUnknown: true,
+	}
+	bv2 := proto.MessageV2(build)
+	_, decodeSpan := startSpan(ctx, "DecodeBuild")
+	err := endSpan(decodeSpan, uo.Unmarshal(pspw.Message.Data, bv2))
+	decodeSpan.End()
+	if err != nil {
+		badMessages.With(metricLabelsFor(notifier)).Inc()
+		if params.ignoreBadMessages {
+			Warningf(ctx, "not attempting to handle unmarshal-able Pub/Sub message data=%q publishTime=%q which gave error: %v",
+				string(pspw.Message.Data), pspw.Message.PublishTime, err)
+			return ackMessage
+		}
+
+		Errorf(ctx, "failed to unmarshal PubSub message data=%q publishTime=%q into a Build: %v",
+			string(pspw.Message.Data), pspw.Message.PublishTime, err)
+		return rejectMessage
+	}
+	build = proto.MessageV1(bv2).(*cbpb.Build)
+	setBuildAttributes(span, build)
+	ctx = withLogBuild(ctx, build)
 
-		build := new(cbpb.Build)
-		// Be as lenient as possible in unmarshalling.
-		// `Unmarshal` will fail if we get a payload with a field that is unknown to the current proto version unless `DiscardUnknown` is set.
-		uo := protojson.UnmarshalOptions{
-			AllowPartial:   true,
-			DiscardUnknown: true,
+	if params.dedup != nil {
+		state, err := params.dedup.reserve(ctx, pspw.Message.ID, build)
+		if err != nil {
+			Warningf(ctx, "failed to check PubSub message for duplicates, handling it anyway: %v", err)
 		}
-		bv2 := proto.MessageV2(build)
-		if err := uo.Unmarshal(pspw.Message.Data, bv2); err != nil {
-			if params.ignoreBadMessages {
-				log.Warningf("not attempting to handle unmarshal-able Pub/Sub message id=%q data=%q publishTime=%q which gave error: %v",
-					pspw.Message.ID, string(pspw.Message.Data), pspw.Message.PublishTime, err)
-				return
-			}
+		switch state {
+		case dedupHandled:
+			Debugf(ctx, "acking duplicate PubSub message")
+			return ackMessage
+		case dedupInFlight:
+			// Not acked since the call that is handling it might still fail.
+			Debugf(ctx, "nacking PubSub message that is already being handled")
+			return nackMessage
+		}
+		// Released only after the message was recorded as handled, if it was.
+		defer params.dedup.release(pspw.Message.ID, build)
+	}
 
-			log.Errorf("failed to unmarshal PubSub message id=%q data=%q publishTime=%q into a Build: %v",
-				pspw.Message.ID, string(pspw.Message.Data), pspw.Message.PublishTime, err)
-			http.Error(w, "Bad Cloud Build Pub/Sub data", http.StatusBadRequest)
-			return
+	if params.statuses != nil && !params.statuses.advance(build) {
+		Debugf(ctx, "acking out-of-order PubSub message")
+		return ackMessage
+	}
+
+	if params.history != nil {
+		previous, streak := params.history.observe(build)
+		ctx = withBuildHistory(ctx, previous, streak)
+	}
+
+	Debugf(ctx, "attempting to send notification")
+	if err := sendWithRetries(ctx, notifier, pspw.Message.ID, build, params); err != nil {
+		if IsPermanent(err) {
+			Errorf(ctx, "acking PubSub message after SendNotification failed with a permanent error: %v", err)
+			recordHandled(ctx, params.dedup, pspw.Message.ID, build)
+			return ackMessage
 		}
-		build = proto.MessageV1(bv2).(*cbpb.Build)
 
-		log.V(2).Infof("got PubSub Build payload:\n%+v\nattempting to send notification", proto.MarshalTextString(build))
-		if err := notifier.SendNotification(ctx, build); err != nil {
-			log.Errorf("failed to run SendNotification: %v", err)
-			http.Error(w, "failed to send notification", http.StatusInternalServerError)
-			return
+		if params.maxDeliveryAttempts > 0 && pspw.DeliveryAttempt >= params.maxDeliveryAttempts {
+			Errorf(ctx, "acking PubSub message after SendNotification failed on delivery attempt %d of %d: %v",
+				pspw.DeliveryAttempt, params.maxDeliveryAttempts, err)
+			return ackMessage
 		}
 
-		log.V(2).Infof("acking PubSub message %q with Build payload:\n%v", pspw.Message.ID, proto.MarshalTextString(build))
+		Errorf(ctx, "failed to run SendNotification: %v", err)
+		endSpan(span, err)
+		return nackMessage
+	}
+
+	recordHandled(ctx, params.dedup, pspw.Message.ID, build)
+	Debugf(ctx, "acking PubSub message")
+	return ackMessage
+}
+
+// recordHandled records the given message as handled in the given deduper, if any.
+// Failures are only logged since the message has already been handled.
+func recordHandled(ctx context.Context, dd *deduper, msgID string, build *cbpb.Build) {
+	if dd == nil {
+		return
+	}
+	if err := dd.markHandled(ctx, msgID, build); err != nil {
+		Warningf(ctx, "failed to record PubSub message as handled: %v", err)
 	}
 }
 
@@ -240,6 +240,21 @@ func (f *fakeGCSReaderFactory) NewReader(_ context.Context, bucket, object strin
 	return ioutil.NopCloser(bytes.NewBufferString(s)), nil
 }
 
+func (f *fakeGCSReaderFactory) List(_ context.Context, bucket, prefix string) ([]string, error) {
+	var objects []string
+	for uri := range f.data {
+		object := strings.TrimPrefix(uri, "gs://"+bucket+"/")
+		if object == uri || !strings.HasPrefix(object, prefix) {
+			continue
+		}
+		// Like a storage.Query with a "/" Delimiter, leave out the objects in "subdirectories" of the prefix.
+		if !strings.Contains(strings.TrimPrefix(object, prefix), "/") {
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
 // It's annoying to update this config since YAML requires spaces but Go likes tabs.
 // Just keep everything at tabs and then replace accordingly.
 const validConfigYAMLWithTabs = `
@@ -354,21 +369,21 @@ func TestGetGCSConfig(t *testing.T) {
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			gotConfig, err := getGCSConfig(context.Background(), tc.fake, tc.path)
+			gotConfig, err := getConfig(context.Background(), &gcsConfigSource{grf: tc.fake}, tc.path)
 			if err != nil {
 				if tc.wantError {
 					t.Logf("got expected error: %v", err)
 					return
 				}
-				t.Fatalf("getGCSConfig(%q) failed: %v", tc.path, err)
+				t.Fatalf("getConfig(%q) failed: %v", tc.path, err)
 			}
 
 			if tc.wantError {
-				t.Fatalf("getGCSConfig(%q) succeeded unexpectedly: %v", tc.path, err)
+				t.Fatalf("getConfig(%q) succeeded unexpectedly: %v", tc.path, err)
 			}
 
 			if diff := cmp.Diff(tc.wantConfig, gotConfig); diff != "" {
-				t.Fatalf("getGCSConfig(%q) produced unexpected Config diff: (want- got+)\n%s", tc.path, diff)
+				t.Fatalf("getConfig(%q) produced unexpected Config diff: (want- got+)\n%s", tc.path, diff)
 			}
 		})
 	}
@@ -413,13 +428,13 @@ func TestGetGCSTemplate(t *testing.T) {
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			gotTemplate, err := getGCSTemplate(context.Background(), tc.fake, tc.path)
+			gotTemplate, err := getTemplate(context.Background(), &gcsConfigSource{grf: tc.fake}, tc.path)
 			if err != nil {
 				if tc.wantError {
 					t.Logf("got expected error: %v", err)
 					return
 				}
-				t.Fatalf("getGCSTemplate(%q) failed: %v", tc.path, err)
+				t.Fatalf("getTemplate(%q) failed: %v", tc.path, err)
 			}
 			if validateTemplate(gotTemplate) != nil && tc.wantError {
 				t.Logf("got expected error: %v", err)
@@ -427,11 +442,11 @@ func TestGetGCSTemplate(t *testing.T) {
 			}
 
 			if tc.wantError {
-				t.Fatalf("getGCSTemplate(%q) succeeded unexpectedly: %v", tc.path, err)
+				t.Fatalf("getTemplate(%q) succeeded unexpectedly: %v", tc.path, err)
 			}
 
 			if diff := cmp.Diff(tc.wantTemplate, gotTemplate); diff != "" {
-				t.Fatalf("getGCSTemplate(%q) produced unexpected template diff: (want- got+)\n%s", tc.path, diff)
+				t.Fatalf("getTemplate(%q) produced unexpected template diff: (want- got+)\n%s", tc.path, diff)
 			}
 		})
 	}
@@ -638,6 +653,29 @@ func TestValidateConfig(t *testing.T) {
 				Spec:       &Spec{},
 			},
 			wantErr: true,
+		}, {
+			name: "valid spec.notifications",
+			cfg: &Config{
+				APIVersion: "cloud-build-notifiers/v1",
+				Spec:       &Spec{Notifications: []*Notification{{}, {}}},
+			},
+		}, {
+			name: "both spec.notification and spec.notifications",
+			cfg: &Config{
+				APIVersion: "cloud-build-notifiers/v1",
+				Spec: &Spec{
+					Notification:  &Notification{},
+					Notifications: []*Notification{{}},
+				},
+			},
+			wantErr: true,
+		}, {
+			name: "empty spec.notifications entry",
+			cfg: &Config{
+				APIVersion: "cloud-build-notifiers/v1",
+				Spec:       &Spec{Notifications: []*Notification{{}, nil}},
+			},
+			wantErr: true,
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
@@ -799,6 +837,102 @@ func TestNewReceiverError(t *testing.T) {
 	}
 }
 
+// flakyNotifier is a Notifier whose SendNotification returns the next error in errs on every call (or nil when there
+// are none left).
+type flakyNotifier struct {
+	errs  []error
+	calls int
+}
+
+func (n *flakyNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (n *flakyNotifier) SendNotification(_ context.Context, _ *cbpb.Build) error {
+	n.calls++
+	if len(n.errs) == 0 {
+		return nil
+	}
+	err := n.errs[0]
+	n.errs = n.errs[1:]
+	return err
+}
+
+func TestNewReceiverRetries(t *testing.T) {
+	errSplines := errors.New("failed to reticulate splines")
+	for _, tc := range []struct {
+		name            string
+		errs            []error
+		params          *receiverParams
+		deliveryAttempt int
+		wantCode        int
+		wantCalls       int
+	}{{
+		name:      "permanent error is acked",
+		errs:      []error{Permanent(errSplines)},
+		params:    &receiverParams{maxSendAttempts: 3},
+		wantCode:  http.StatusOK,
+		wantCalls: 1,
+	}, {
+		name:      "retryable error succeeds in-process",
+		errs:      []error{Retryable(errSplines), errSplines},
+		params:    &receiverParams{maxSendAttempts: 3, retryBackoff: time.Millisecond},
+		wantCode:  http.StatusOK,
+		wantCalls: 3,
+	}, {
+		name:      "retryable error exhausts budget",
+		errs:      []error{errSplines, errSplines, errSplines},
+		params:    &receiverParams{maxSendAttempts: 2, retryBackoff: time.Millisecond},
+		wantCode:  http.StatusInternalServerError,
+		wantCalls: 2,
+	}, {
+		name:      "permanent error stops retries",
+		errs:      []error{errSplines, Permanent(errSplines), errSplines},
+		params:    &receiverParams{maxSendAttempts: 3, retryBackoff: time.Millisecond},
+		wantCode:  http.StatusOK,
+		wantCalls: 2,
+	}, {
+		name:            "retryable error before max delivery attempts",
+		errs:            []error{errSplines},
+		params:          &receiverParams{maxDeliveryAttempts: 5},
+		deliveryAttempt: 4,
+		wantCode:        http.StatusInternalServerError,
+		wantCalls:       1,
+	}, {
+		name:            "retryable error on max delivery attempt is acked",
+		errs:            []error{errSplines},
+		params:          &receiverParams{maxDeliveryAttempts: 5},
+		deliveryAttempt: 5,
+		wantCode:        http.StatusOK,
+		wantCalls:       1,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			j, err := protojson.Marshal(proto.MessageV2(&cbpb.Build{Id: "some-build-id"}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := wrapperToBuffer(t, &pubSubPushWrapper{
+				Message:         pubSubPushMessage{ID: "id-does-not-matter", Data: j},
+				DeliveryAttempt: tc.deliveryAttempt,
+			})
+
+			n := &flakyNotifier{errs: tc.errs}
+			handler := newReceiver(n, tc.params)
+			req := httptest.NewRequest(http.MethodPost, "http://notifer.example.com/", body)
+			w := httptest.NewRecorder()
+
+			handler(w, req)
+
+			if s := w.Result().StatusCode; s != tc.wantCode {
+				t.Errorf("result.StatusCode = %d, expected %d", s, tc.wantCode)
+			}
+			if n.calls != tc.wantCalls {
+				t.Errorf("SendNotification was called %d times, expected %d", n.calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
 type fatalNotifier struct {
 	t *testing.T
 }
@@ -886,7 +1020,7 @@ func TestParseTemplate(t *testing.T) {
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			got, err := parseTemplate(ctx, tc.tmpl, validFakeFactory)
+			got, err := parseTemplate(ctx, tc.tmpl, newConfigSource(validFakeFactory))
 			if err != nil {
 				if !tc.wantErr {
 					t.Fatalf("parseTemplate(%v) got unexpected error: %v", tc.tmpl, err)
@@ -0,0 +1,332 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	googleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+	// jwksMaxAge is how long fetched keys are used before they are fetched again.
+	jwksMaxAge = time.Hour
+	// jwksMinRefreshInterval limits how often keys are fetched again, e.g. because a token used an unknown key ID or
+	// the last fetch failed.
+	jwksMinRefreshInterval = time.Minute
+	// jwksFetchTimeout bounds fetching the keys, including reading the response.
+	jwksFetchTimeout = 10 * time.Second
+	// tokenClockSkew is how far the issue and expiry times of a token may be off from the local clock.
+	tokenClockSkew = time.Minute
+)
+
+var defaultTokenIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// pushVerifier checks the OIDC token that Pub/Sub attaches to push requests in the `Authorization` header.
+type pushVerifier struct {
+	jwksURL  string
+	client   *http.Client
+	audience string
+	issuers  map[string]bool
+	emails   map[string]bool // Allowed service account emails. Any email is allowed if empty.
+
+	mtx         sync.Mutex
+	keys        map[string]*rsa.PublicKey // Map of key ID => its public key.
+	fetched     time.Time                 // When keys was last fetched successfully.
+	lastAttempt time.Time                 // When keys was last fetched, successfully or not.
+	fetching    chan struct{}             // Closed once the fetch in progress, if any, is done.
+	now         func() time.Time
+}
+
+// newPushVerifier returns a pushVerifier for tokens with the given audience that are signed by a key in the JWKS at the
+// given URL, issued by one of the given issuers and, if any emails are given, issued to one of those emails.
+func newPushVerifier(jwksURL, audience string, issuers, emails []string) *pushVerifier {
+	v := &pushVerifier{
+		jwksURL:  jwksURL,
+		client:   &http.Client{Timeout: jwksFetchTimeout},
+		audience: audience,
+		issuers:  map[string]bool{},
+		emails:   map[string]bool{},
+		now:      time.Now,
+	}
+	for _, iss := range issuers {
+		v.issuers[iss] = true
+	}
+	for _, e := range emails {
+		v.emails[e] = true
+	}
+	return v
+}
+
+// pushVerifierFromEnv returns a pushVerifier configured by the environment, or nil if push requests should not be
+// verified. Verification is enabled by setting PUSH_AUTH_AUDIENCE.
+func pushVerifierFromEnv() *pushVerifier {
+	audience, ok := GetEnv("PUSH_AUTH_AUDIENCE")
+	if !ok {
+		return nil
+	}
+
+	jwksURL := googleJWKSURL
+	if u, ok := GetEnv("PUSH_AUTH_JWKS_URL"); ok {
+		jwksURL = u
+	}
+
+	issuers := defaultTokenIssuers
+	if v, ok := GetEnv("PUSH_AUTH_ISSUERS"); ok {
+		issuers = splitList(v)
+	}
+
+	var emails []string
+	if v, ok := GetEnv("PUSH_AUTH_SERVICE_ACCOUNTS"); ok {
+		emails = splitList(v)
+	}
+
+	return newPushVerifier(jwksURL, audience, issuers, emails)
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type tokenClaims struct {
+	Issuer        string `json:"iss"`
+	Audience      string `json:"aud"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	IssuedAt      int64  `json:"iat"`
+	Expiry        int64  `json:"exp"`
+}
+
+// verifyRequest checks the bearer token of the given push request.
+func (v *pushVerifier) verifyRequest(r *http.Request) error {
+	authz := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(authz) < len(prefix) || !strings.EqualFold(authz[:len(prefix)], prefix) {
+		return errors.New("expected an `Authorization: Bearer` header")
+	}
+	_, err := v.verify(r.Context(), authz[len(prefix):])
+	return err
+}
+
+// requireAuth returns a handler that serves the request with the given handler only if the given pushVerifier, if
+// any, accepts its bearer token. It guards the auxiliary endpoints that expose the config, so that they are not served
+// to anyone who can reach a notifier behind unauthenticated ingress.
+func requireAuth(auth *pushVerifier, h http.HandlerFunc) http.HandlerFunc {
+	if auth == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.verifyRequest(r); err != nil {
+			Warningf(r.Context(), "rejecting %s request with an invalid token: %v", r.URL.Path, err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// verify checks the signature and claims of the given RS256-signed JWT and returns its claims.
+func (v *pushVerifier) verify(ctx context.Context, token string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("expected token to have three parts")
+	}
+
+	header := new(tokenHeader)
+	if err := decodeTokenPart(parts[0], header); err != nil {
+		return nil, fmt.Errorf("failed to decode token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("got unsupported token algorithm %q (expected RS256)", header.Alg)
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("failed to verify token signature: %w", err)
+	}
+
+	claims := new(tokenClaims)
+	if err := decodeTokenPart(parts[1], claims); err != nil {
+		return nil, fmt.Errorf("failed to decode token claims: %w", err)
+	}
+
+	now := v.now()
+	if exp := time.Unix(claims.Expiry, 0); now.After(exp.Add(tokenClockSkew)) {
+		return nil, fmt.Errorf("token expired at %v", exp)
+	}
+	if iat := time.Unix(claims.IssuedAt, 0); now.Add(tokenClockSkew).Before(iat) {
+		return nil, fmt.Errorf("token was issued in the future at %v", iat)
+	}
+	if !v.issuers[claims.Issuer] {
+		return nil, fmt.Errorf("got unexpected token issuer %q", claims.Issuer)
+	}
+	if claims.Audience != v.audience {
+		return nil, fmt.Errorf("got unexpected token audience %q (expected %q)", claims.Audience, v.audience)
+	}
+	if len(v.emails) > 0 {
+		if !claims.EmailVerified {
+			return nil, fmt.Errorf("token email %q is not verified", claims.Email)
+		}
+		if !v.emails[claims.Email] {
+			return nil, fmt.Errorf("token email %q is not one of the allowed service accounts", claims.Email)
+		}
+	}
+
+	return claims, nil
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// key returns the public key with the given ID, fetching the JWKS if the keys are stale or do not include it. The JWKS
+// is fetched without holding the lock, by one caller at a time, and at most once per jwksMinRefreshInterval once it has
+// been fetched successfully. It is fetched with its own timeout instead of the caller's context, so that a canceled
+// request does not leave every other one without keys. If a refresh fails, the cached key is used even if it is stale.
+func (v *pushVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mtx.Lock()
+	if key, ok := v.keys[kid]; ok && v.now().Sub(v.fetched) < jwksMaxAge {
+		v.mtx.Unlock()
+		return key, nil
+	}
+	wait := v.fetching
+	// Until the keys are fetched once, every request would fail anyway, so failed fetches are not throttled.
+	fetch := wait == nil && (v.fetched.IsZero() || v.now().Sub(v.lastAttempt) >= jwksMinRefreshInterval)
+	if fetch {
+		v.fetching = make(chan struct{})
+		v.lastAttempt = v.now()
+	}
+	v.mtx.Unlock()
+
+	var fetchErr error
+	if fetch {
+		fctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+		var keys map[string]*rsa.PublicKey
+		keys, fetchErr = fetchJWKS(fctx, v.client, v.jwksURL)
+		cancel()
+		v.mtx.Lock()
+		if fetchErr == nil {
+			v.keys, v.fetched = keys, v.now()
+		}
+		close(v.fetching)
+		v.fetching = nil
+		v.mtx.Unlock()
+	} else if wait != nil {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		if fetchErr != nil {
+			Warningf(ctx, "failed to refresh JWKS, using the cached key %q: %v", kid, fetchErr)
+		}
+		return key, nil
+	}
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	return nil, fmt.Errorf("got token signed with unknown key ID %q", kid)
+}
+
+type jwks struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// fetchJWKS returns the RSA keys in the JWKS at the given URL.
+func fetchJWKS(ctx context.Context, client *http.Client, url string) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a new HTTP request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS from %q: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got a non-OK response status %q (%d) fetching JWKS from %q", resp.Status, resp.StatusCode, url)
+	}
+
+	set := new(jwks)
+	if err := json.NewDecoder(resp.Body).Decode(set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS from %q: %w", url, err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode modulus of key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode exponent of key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,369 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testAudience = "https://my-notifier.a.run.app/"
+	testEmail    = "pusher@my-project.iam.gserviceaccount.com"
+)
+
+// signToken returns an RS256 JWT with the given header and claims, signed by the given key.
+func signToken(t *testing.T, key *rsa.PrivateKey, header, claims interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	unsigned := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// newJWKSServer serves the public part of the given keys as a JWKS.
+func newJWKSServer(t *testing.T, keys map[string]*rsa.PrivateKey) *httptest.Server {
+	t.Helper()
+	set := map[string][]map[string]string{}
+	for kid, k := range keys {
+		set["keys"] = append(set["keys"], map[string]string{
+			"kid": kid,
+			"kty": "RSA",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		})
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(set)
+	}))
+}
+
+func mustGenerateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestPushVerifier(t *testing.T) {
+	key := mustGenerateKey(t)
+	otherKey := mustGenerateKey(t)
+	ts := newJWKSServer(t, map[string]*rsa.PrivateKey{"key-1": key})
+	defer ts.Close()
+
+	now := time.Now()
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"aud":            testAudience,
+			"email":          testEmail,
+			"email_verified": true,
+			"iat":            now.Add(-time.Minute).Unix(),
+			"exp":            now.Add(time.Hour).Unix(),
+		}
+	}
+	withClaim := func(name string, value interface{}) map[string]interface{} {
+		c := validClaims()
+		c[name] = value
+		return c
+	}
+	rs256 := map[string]string{"alg": "RS256", "kid": "key-1"}
+
+	for _, tc := range []struct {
+		name      string
+		token     string
+		wantError bool
+	}{{
+		name:  "valid",
+		token: signToken(t, key, rs256, validClaims()),
+	}, {
+		name:      "wrong audience",
+		token:     signToken(t, key, rs256, withClaim("aud", "https://elsewhere.example.com/")),
+		wantError: true,
+	}, {
+		name:      "wrong issuer",
+		token:     signToken(t, key, rs256, withClaim("iss", "https://evil.example.com")),
+		wantError: true,
+	}, {
+		name:      "expired",
+		token:     signToken(t, key, rs256, withClaim("exp", now.Add(-time.Hour).Unix())),
+		wantError: true,
+	}, {
+		name:      "issued in the future",
+		token:     signToken(t, key, rs256, withClaim("iat", now.Add(time.Hour).Unix())),
+		wantError: true,
+	}, {
+		name:      "email not allowed",
+		token:     signToken(t, key, rs256, withClaim("email", "someone@example.com")),
+		wantError: true,
+	}, {
+		name:      "email not verified",
+		token:     signToken(t, key, rs256, withClaim("email_verified", false)),
+		wantError: true,
+	}, {
+		name:      "signed by another key",
+		token:     signToken(t, otherKey, rs256, validClaims()),
+		wantError: true,
+	}, {
+		name:      "unknown key ID",
+		token:     signToken(t, otherKey, map[string]string{"alg": "RS256", "kid": "key-2"}, validClaims()),
+		wantError: true,
+	}, {
+		name:      "unsigned",
+		token:     strings.Join(strings.Split(signToken(t, key, map[string]string{"alg": "none", "kid": "key-1"}, validClaims()), ".")[:2], ".") + ".",
+		wantError: true,
+	}, {
+		name:      "garbage",
+		token:     "not-a-token",
+		wantError: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newPushVerifier(ts.URL, testAudience, defaultTokenIssuers, []string{testEmail})
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+
+			err := v.verifyRequest(req)
+			if err != nil {
+				if tc.wantError {
+					t.Logf("got expected error: %v", err)
+					return
+				}
+				t.Fatalf("verifyRequest failed: %v", err)
+			}
+			if tc.wantError {
+				t.Fatal("verifyRequest succeeded unexpectedly")
+			}
+		})
+	}
+}
+
+func TestPushVerifierKeyRefresh(t *testing.T) {
+	ctx := context.Background()
+	key := mustGenerateKey(t)
+	jwks := newJWKSServer(t, map[string]*rsa.PrivateKey{"key-1": key})
+	defer jwks.Close()
+
+	var fetches int
+	failing := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if failing {
+			http.Error(w, "oops", http.StatusServiceUnavailable)
+			return
+		}
+		jwks.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	clk := &fakeClock{t: time.Unix(1000, 0)}
+	v := newPushVerifier(ts.URL, testAudience, defaultTokenIssuers, nil)
+	v.now = clk.now
+
+	mustGetKey := func(kid string, wantFetches int) {
+		t.Helper()
+		if _, err := v.key(ctx, kid); err != nil {
+			t.Errorf("key(%q) failed: %v", kid, err)
+		}
+		if fetches != wantFetches {
+			t.Errorf("key(%q) fetched the JWKS %d times in total, want %d", kid, fetches, wantFetches)
+		}
+	}
+
+	mustGetKey("key-1", 1)
+	mustGetKey("key-1", 1)
+
+	// Stale keys are still used if they fail to refresh, and the failed refresh is not tried again right away.
+	failing = true
+	clk.t = clk.t.Add(jwksMaxAge)
+	mustGetKey("key-1", 2)
+	mustGetKey("key-1", 2)
+
+	if _, err := v.key(ctx, "key-2"); err == nil {
+		t.Error("key(\"key-2\") succeeded unexpectedly")
+	}
+	if fetches != 2 {
+		t.Errorf("key(\"key-2\") fetched the JWKS within the minimum refresh interval")
+	}
+
+	failing = false
+	clk.t = clk.t.Add(jwksMinRefreshInterval)
+	mustGetKey("key-1", 3)
+}
+
+func TestPushVerifierFirstFetchCanceled(t *testing.T) {
+	key := mustGenerateKey(t)
+	jwks := newJWKSServer(t, map[string]*rsa.PrivateKey{"key-1": key})
+	defer jwks.Close()
+
+	// The first fetch fails as if its request had timed out, and the request itself is canceled.
+	var fetches int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if fetches == 1 {
+			http.Error(w, "timed out", http.StatusGatewayTimeout)
+			return
+		}
+		jwks.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	clk := &fakeClock{t: time.Unix(1000, 0)}
+	v := newPushVerifier(ts.URL, testAudience, defaultTokenIssuers, nil)
+	v.now = clk.now
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := v.key(canceled, "key-1"); err == nil {
+		t.Error("key(\"key-1\") succeeded unexpectedly for the failed first fetch")
+	}
+
+	// The keys are fetched again right away since none were ever fetched, despite the minimum refresh interval.
+	if _, err := v.key(context.Background(), "key-1"); err != nil {
+		t.Errorf("key(\"key-1\") failed after a failed first fetch: %v", err)
+	}
+	if fetches != 2 {
+		t.Errorf("fetched the JWKS %d times, want 2", fetches)
+	}
+
+	// A canceled request does not cancel the fetch of the keys.
+	v = newPushVerifier(jwks.URL, testAudience, defaultTokenIssuers, nil)
+	if _, err := v.key(canceled, "key-1"); err != nil {
+		t.Errorf("key(\"key-1\") failed for a canceled request: %v", err)
+	}
+}
+
+func TestNewReceiverWithPushAuth(t *testing.T) {
+	key := mustGenerateKey(t)
+	ts := newJWKSServer(t, map[string]*rsa.PrivateKey{"key-1": key})
+	defer ts.Close()
+
+	token := signToken(t, key, map[string]string{"alg": "RS256", "kid": "key-1"}, map[string]interface{}{
+		"iss": "accounts.google.com",
+		"aud": testAudience,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	body := `{"message": {"data": "e30=", "id": "some-id"}, "subscription": "some-sub"}`
+
+	for _, tc := range []struct {
+		name      string
+		authz     string
+		wantCode  int
+		wantCalls int
+	}{{
+		name:      "valid token",
+		authz:     "Bearer " + token,
+		wantCode:  http.StatusOK,
+		wantCalls: 1,
+	}, {
+		name:     "no token",
+		wantCode: http.StatusUnauthorized,
+	}, {
+		name:     "basic auth",
+		authz:    "Basic dXNlcjpwYXNz",
+		wantCode: http.StatusUnauthorized,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			n := new(flakyNotifier)
+			params := &receiverParams{
+				maxSendAttempts: 1,
+				// Any service account is allowed.
+				auth: newPushVerifier(ts.URL, testAudience, defaultTokenIssuers, nil),
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			if tc.authz != "" {
+				req.Header.Set("Authorization", tc.authz)
+			}
+			w := httptest.NewRecorder()
+
+			newReceiver(n, params)(w, req)
+			if w.Code != tc.wantCode {
+				t.Errorf("got response code %d, want %d", w.Code, tc.wantCode)
+			}
+			if n.calls != tc.wantCalls {
+				t.Errorf("SendNotification was called %d times, want %d", n.calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	key := mustGenerateKey(t)
+	ts := newJWKSServer(t, map[string]*rsa.PrivateKey{"key-1": key})
+	defer ts.Close()
+
+	token := signToken(t, key, map[string]string{"alg": "RS256", "kid": "key-1"}, map[string]interface{}{
+		"iss": "accounts.google.com",
+		"aud": testAudience,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	ok := func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "config") }
+
+	for _, tc := range []struct {
+		name     string
+		auth     *pushVerifier
+		authz    string
+		wantCode int
+	}{{
+		name:     "no verification",
+		wantCode: http.StatusOK,
+	}, {
+		name:     "valid token",
+		auth:     newPushVerifier(ts.URL, testAudience, defaultTokenIssuers, nil),
+		authz:    "Bearer " + token,
+		wantCode: http.StatusOK,
+	}, {
+		name:     "no token",
+		auth:     newPushVerifier(ts.URL, testAudience, defaultTokenIssuers, nil),
+		wantCode: http.StatusUnauthorized,
+	}} {
+		req := httptest.NewRequest(http.MethodGet, "/configz", nil)
+		if tc.authz != "" {
+			req.Header.Set("Authorization", tc.authz)
+		}
+		w := httptest.NewRecorder()
+		requireAuth(tc.auth, ok)(w, req)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got response code %d, want %d", tc.name, w.Code, tc.wantCode)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+const (
+	defaultStatusTrackerTTL        = 24 * time.Hour
+	defaultStatusTrackerMaxEntries = 10000
+
+	terminalStatusRank = 4
+)
+
+// statusRanks orders Build statuses by where they occur in a Build's lifecycle.
+// All terminal statuses share the same (highest) rank.
+var statusRanks = map[cbpb.Build_Status]int{
+	cbpb.Build_STATUS_UNKNOWN: 0,
+	cbpb.Build_PENDING:        1,
+	cbpb.Build_QUEUED:         2,
+	cbpb.Build_WORKING:        3,
+	cbpb.Build_SUCCESS:        terminalStatusRank,
+	cbpb.Build_FAILURE:        terminalStatusRank,
+	cbpb.Build_INTERNAL_ERROR: terminalStatusRank,
+	cbpb.Build_TIMEOUT:        terminalStatusRank,
+	cbpb.Build_CANCELLED:      terminalStatusRank,
+	cbpb.Build_EXPIRED:        terminalStatusRank,
+}
+
+// isTerminalStatus returns true iff the given status is the last one a Build will have.
+func isTerminalStatus(s cbpb.Build_Status) bool {
+	return statusRanks[s] == terminalStatusRank
+}
+
+type trackedStatus struct {
+	buildID string
+	rank    int
+	expires time.Time
+}
+
+// statusTracker remembers the latest lifecycle stage seen for each Build so that statuses that arrive out of order
+// (e.g. a WORKING message after a SUCCESS message) can be dropped. Builds are forgotten in LRU order or after a TTL.
+type statusTracker struct {
+	mtx        sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	lru        *list.List               // Most recently updated Builds first.
+	builds     map[string]*list.Element // Map of Build ID => its element in lru.
+	now        func() time.Time
+}
+
+func newStatusTracker(maxEntries int, ttl time.Duration) *statusTracker {
+	return &statusTracker{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		lru:        list.New(),
+		builds:     map[string]*list.Element{},
+		now:        time.Now,
+	}
+}
+
+// advance records the given Build's status and returns true, unless a later status has already been seen for that
+// Build, in which case it returns false. Builds without an ID or with an unknown status are always let through.
+func (s *statusTracker) advance(build *cbpb.Build) bool {
+	rank, ok := statusRanks[build.Status]
+	if build.Id == "" || !ok {
+		return true
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := s.now()
+	if el, ok := s.builds[build.Id]; ok {
+		ts := el.Value.(*trackedStatus)
+		if now.Before(ts.expires) && rank < ts.rank {
+			return false
+		}
+		ts.rank = rank
+		ts.expires = now.Add(s.ttl)
+		s.lru.MoveToFront(el)
+		return true
+	}
+
+	s.builds[build.Id] = s.lru.PushFront(&trackedStatus{buildID: build.Id, rank: rank, expires: now.Add(s.ttl)})
+	for s.lru.Len() > s.maxEntries {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.builds, oldest.Value.(*trackedStatus).buildID)
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestStatusTracker(t *testing.T) {
+	clk := &fakeClock{t: time.Unix(1000, 0)}
+	s := newStatusTracker(2, time.Hour)
+	s.now = clk.now
+
+	for _, tc := range []struct {
+		name    string
+		build   *cbpb.Build
+		advance time.Duration
+		want    bool
+	}{{
+		name:  "first status",
+		build: &cbpb.Build{Id: "a", Status: cbpb.Build_QUEUED},
+		want:  true,
+	}, {
+		name:  "later status",
+		build: &cbpb.Build{Id: "a", Status: cbpb.Build_SUCCESS},
+		want:  true,
+	}, {
+		name:  "stale status",
+		build: &cbpb.Build{Id: "a", Status: cbpb.Build_WORKING},
+		want:  false,
+	}, {
+		name:  "repeated terminal status",
+		build: &cbpb.Build{Id: "a", Status: cbpb.Build_SUCCESS},
+		want:  true,
+	}, {
+		name:  "other build",
+		build: &cbpb.Build{Id: "b", Status: cbpb.Build_WORKING},
+		want:  true,
+	}, {
+		name:  "no build ID",
+		build: &cbpb.Build{Status: cbpb.Build_QUEUED},
+		want:  true,
+	}, {
+		name:  "third build evicts the first",
+		build: &cbpb.Build{Id: "c", Status: cbpb.Build_SUCCESS},
+		want:  true,
+	}, {
+		name:  "evicted build is forgotten",
+		build: &cbpb.Build{Id: "a", Status: cbpb.Build_WORKING},
+		want:  true,
+	}, {
+		name:    "expired build is forgotten",
+		build:   &cbpb.Build{Id: "c", Status: cbpb.Build_QUEUED},
+		advance: 2 * time.Hour,
+		want:    true,
+	}} {
+		clk.t = clk.t.Add(tc.advance)
+		if got := s.advance(tc.build); got != tc.want {
+			t.Errorf("%s: advance(%v) = %v, want %v", tc.name, tc.build, got, tc.want)
+		}
+	}
+}
+
+func TestReceiverDropsOutOfOrderStatuses(t *testing.T) {
+	n := new(flakyNotifier)
+	handler := newReceiver(n, &receiverParams{statuses: newStatusTracker(100, time.Hour)})
+
+	for i, b := range []*cbpb.Build{
+		{Id: "some-build", Status: cbpb.Build_QUEUED},
+		{Id: "some-build", Status: cbpb.Build_SUCCESS},
+		{Id: "some-build", Status: cbpb.Build_WORKING},
+	} {
+		j, err := protojson.Marshal(proto.MessageV2(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := wrapperToBuffer(t, &pubSubPushWrapper{Message: pubSubPushMessage{ID: "id-does-not-matter", Data: j}})
+		req := httptest.NewRequest(http.MethodPost, "http://notifer.example.com/", body)
+		w := httptest.NewRecorder()
+
+		handler(w, req)
+
+		if s := w.Result().StatusCode; s != http.StatusOK {
+			t.Errorf("message %d: result.StatusCode = %d, expected %d", i, s, http.StatusOK)
+		}
+	}
+
+	if n.calls != 2 {
+		t.Errorf("SendNotification was called %d times, expected 2", n.calls)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+// Param types that resolved params are coerced to.
+const (
+	paramTypeString = "string"
+	paramTypeInt    = "int"
+	paramTypeJSON   = "json"
+)
+
+// Param is the declaration of a param along with its options, as in Notification.ParamOptions. In YAML, it is either
+// just its value or a map with the value and its options.
+type Param struct {
+	// Value is a JSONPath such as `$(build.id)` or a `cel:` expression.
+	Value string `yaml:"value"`
+	// SecretRef, if set instead of Value, is the name of the `spec.secrets` entry whose value is used.
+	SecretRef string `yaml:"secretRef"`
+	// Default, if set, is used instead of failing when the value does not resolve (e.g. a missing substitution).
+	Default *string `yaml:"default"`
+	// Optional params that do not resolve and have no default are left out instead of failing.
+	Optional bool `yaml:"optional"`
+	// Type is the type that the resolved value is coerced to: `string` (the default), `int` or `json`.
+	Type string `yaml:"type"`
+}
+
+// UnmarshalYAML decodes a Param from either a string, which is its value, or a map.
+func (p *Param) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*p = Param{Value: value}
+		return nil
+	}
+
+	// Avoid calling this method recursively.
+	type param Param
+	return unmarshal((*param)(p))
+}
+
+// MarshalYAML encodes a Param without options as just its value.
+func (p *Param) MarshalYAML() (interface{}, error) {
+	if !p.hasOptions() {
+		return p.Value, nil
+	}
+	type param Param
+	return (*param)(p), nil
+}
+
+// hasOptions returns true iff the Param is more than just its value.
+func (p *Param) hasOptions() bool {
+	return p.SecretRef != "" || p.Default != nil || p.Optional || p.Type != ""
+}
+
+// ResolvedParams are the params that a BindingResolver resolved for a Build.
+type ResolvedParams struct {
+	// Values maps the names of the resolved params to their values.
+	Values map[string]string
+	// Defaulted are the sorted names of the params that did not resolve and got their default or, if they are
+	// optional, were left out of Values.
+	Defaulted []string
+}
+
+// paramsResolver is implemented by BindingResolvers that can report which params were defaulted.
+type paramsResolver interface {
+	resolveParams(context.Context, SecretGetter, *cbpb.Build) (*ResolvedParams, error)
+}
+
+// ResolveParams resolves the params for the given Build with the given BindingResolver, such as the one passed to
+// Notifier.SetUp, and also returns which of them were defaulted. Resolvers that cannot tell are assumed to not
+// have defaulted any params.
+func ResolveParams(ctx context.Context, resolver BindingResolver, sg SecretGetter, build *cbpb.Build) (*ResolvedParams, error) {
+	if pr, ok := resolver.(paramsResolver); ok {
+		return pr.resolveParams(ctx, sg, build)
+	}
+	values, err := resolver.Resolve(ctx, sg, build)
+	if err != nil {
+		return nil, err
+	}
+	return &ResolvedParams{Values: values}, nil
+}
+
+// coerceParam converts the given resolved value to the given param type. Integers are normalized and `json` values
+// are kept if they are already valid JSON (e.g. a list) and quoted as a JSON string otherwise.
+func coerceParam(value, typ string) (string, error) {
+	switch typ {
+	case "", paramTypeString:
+		return value, nil
+	case paramTypeInt:
+		i, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("failed to coerce %q to an int: %w", value, err)
+		}
+		return strconv.FormatInt(i, 10), nil
+	case paramTypeJSON:
+		if json.Valid([]byte(value)) {
+			buf := new(bytes.Buffer)
+			if err := json.Compact(buf, []byte(value)); err != nil {
+				return "", err
+			}
+			return buf.String(), nil
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	default:
+		return "", fmt.Errorf("got unknown param type %q (expected one of `string`, `int` or `json`)", typ)
+	}
+}
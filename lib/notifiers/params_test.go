@@ -0,0 +1,219 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"gopkg.in/yaml.v2"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestNotificationParamsYAML(t *testing.T) {
+	const in = `
+filter: build.status == Build.Status.FAILURE
+params:
+  branch: $(build.substitutions.BRANCH_NAME)
+  pr:
+    value: $(build.substitutions._PR_NUMBER)
+    type: int
+    optional: true
+  tag:
+    value: $(build.substitutions.TAG_NAME)
+    default: none
+`
+	got := new(Notification)
+	if err := yaml.Unmarshal([]byte(in), got); err != nil {
+		t.Fatalf("failed to decode notification: %v", err)
+	}
+	want := &Notification{
+		Filter: "build.status == Build.Status.FAILURE",
+		Params: map[string]string{"branch": "$(build.substitutions.BRANCH_NAME)"},
+		ParamOptions: map[string]*Param{
+			"pr":  {Value: "$(build.substitutions._PR_NUMBER)", Type: "int", Optional: true},
+			"tag": {Value: "$(build.substitutions.TAG_NAME)", Default: stringPtr("none")},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("got unexpected notification (want- got+):\n%s", diff)
+	}
+
+	out, err := yaml.Marshal(got)
+	if err != nil {
+		t.Fatalf("failed to encode notification: %v", err)
+	}
+	roundTripped := new(Notification)
+	if err := yaml.Unmarshal(out, roundTripped); err != nil {
+		t.Fatalf("failed to decode encoded notification: %v", err)
+	}
+	// The encoded notification has an empty `delivery` map.
+	if diff := cmp.Diff(want, roundTripped, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("got unexpected notification after a round trip (want- got+):\n%s", diff)
+	}
+
+	// A param cannot be declared twice.
+	dup := &Notification{
+		Params:       map[string]string{"tag": "$(build.substitutions.TAG_NAME)"},
+		ParamOptions: map[string]*Param{"tag": {Value: "$(build.substitutions.TAG_NAME)", Optional: true}},
+	}
+	if _, err := yaml.Marshal(dup); err == nil {
+		t.Error("yaml.Marshal unexpectedly succeeded for a param in both Params and ParamOptions")
+	}
+	if _, err := newResolver(&Config{Spec: &Spec{Notification: dup}}, nil); err == nil {
+		t.Error("newResolver unexpectedly succeeded for a param in both Params and ParamOptions")
+	}
+}
+
+func TestCoerceParam(t *testing.T) {
+	for _, tc := range []struct {
+		value, typ string
+		want       string
+		wantErr    bool
+	}{
+		{value: "hello", want: "hello"},
+		{value: "hello", typ: "string", want: "hello"},
+		{value: " 0042 ", typ: "int", want: "42"},
+		{value: "4.2", typ: "int", wantErr: true},
+		{value: "hello", typ: "json", want: `"hello"`},
+		{value: `say "hi"`, typ: "json", want: `"say \"hi\""`},
+		{value: `[1, 2]`, typ: "json", want: `[1,2]`},
+		{value: "hello", typ: "float", wantErr: true},
+	} {
+		got, err := coerceParam(tc.value, tc.typ)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("coerceParam(%q, %q) got error %v, want error = %v", tc.value, tc.typ, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("coerceParam(%q, %q) = %q, want %q", tc.value, tc.typ, got, tc.want)
+		}
+	}
+}
+
+func TestResolveParamOptions(t *testing.T) {
+	params := map[string]*Param{
+		"branch":   {Value: "$(build.substitutions.BRANCH_NAME)", Default: stringPtr("no-branch")},
+		"pr":       {Value: "$(build.substitutions._PR_NUMBER)", Type: "int", Optional: true},
+		"attempts": {Value: "$(build.substitutions._ATTEMPTS)", Type: "int", Default: stringPtr("1")},
+		"tags":     {Value: "cel: build.tags", Type: "json"},
+		"id":       {Value: "$(build.id)"},
+	}
+	r, err := newResolver(&Config{Spec: &Spec{Notification: &Notification{ParamOptions: params}}}, nil)
+	if err != nil {
+		t.Fatalf("newResolver failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		build         *cbpb.Build
+		want          map[string]string
+		wantDefaulted []string
+	}{{
+		name: "branch build",
+		build: &cbpb.Build{Id: "b1", Tags: []string{"a"}, Substitutions: map[string]string{
+			"BRANCH_NAME": "main",
+			"_PR_NUMBER":  "12",
+			"_ATTEMPTS":   "3",
+		}},
+		want: map[string]string{"branch": "main", "pr": "12", "attempts": "3", "tags": `["a"]`, "id": "b1"},
+	}, {
+		name:          "tag build",
+		build:         &cbpb.Build{Id: "b2", Substitutions: map[string]string{"TAG_NAME": "v1"}},
+		want:          map[string]string{"branch": "no-branch", "attempts": "1", "tags": "[]", "id": "b2"},
+		wantDefaulted: []string{"attempts", "branch", "pr"},
+	}, {
+		name:          "not an int",
+		build:         &cbpb.Build{Id: "b3", Substitutions: map[string]string{"BRANCH_NAME": "main", "_ATTEMPTS": "many"}},
+		want:          map[string]string{"branch": "main", "attempts": "1", "tags": "[]", "id": "b3"},
+		wantDefaulted: []string{"attempts", "pr"},
+	}} {
+		got, err := ResolveParams(context.Background(), r, nil, tc.build)
+		if err != nil {
+			t.Fatalf("%s: ResolveParams failed: %v", tc.name, err)
+		}
+		if diff := cmp.Diff(tc.want, got.Values); diff != "" {
+			t.Errorf("%s: ResolveParams got unexpected params (want- got+):\n%s", tc.name, diff)
+		}
+		if diff := cmp.Diff(tc.wantDefaulted, got.Defaulted); diff != "" {
+			t.Errorf("%s: ResolveParams got unexpected defaulted params (want- got+):\n%s", tc.name, diff)
+		}
+	}
+
+	// Params without a default that are not optional still fail the resolution.
+	required, err := newResolver(&Config{Spec: &Spec{Notification: &Notification{ParamOptions: map[string]*Param{
+		"branch": {Value: "$(build.substitutions.BRANCH_NAME)"},
+	}}}}, nil)
+	if err != nil {
+		t.Fatalf("newResolver failed: %v", err)
+	}
+	if _, err := required.Resolve(context.Background(), nil, new(cbpb.Build)); err == nil {
+		t.Error("Resolve unexpectedly succeeded for a missing required param")
+	}
+}
+
+func TestResolveSecretRefParam(t *testing.T) {
+	cfg := &Config{Spec: &Spec{
+		Notification: &Notification{ParamOptions: map[string]*Param{
+			"token": {SecretRef: "api-token"},
+			"id":    {Value: "$(build.id)"},
+		}},
+		Secrets: []*Secret{{LocalName: "api-token", ResourceName: "projects/p/secrets/token/versions/latest"}},
+	}}
+	sg := &fakeSecretGetter{secrets: map[string]string{"projects/p/secrets/token/versions/latest": "s3cret"}}
+	r, err := newResolver(cfg, sg)
+	if err != nil {
+		t.Fatalf("newResolver failed: %v", err)
+	}
+
+	got, err := r.Resolve(context.Background(), nil, &cbpb.Build{Id: "b1"})
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if diff := cmp.Diff(map[string]string{"token": "s3cret", "id": "b1"}, got); diff != "" {
+		t.Errorf("Resolve got unexpected params (want- got+):\n%s", diff)
+	}
+}
+
+func TestNewResolverParamErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		param *Param
+	}{{
+		name:  "unknown type",
+		param: &Param{Value: "$(build.id)", Type: "float"},
+	}, {
+		name:  "bad default",
+		param: &Param{Value: "$(build.id)", Type: "int", Default: stringPtr("none")},
+	}, {
+		name: "no value",
+	}, {
+		name:  "value and secret",
+		param: &Param{Value: "$(build.id)", SecretRef: "token"},
+	}, {
+		name:  "unknown secret",
+		param: &Param{SecretRef: "nope"},
+	}} {
+		cfg := &Config{Spec: &Spec{Notification: &Notification{ParamOptions: map[string]*Param{"p": tc.param}}}}
+		if _, err := newResolver(cfg, nil); err == nil {
+			t.Errorf("%s: newResolver unexpectedly succeeded", tc.name)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// partialURIs returns the URIs of the partial files for the given `partials` entries, listing the files under any
+// entry that ends with a `/`.
+func partialURIs(ctx context.Context, src ConfigSource, entries []string) ([]string, error) {
+	var uris []string
+	for _, e := range entries {
+		if !strings.HasSuffix(e, "/") {
+			uris = append(uris, e)
+			continue
+		}
+		ls, ok := src.(listingConfigSource)
+		if !ok {
+			return nil, fmt.Errorf("cannot list the partials under %q", e)
+		}
+		listed, err := ls.List(ctx, e)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the partials under %q: %w", e, err)
+		}
+		sort.Strings(listed)
+		uris = append(uris, listed...)
+	}
+	return uris, nil
+}
+
+// partialName returns the name that the partial at the given URI is defined as: its file name without the extension,
+// e.g. `header` for `gs://bucket/partials/header.tmpl`.
+func partialName(uri string) string {
+	base := path.Base(uri)
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// withPartials returns the given template with every partial at the given `partials` entries defined in front of it,
+// so that it can use them with `{{template "name" .}}`. Each partial is parsed on its own, so that one that does not
+// parse is reported with its URI and cannot change the rest of the template (e.g. with a stray `{{end}}`). The
+// templates that a partial defines itself with `{{define}}` can be used too.
+func withPartials(ctx context.Context, src ConfigSource, tmpl string, entries []string) (string, error) {
+	uris, err := partialURIs(ctx, src, entries)
+	if err != nil {
+		return "", err
+	}
+
+	var trees []*parse.Tree
+	defined := map[string]string{} // Map of template name => the URI of the partial that defined it.
+	for _, uri := range uris {
+		name := partialName(uri)
+		partial, err := getTemplate(ctx, src, uri)
+		if err != nil {
+			return "", fmt.Errorf("failed to get partial from %q: %w", uri, err)
+		}
+		t, err := template.New(name).Funcs(TemplateFuncs()).Parse(partial)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse partial from %q: %w", uri, err)
+		}
+		for _, at := range t.Templates() {
+			if at.Tree == nil {
+				continue
+			}
+			if other, ok := defined[at.Name()]; ok {
+				return "", fmt.Errorf("got partials %q and %q that both define %q", other, uri, at.Name())
+			}
+			defined[at.Name()] = uri
+			trees = append(trees, at.Tree)
+		}
+	}
+	// Sorted so that the template, whose hash is reported by `/configz`, does not change between loads.
+	sort.Slice(trees, func(i, j int) bool { return trees[i].Name < trees[j].Name })
+
+	var b strings.Builder
+	for _, tree := range trees {
+		// The parsed trees print back as template text that parses to the same trees.
+		fmt.Fprintf(&b, "{{define %q}}%s{{end}}", tree.Name, tree.Root.String())
+	}
+	b.WriteString(tmpl)
+	return b.String(), nil
+}
+
+// checkTemplateRefs returns an error if the given template uses a template (such as a partial) that it does not
+// define, which would otherwise only fail once a notification is sent.
+func checkTemplateRefs(s string) error {
+	t, err := template.New("").Funcs(TemplateFuncs()).Parse(s)
+	if err != nil {
+		return err
+	}
+
+	defined := map[string]bool{}
+	var trees []*parse.Tree
+	for _, at := range t.Templates() {
+		defined[at.Name()] = true
+		trees = append(trees, at.Tree)
+	}
+
+	var missing []string
+	for _, tree := range trees {
+		if tree == nil || tree.Root == nil {
+			continue
+		}
+		walkTemplate(tree.Root, func(n parse.Node) {
+			if tn, ok := n.(*parse.TemplateNode); ok && !defined[tn.Name] {
+				missing = append(missing, tn.Name)
+			}
+		})
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("template uses undefined templates %q", missing)
+	}
+	return nil
+}
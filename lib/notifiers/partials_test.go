@@ -0,0 +1,204 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+func TestParseTemplateWithPartials(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"footer.tmpl": "-- sent by {{.Params.team}}",
+		"status.json": `{{.Build.StatusEmoji}} {{.Build.Status}}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src := newConfigSource(&fakeGCSReaderFactory{data: map[string]string{
+		"gs://bucket/partials/header.tmpl":   "Build {{.Build.ShortID}}",
+		"gs://bucket/partials/status.tmpl":   "{{.Build.Status}}",
+		"gs://bucket/partials/":              "",
+		"gs://bucket/templates/slack.json":   `{{template "header" .}}: {{template "status" .}}`,
+		"gs://bucket/library/nested/x.tmpl":  "x",
+		"gs://bucket/library/nested/y.tmpl":  "y",
+		"gs://bucket/library/other/x.tmpl":   "other x",
+		"gs://bucket/templates/broken.tmpl":  "{{if}}",
+		"gs://bucket/templates/plain.tmpl":   "{{.Build.Id}}",
+		"gs://bucket/templates/missing.tmpl": `{{template "nowhere" .}}`,
+		"gs://bucket/templates/nested.tmpl":  `{{template "x" .}}`,
+		"gs://bucket/templates/escape.tmpl":  `{{end}}{{define "status"}}hijacked`,
+		"gs://bucket/helpers/defines.tmpl":   `{{define "id"}}{{.Build.Id}}{{end}}{{define "emoji"}}{{.Build.StatusEmoji}}{{end}}`,
+		"gs://bucket/helpers/statuses.tmpl":  `{{define "status"}}{{.Build.Status}}{{end}}`,
+	}})
+
+	view := &TemplateView{
+		Build:  &BuildView{Build: &cbpb.Build{Id: "0123456789", Status: cbpb.Build_SUCCESS}},
+		Params: map[string]string{"team": "infra"},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		tmpl      *Template
+		want      string // The output of the parsed template for the view above.
+		wantError bool
+		wantURI   string // The URI that the error must name, if any.
+	}{{
+		name: "gcs prefix",
+		tmpl: &Template{Type: "golang", URI: "gs://bucket/templates/slack.json", Partials: []string{"gs://bucket/partials/"}},
+		want: "Build 01234567: SUCCESS",
+	}, {
+		name: "single files",
+		tmpl: &Template{
+			Type:     "golang",
+			Content:  `{{template "header" .}} {{template "footer" .}}`,
+			Partials: []string{"gs://bucket/partials/header.tmpl", "file://" + filepath.Join(dir, "footer.tmpl")},
+		},
+		want: "Build 01234567 -- sent by infra",
+	}, {
+		name: "directory",
+		tmpl: &Template{Type: "golang", Content: `{{template "status" .}} {{template "footer" .}}`, Partials: []string{"file://" + dir + "/"}},
+		want: "✅ SUCCESS -- sent by infra",
+	}, {
+		name: "unused partials",
+		tmpl: &Template{Type: "golang", URI: "gs://bucket/templates/plain.tmpl", Partials: []string{"gs://bucket/partials/"}},
+		want: "0123456789",
+	}, {
+		name:      "same name",
+		tmpl:      &Template{Type: "golang", Content: "", Partials: []string{"gs://bucket/partials/", "file://" + dir + "/"}},
+		wantError: true,
+	}, {
+		name: "defines in partial",
+		tmpl: &Template{Type: "golang", Content: `{{template "emoji" .}} {{template "id" .}}`, Partials: []string{"gs://bucket/helpers/defines.tmpl"}},
+		want: "✅ 0123456789",
+	}, {
+		name:      "define in partial with the same name",
+		tmpl:      &Template{Type: "golang", Content: "", Partials: []string{"gs://bucket/helpers/statuses.tmpl", "gs://bucket/partials/status.tmpl"}},
+		wantError: true,
+	}, {
+		name:      "prefix is not recursive",
+		tmpl:      &Template{Type: "golang", URI: "gs://bucket/templates/nested.tmpl", Partials: []string{"gs://bucket/library/"}},
+		wantError: true,
+	}, {
+		name:      "partial escapes its define",
+		tmpl:      &Template{Type: "golang", Content: `{{template "status" .}}`, Partials: []string{"gs://bucket/templates/escape.tmpl", "gs://bucket/partials/status.tmpl"}},
+		wantError: true,
+		wantURI:   "gs://bucket/templates/escape.tmpl",
+	}, {
+		name:      "undefined partial",
+		tmpl:      &Template{Type: "golang", URI: "gs://bucket/templates/missing.tmpl", Partials: []string{"gs://bucket/partials/"}},
+		wantError: true,
+	}, {
+		name:      "undefined partial without partials",
+		tmpl:      &Template{Type: "golang", URI: "gs://bucket/templates/slack.json"},
+		wantError: true,
+	}, {
+		name:      "invalid partial",
+		tmpl:      &Template{Type: "golang", Content: "", Partials: []string{"gs://bucket/templates/broken.tmpl"}},
+		wantError: true,
+		wantURI:   "gs://bucket/templates/broken.tmpl",
+	}, {
+		name:      "missing partial",
+		tmpl:      &Template{Type: "golang", Content: "", Partials: []string{"gs://bucket/partials/nowhere.tmpl"}},
+		wantError: true,
+	}, {
+		name:      "unlistable prefix",
+		tmpl:      &Template{Type: "golang", Content: "", Partials: []string{"https://example.com/partials/"}},
+		wantError: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTemplate(ctx, tc.tmpl, src)
+			if err != nil {
+				if tc.wantError {
+					if !strings.Contains(err.Error(), tc.wantURI) {
+						t.Errorf("parseTemplate got error %q, want it to name %q", err, tc.wantURI)
+					}
+					return
+				}
+				t.Fatalf("parseTemplate failed: %v", err)
+			}
+			if tc.wantError {
+				t.Fatalf("parseTemplate unexpectedly succeeded with %q", got)
+			}
+
+			// The template is parsed by notifiers with either package.
+			tt, err := template.New("t").Funcs(TemplateFuncs()).Parse(got)
+			if err != nil {
+				t.Fatalf("failed to parse %q with text/template: %v", got, err)
+			}
+			ht, err := htmltemplate.New("t").Funcs(htmltemplate.FuncMap(TemplateFuncs())).Parse(got)
+			if err != nil {
+				t.Fatalf("failed to parse %q with html/template: %v", got, err)
+			}
+			for _, tmpl := range []templateExecutor{tt, ht} {
+				var buf bytes.Buffer
+				if err := tmpl.Execute(&buf, view); err != nil {
+					t.Fatalf("Execute failed: %v", err)
+				}
+				if buf.String() != tc.want {
+					t.Errorf("%T got %q, want %q", tmpl, buf.String(), tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSourceVersionsWithPartials(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "header.tmpl"), []byte("header"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := &reloader{cfgPath: "env://NOTIFIERS_TEST_CONFIG", src: newConfigSource(nil)}
+	cfg := &Config{Spec: &Spec{Notification: &Notification{Template: &Template{
+		Type:     "golang",
+		Content:  `{{template "header" .}}`,
+		Partials: []string{"file://" + dir + "/"},
+	}}}}
+
+	os.Setenv("NOTIFIERS_TEST_CONFIG", "config")
+	defer os.Unsetenv("NOTIFIERS_TEST_CONFIG")
+	before, err := r.sourceVersions(ctx, cfg)
+	if err != nil {
+		t.Fatalf("sourceVersions failed: %v", err)
+	}
+	if _, ok := before["file://"+dir+"/header.tmpl"]; !ok {
+		t.Errorf("sourceVersions = %v, want the version of the partial", before)
+	}
+
+	// Adding a partial changes the versions.
+	if err := ioutil.WriteFile(filepath.Join(dir, "footer.tmpl"), []byte("footer"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	after, err := r.sourceVersions(ctx, cfg)
+	if err != nil {
+		t.Fatalf("sourceVersions failed: %v", err)
+	}
+	if equalVersions(before, after) {
+		t.Errorf("sourceVersions = %v after adding a partial, want a change from %v", after, before)
+	}
+}
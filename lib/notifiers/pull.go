@@ -0,0 +1,166 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const defaultPullMaxOutstandingMessages = 10
+
+var subscriptionPattern = regexp.MustCompile(`^projects/([^/]+)/subscriptions/([^/]+)$`)
+
+// pullSubscription is the part of *pubsub.Subscription that the pull receiver uses.
+type pullSubscription interface {
+	Receive(ctx context.Context, f func(context.Context, *pubsub.Message)) error
+}
+
+// splitSubscriptionName returns the project and subscription ID of the given
+// `projects/<project>/subscriptions/<subscription>` name.
+func splitSubscriptionName(name string) (string, string, error) {
+	split := subscriptionPattern.FindStringSubmatch(name)
+	if len(split) != 3 {
+		return "", "", fmt.Errorf("expected subscription %q to be of the form `projects/<project>/subscriptions/<subscription>`", name)
+	}
+	return split[1], split[2], nil
+}
+
+// newPullSubscription returns the named subscription with flow control settings taken from the environment.
+func newPullSubscription(client *pubsub.Client, subID string) (*pubsub.Subscription, error) {
+	sub := client.Subscription(subID)
+	sub.ReceiveSettings.MaxOutstandingMessages = defaultPullMaxOutstandingMessages
+
+	if v, ok := GetEnv("PULL_MAX_OUTSTANDING_MESSAGES"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PULL_MAX_OUTSTANDING_MESSAGES %q: %w", v, err)
+		}
+		sub.ReceiveSettings.MaxOutstandingMessages = n
+	}
+
+	if v, ok := GetEnv("PULL_MAX_OUTSTANDING_BYTES"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PULL_MAX_OUTSTANDING_BYTES %q: %w", v, err)
+		}
+		sub.ReceiveSettings.MaxOutstandingBytes = n
+	}
+
+	return sub, nil
+}
+
+// receivePull receives messages from the given subscription until the context is done or receiving fails. Each
+// message goes through the same path as the push receiver and is acked or nacked based on the outcome.
+// Messages are handled with their own context, which is not canceled along with the given one, so that the messages
+// being handled when a shutdown starts get up to the shutdown timeout to finish instead of being aborted and nacked.
+func receivePull(ctx context.Context, sub pullSubscription, subName string, notifier Notifier, params *receiverParams, shutdownTimeout time.Duration) error {
+	hctx, hcancel := context.WithCancel(context.Background())
+	defer hcancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-hctx.Done():
+			return
+		}
+		t := time.NewTimer(shutdownTimeout)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			Warningf(ctx, "aborting the PubSub messages that are still being handled after %v", shutdownTimeout)
+			hcancel()
+		case <-hctx.Done():
+		}
+	}()
+
+	return sub.Receive(ctx, func(_ context.Context, m *pubsub.Message) {
+		ctx := hctx
+		messagesReceived.With(metricLabelsFor(notifier)).Inc()
+		pspw := &pubSubPushWrapper{
+			Message: pubSubPushMessage{
+				Data:        m.Data,
+				Attributes:  m.Attributes,
+				ID:          m.ID,
+				PublishTime: m.PublishTime.Format(time.RFC3339Nano),
+			},
+			Subscription: subName,
+		}
+		if m.DeliveryAttempt != nil {
+			pspw.DeliveryAttempt = *m.DeliveryAttempt
+		}
+
+		switch handleMessage(ctx, notifier, params, pspw) {
+		case ackMessage:
+			m.Ack()
+		default:
+			Debugf(ctx, "nacking PubSub message %q", m.ID)
+			m.Nack()
+		}
+	})
+}
+
+// runPull receives messages from the named subscription while serving the auxiliary HTTP endpoints on the listener.
+// It blocks until either of them fails or the context is done, in which case it waits for the messages being handled
+// and drains the server before returning.
+func runPull(ctx context.Context, subName string, srv *http.Server, ln net.Listener, shutdownTimeout time.Duration, notifier Notifier, params *receiverParams) error {
+	project, subID, err := splitSubscriptionName(subName)
+	if err != nil {
+		return err
+	}
+
+	client, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to create new Pub/Sub client: %w", err)
+	}
+	defer client.Close()
+
+	sub, err := newPullSubscription(client, subID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		err := serve(ctx, srv, ln, shutdownTimeout)
+		if err != nil {
+			// Stop receiving if the server fails.
+			cancel()
+		}
+		serveErr <- err
+	}()
+
+	Debugf(ctx, "receiving messages from subscription %q", subName)
+	// Receive only returns once every message being handled is done.
+	err = receivePull(ctx, sub, subName, notifier, params, shutdownTimeout)
+	if err == nil && ctx.Err() == nil {
+		err = fmt.Errorf("stopped receiving messages from subscription %q", subName)
+	}
+	cancel()
+
+	if serr := <-serveErr; err == nil {
+		err = serr
+	}
+	return err
+}
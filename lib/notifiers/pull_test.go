@@ -0,0 +1,201 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/grpc"
+)
+
+func TestSplitSubscriptionName(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		wantProject string
+		wantSubID   string
+		wantError   bool
+	}{{
+		name:        "projects/my-project/subscriptions/my-sub",
+		wantProject: "my-project",
+		wantSubID:   "my-sub",
+	}, {
+		name:      "my-sub",
+		wantError: true,
+	}, {
+		name:      "projects/my-project/topics/cloud-builds",
+		wantError: true,
+	}} {
+		project, subID, err := splitSubscriptionName(tc.name)
+		if err != nil {
+			if !tc.wantError {
+				t.Errorf("splitSubscriptionName(%q) failed unexpectedly: %v", tc.name, err)
+			}
+			continue
+		}
+		if tc.wantError {
+			t.Errorf("splitSubscriptionName(%q) succeeded unexpectedly", tc.name)
+			continue
+		}
+		if project != tc.wantProject || subID != tc.wantSubID {
+			t.Errorf("splitSubscriptionName(%q) = (%q, %q), want (%q, %q)", tc.name, project, subID, tc.wantProject, tc.wantSubID)
+		}
+	}
+}
+
+const testTopicName = "projects/my-project/topics/" + cloudBuildTopic
+
+// newTestSubscription returns a fake Pub/Sub server with a subscription to testTopicName that handles one message at a
+// time, since the test notifiers are not safe for concurrent use. It is torn down once the test is done.
+func newTestSubscription(ctx context.Context, t *testing.T) (*pstest.Server, *pubsub.Subscription) {
+	t.Helper()
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client, err := pubsub.NewClient(ctx, "my-project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	topic, err := client.CreateTopic(ctx, cloudBuildTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := client.CreateSubscription(ctx, "my-sub", pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.ReceiveSettings.MaxOutstandingMessages = 1
+	sub.ReceiveSettings.NumGoroutines = 1
+	return srv, sub
+}
+
+func TestReceivePull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	srv, sub := newTestSubscription(ctx, t)
+	flakyID := srv.Publish(testTopicName, []byte(`{"id": "flaky", "status": "SUCCESS"}`), nil)
+	badID := srv.Publish(testTopicName, []byte("not a build"), nil)
+
+	n := &flakyNotifier{errs: []error{errors.New("failed to reticulate splines")}}
+	params := &receiverParams{ignoreBadMessages: true, maxSendAttempts: 1}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- receivePull(ctx, sub, sub.String(), n, params, time.Second)
+	}()
+
+	// The flaky message is nacked the first time and acked once redelivered; the bad one is acked without a retry.
+	for srv.Message(flakyID).Acks == 0 || srv.Message(badID).Acks == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for acks: flaky=%+v bad=%+v", srv.Message(flakyID), srv.Message(badID))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel()
+	if err := <-errs; err != nil {
+		t.Errorf("receivePull failed: %v", err)
+	}
+
+	if n.calls != 2 {
+		t.Errorf("SendNotification was called %d times, want 2", n.calls)
+	}
+	if got := srv.Message(flakyID).Deliveries; got < 2 {
+		t.Errorf("flaky message was delivered %d times, want at least 2", got)
+	}
+	if got := srv.Message(badID).Deliveries; got != 1 {
+		t.Errorf("bad message was delivered %d times, want 1", got)
+	}
+}
+
+// blockingNotifier is a Notifier whose SendNotification blocks until it is released or its context is done.
+type blockingNotifier struct {
+	started chan struct{}
+	release chan struct{}
+	ctxErr  error // The error of the context of the last SendNotification call.
+}
+
+func (n *blockingNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (n *blockingNotifier) SendNotification(ctx context.Context, _ *cbpb.Build) error {
+	close(n.started)
+	select {
+	case <-n.release:
+	case <-ctx.Done():
+	}
+	n.ctxErr = ctx.Err()
+	return n.ctxErr
+}
+
+func TestReceivePullShutdown(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		handleFor  time.Duration // How long the in-flight message takes after shutdown starts.
+		wantCtxErr bool
+		wantAcked  bool
+	}{{
+		name:      "drained",
+		handleFor: 50 * time.Millisecond,
+		wantAcked: true,
+	}, {
+		name:       "timed out",
+		handleFor:  time.Minute,
+		wantCtxErr: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			srv, sub := newTestSubscription(context.Background(), t)
+			id := srv.Publish(testTopicName, []byte(`{"id": "some-id", "status": "SUCCESS"}`), nil)
+
+			n := &blockingNotifier{started: make(chan struct{}), release: make(chan struct{})}
+			errs := make(chan error, 1)
+			go func() {
+				errs <- receivePull(ctx, sub, sub.String(), n, &receiverParams{maxSendAttempts: 1}, time.Second)
+			}()
+
+			<-n.started
+			cancel()
+			go func() {
+				time.Sleep(tc.handleFor)
+				close(n.release)
+			}()
+			if err := <-errs; err != nil {
+				t.Errorf("receivePull failed: %v", err)
+			}
+
+			if (n.ctxErr != nil) != tc.wantCtxErr {
+				t.Errorf("in-flight SendNotification got context error %v, want error = %v", n.ctxErr, tc.wantCtxErr)
+			}
+			if acked := srv.Message(id).Acks > 0; acked != tc.wantAcked {
+				t.Errorf("in-flight message acked = %v, want %v", acked, tc.wantAcked)
+			}
+		})
+	}
+}
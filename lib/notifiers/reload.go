@@ -0,0 +1,315 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+// reloader is a Notifier that sends notifications using the router built from the most recent valid config. It can
+// poll the config and template sources for changes and swap in a freshly set-up router without a redeploy.
+type reloader struct {
+	notifier Notifier // The not-yet-set-up notifier that every router's notifiers are copied from.
+	cfgPath  string
+	src      ConfigSource
+	sg       SecretGetter
+
+	mtx        sync.RWMutex
+	current    *router
+	cfg        *Config
+	versions   map[string]string // Map of URI => its version, as of the last load attempt.
+	lastCheck  time.Time
+	lastReload time.Time
+	lastErr    error     // The error of the last load attempt, if it failed.
+	failures   int       // The number of load attempts that failed in a row.
+	retryAt    time.Time // When a failed load is tried again even if nothing changed.
+	now        func() time.Time
+}
+
+const (
+	// reloadRetryBackoff is how long a failed load waits before it is tried again if nothing changed. It doubles after
+	// every failure in a row, up to maxReloadRetryBackoff.
+	reloadRetryBackoff    = 10 * time.Second
+	maxReloadRetryBackoff = 10 * time.Minute
+)
+
+// newReloader loads the config at the given path and sets up a router for it.
+func newReloader(ctx context.Context, notifier Notifier, cfgPath string, src ConfigSource, sg SecretGetter) (*reloader, error) {
+	r := &reloader{
+		notifier: notifier,
+		cfgPath:  cfgPath,
+		src:      src,
+		sg:       sg,
+		now:      time.Now,
+	}
+
+	cfg, rtr, versions, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.current, r.cfg, r.versions, r.lastReload = rtr, cfg, versions, r.now()
+	return r, nil
+}
+
+// load reads and validates the config and sets up a new router for it. It also returns the versions of the config and
+// its templates, which are read before their contents so that an edit made during the load is picked up by the next
+// check instead of being recorded as already loaded.
+func (r *reloader) load(ctx context.Context) (*Config, *router, map[string]string, error) {
+	cfgVersion, err := sourceVersion(ctx, r.src, r.cfgPath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get version of %q: %w", r.cfgPath, err)
+	}
+
+	cfg, err := getConfig(ctx, r.src, r.cfgPath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get config from %q: %w", r.cfgPath, err)
+	}
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, nil, nil, fmt.Errorf("got invalid config from path %q: %w", r.cfgPath, err)
+	}
+	Debugf(ctx, "got config from %q: %+v\n", r.cfgPath, cfg)
+
+	// Template URIs are only known once the config has been read.
+	versions, err := r.sourceVersions(ctx, cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	versions[r.cfgPath] = cfgVersion
+
+	rtr, err := newRouter(ctx, r.notifier, cfg, r.sg, r.src)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to set up notification routes: %w", err)
+	}
+	return cfg, rtr, versions, nil
+}
+
+// sourceVersions returns the versions of the config and of every template and partial URI in the given config, which
+// may be nil.
+func (r *reloader) sourceVersions(ctx context.Context, cfg *Config) (map[string]string, error) {
+	uris := []string{r.cfgPath}
+	if cfg != nil {
+		for _, n := range cfg.Spec.routes() {
+			if n.Template == nil {
+				continue
+			}
+			if n.Template.URI != "" {
+				uris = append(uris, n.Template.URI)
+			}
+			// Listed again on every check so that added and removed partials are noticed too.
+			partials, err := partialURIs(ctx, r.src, n.Template.Partials)
+			if err != nil {
+				return nil, err
+			}
+			uris = append(uris, partials...)
+		}
+	}
+
+	versions := map[string]string{}
+	for _, uri := range uris {
+		v, err := sourceVersion(ctx, r.src, uri)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get version of %q: %w", uri, err)
+		}
+		versions[uri] = v
+	}
+	return versions, nil
+}
+
+// sourceVersion returns the version of the contents at the given URI.
+func sourceVersion(ctx context.Context, src ConfigSource, uri string) (string, error) {
+	if vs, ok := src.(versionedConfigSource); ok {
+		return vs.Version(ctx, uri)
+	}
+	return hashContents(ctx, src, uri)
+}
+
+// check reloads the config if it or any of its templates changed since the last load attempt, or if the last load
+// attempt failed and its retry backoff passed. If the new config fails to load, the current router is kept and the
+// error is reported by the status handler until a later load succeeds. It returns true iff a new router was swapped in.
+func (r *reloader) check(ctx context.Context) (bool, error) {
+	r.mtx.RLock()
+	cfg, lastVersions, lastErr, retryAt := r.cfg, r.versions, r.lastErr, r.retryAt
+	r.mtx.RUnlock()
+
+	versions, err := r.sourceVersions(ctx, cfg)
+	if err != nil {
+		r.setCheckResult(nil, err)
+		return false, err
+	}
+	changed := !equalVersions(versions, lastVersions)
+	if !changed && (lastErr == nil || r.now().Before(retryAt)) {
+		// Nothing changed, so the outcome of the last load attempt (including its error) still stands.
+		r.mtx.Lock()
+		r.lastCheck = r.now()
+		r.mtx.Unlock()
+		return false, nil
+	}
+
+	if changed {
+		Infof(ctx, "config or templates for %q changed, reloading", r.cfgPath)
+	} else {
+		Infof(ctx, "retrying the failed load of %q", r.cfgPath)
+	}
+	newCfg, rtr, newVersions, err := r.load(ctx)
+	if err != nil {
+		// Remember the versions that failed so that the load is only tried again once they change or the backoff passes.
+		r.setCheckResult(versions, err)
+		return false, err
+	}
+
+	r.mtx.Lock()
+	old := r.current
+	r.current, r.cfg, r.versions, r.lastErr, r.failures = rtr, newCfg, newVersions, nil, 0
+	r.lastCheck, r.lastReload = r.now(), r.now()
+	r.mtx.Unlock()
+
+	go retireRouter(ctx, old)
+	Infof(ctx, "reloaded config from %q", r.cfgPath)
+	return true, nil
+}
+
+// retireRouter closes a router that was swapped out once the notifications it is still sending are done.
+func retireRouter(ctx context.Context, rtr *router) {
+	rtr.inflight.Wait()
+	if err := rtr.Close(); err != nil {
+		Warningf(ctx, "failed to close replaced notification routes: %v", err)
+	}
+}
+
+// setCheckResult records the error of a check that did not swap in a new router and schedules its retry. A nil
+// versions map keeps the previous versions.
+func (r *reloader) setCheckResult(versions map[string]string, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if versions != nil {
+		r.versions = versions
+	}
+	r.lastErr = err
+	r.lastCheck = r.now()
+
+	backoff := reloadRetryBackoff
+	for i := 0; i < r.failures && backoff < maxReloadRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxReloadRetryBackoff {
+		backoff = maxReloadRetryBackoff
+	}
+	r.failures++
+	r.retryAt = r.now().Add(backoff)
+}
+
+func equalVersions(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// poll calls check at the given interval until the context is done.
+func (r *reloader) poll(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := r.check(ctx); err != nil {
+				Errorf(ctx, "failed to reload config from %q, keeping the last good config: %v", r.cfgPath, err)
+			}
+		}
+	}
+}
+
+// SetUp always fails since a reloader sets up its own routers.
+func (r *reloader) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return errors.New("reloader routers are set up by the reloader and cannot be set up again")
+}
+
+// SendNotification sends the notification using the current router.
+func (r *reloader) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	return r.sendWithRetries(ctx, "", build, new(receiverParams))
+}
+
+// sendWithRetries sends the notification using the current router, which retries each of its routes on its own.
+func (r *reloader) sendWithRetries(ctx context.Context, msgID string, build *cbpb.Build, params *receiverParams) error {
+	r.mtx.RLock()
+	rtr := r.current
+	// Added under the lock so a router that is being swapped out is never closed before this send is done.
+	rtr.inflight.Add(1)
+	r.mtx.RUnlock()
+	defer rtr.inflight.Done()
+	return rtr.sendWithRetries(ctx, msgID, build, params)
+}
+
+// Close closes the current router. It should only be called once no more notifications are being sent.
+func (r *reloader) Close() error {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.current.Close()
+}
+
+func (r *reloader) metricLabels() prometheus.Labels {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.current.metricLabels()
+}
+
+type reloadStatus struct {
+	ConfigPath string            `json:"configPath"`
+	Versions   map[string]string `json:"versions"`
+	LastCheck  time.Time         `json:"lastCheck,omitempty"`
+	LastReload time.Time         `json:"lastReload"`
+	LastError  string            `json:"lastError,omitempty"`
+}
+
+// statusHandler serves the reloader's status as JSON. It responds with a 500 if the last load attempt failed.
+func (r *reloader) statusHandler(w http.ResponseWriter, req *http.Request) {
+	r.mtx.RLock()
+	st := &reloadStatus{
+		ConfigPath: r.cfgPath,
+		Versions:   r.versions,
+		LastCheck:  r.lastCheck,
+		LastReload: r.lastReload,
+	}
+	if r.lastErr != nil {
+		st.LastError = r.lastErr.Error()
+	}
+	r.mtx.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if st.LastError != "" {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		Errorf(req.Context(), "failed to encode reload status: %v", err)
+	}
+}
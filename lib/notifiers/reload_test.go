@@ -0,0 +1,213 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+func reloadTestConfig(apiVersion, name string) string {
+	return fmt.Sprintf(`
+apiVersion: %s
+kind: TestNotifier
+metadata:
+  name: my-test-notifier
+spec:
+  notification:
+    filter: build.status == Build.Status.FAILURE
+    delivery:
+      name: %s
+`, apiVersion, name)
+}
+
+func TestReloader(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	mtime := time.Now().Add(-time.Hour)
+
+	// writeConfig writes the config and bumps its mtime so that the change is seen even on coarse filesystem clocks.
+	writeConfig := func(contents string) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mtime = mtime.Add(time.Minute)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(reloadTestConfig("cloud-build-notifiers/v1", "v1"))
+	rec := new(routeRecorder)
+	rl, err := newReloader(ctx, &recordingNotifier{rec: rec}, "file://"+path, newConfigSource(nil), new(setupCheckSecretGetter))
+	if err != nil {
+		t.Fatalf("newReloader failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		contents   string // Written before the check if non-empty.
+		wantReload bool
+		wantError  bool
+		wantSent   string
+	}{{
+		name:     "unchanged",
+		wantSent: "v1/unchanged",
+	}, {
+		name:       "changed",
+		contents:   reloadTestConfig("cloud-build-notifiers/v1", "v2"),
+		wantReload: true,
+		wantSent:   "v2/changed",
+	}, {
+		name:      "invalid",
+		contents:  reloadTestConfig("cloud-build-notifiers/v9000", "v3"),
+		wantError: true,
+		wantSent:  "v2/invalid",
+	}, {
+		name:     "still invalid",
+		wantSent: "v2/still invalid",
+	}, {
+		name:       "fixed",
+		contents:   reloadTestConfig("cloud-build-notifiers/v1", "v4"),
+		wantReload: true,
+		wantSent:   "v4/fixed",
+	}} {
+		if tc.contents != "" {
+			writeConfig(tc.contents)
+		}
+
+		reloaded, err := rl.check(ctx)
+		if (err != nil) != tc.wantError {
+			t.Errorf("%s: check() got error %v, want error = %v", tc.name, err, tc.wantError)
+		}
+		if reloaded != tc.wantReload {
+			t.Errorf("%s: check() = %v, want %v", tc.name, reloaded, tc.wantReload)
+		}
+
+		rec.sent = nil
+		if err := rl.SendNotification(ctx, &cbpb.Build{Id: tc.name, Status: cbpb.Build_FAILURE}); err != nil {
+			t.Fatalf("%s: SendNotification failed: %v", tc.name, err)
+		}
+		if diff := cmp.Diff([]string{tc.wantSent}, rec.sent); diff != "" {
+			t.Errorf("%s: SendNotification sent unexpected notifications: (want- got+)\n%s", tc.name, diff)
+		}
+	}
+}
+
+func TestReloaderStatus(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(reloadTestConfig("cloud-build-notifiers/v1", "v1")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	uri := "file://" + path
+	rl, err := newReloader(ctx, &recordingNotifier{rec: new(routeRecorder)}, uri, newConfigSource(nil), new(setupCheckSecretGetter))
+	if err != nil {
+		t.Fatalf("newReloader failed: %v", err)
+	}
+
+	getStatus := func() (int, *reloadStatus) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		rl.statusHandler(w, httptest.NewRequest(http.MethodGet, "/statusz", nil))
+		st := new(reloadStatus)
+		if err := json.NewDecoder(w.Body).Decode(st); err != nil {
+			t.Fatalf("failed to decode status: %v", err)
+		}
+		return w.Code, st
+	}
+
+	code, st := getStatus()
+	if code != http.StatusOK || st.LastError != "" {
+		t.Errorf("got status (%d, %+v), want OK without an error", code, st)
+	}
+	if st.ConfigPath != uri || st.Versions[uri] == "" {
+		t.Errorf("got status %+v, want a version for %q", st, uri)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rl.check(ctx); err == nil {
+		t.Fatal("check() succeeded unexpectedly after the config was removed")
+	}
+
+	code, st = getStatus()
+	if code != http.StatusInternalServerError || st.LastError == "" {
+		t.Errorf("got status (%d, %+v), want an internal server error with the last error", code, st)
+	}
+}
+
+func TestReloaderRetriesFailedLoad(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cfgPath, tmplPath := filepath.Join(dir, "config.yaml"), filepath.Join(dir, "template.txt")
+	if err := ioutil.WriteFile(cfgPath, []byte(reloadTestConfig("cloud-build-notifiers/v1", "v1")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := new(routeRecorder)
+	rl, err := newReloader(ctx, &recordingNotifier{rec: rec}, "file://"+cfgPath, newConfigSource(nil), new(setupCheckSecretGetter))
+	if err != nil {
+		t.Fatalf("newReloader failed: %v", err)
+	}
+	clk := &fakeClock{t: time.Unix(1000, 0)}
+	rl.now = clk.now
+
+	// The new config uses a template that does not exist yet, so it fails to load until the template is written.
+	cfg := reloadTestConfig("cloud-build-notifiers/v1", "v2") + fmt.Sprintf(`
+    template:
+      type: golang
+      uri: file://%s
+`, tmplPath)
+	if err := ioutil.WriteFile(cfgPath, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rl.check(ctx); err == nil {
+		t.Fatal("check() succeeded unexpectedly without the template")
+	}
+
+	if err := ioutil.WriteFile(tmplPath, []byte("{{.Build.Id}}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := rl.check(ctx); reloaded || err != nil {
+		t.Errorf("check() before the retry backoff = (%v, %v), want (false, nil)", reloaded, err)
+	}
+
+	clk.t = clk.t.Add(reloadRetryBackoff)
+	if reloaded, err := rl.check(ctx); !reloaded || err != nil {
+		t.Errorf("check() after the retry backoff = (%v, %v), want (true, nil)", reloaded, err)
+	}
+
+	if err := rl.SendNotification(ctx, &cbpb.Build{Id: "retried", Status: cbpb.Build_FAILURE}); err != nil {
+		t.Fatalf("SendNotification failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"v2/retried"}, rec.sent); diff != "" {
+		t.Errorf("SendNotification sent unexpected notifications: (want- got+)\n%s", diff)
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+// route is a single entry of the config's notification list along with the Notifier instance that was set up for it.
+type route struct {
+	filter       EventFilter
+	resolver     *instrumentedResolver // The resolver that the notifier was set up with.
+	notifier     Notifier
+	templateHash string // See templateHash.
+}
+
+// router is a Notifier that dispatches every Build to all of the routes whose filter matches that Build.
+type router struct {
+	routes []*route
+	labels prometheus.Labels
+	sent   DedupStore // Records the routes that a Pub/Sub message was already sent to, if non-nil.
+
+	inflight sync.WaitGroup // Tracks sends through a reloader so a replaced router is only closed once they finish.
+}
+
+// newRouter sets up one copy of the given (not yet set up) notifier per notification route in the config.
+// Each copy is given a Config whose Spec.Notification is the route's Notification, along with that route's
+// BindingResolver and template. If src is nil, templates are not fetched and the empty template is used instead.
+func newRouter(ctx context.Context, notifier Notifier, cfg *Config, sg SecretGetter, src ConfigSource) (*router, error) {
+	if sn, ok := sg.(secretNamer); ok {
+		sn.nameSecrets(cfg.Spec.Secrets)
+	}
+	r := &router{
+		labels: newMetricLabels(notifier, cfg),
+		sent:   NewMemoryDedupStore(defaultDedupMaxEntries, defaultDedupTTL),
+	}
+	if err := r.setUpRoutes(ctx, notifier, cfg, sg, src); err != nil {
+		// Close the routes that were already set up, since a failed reload is retried and would leak their clients.
+		if cerr := r.Close(); cerr != nil {
+			Warningf(ctx, "failed to close the routes of a router that failed to be set up: %v", cerr)
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+// setUpRoutes sets up a route for every notification route in the config, adding each one to the router once its
+// notifier is set up.
+func (r *router) setUpRoutes(ctx context.Context, notifier Notifier, cfg *Config, sg SecretGetter, src ConfigSource) error {
+	for i, n := range cfg.Spec.routes() {
+		rcfg := routeConfig(cfg, n)
+
+		prd, err := MakeCELPredicate(n.Filter)
+		if err != nil {
+			return fmt.Errorf("failed to make a CEL predicate for route %d: %w", i, err)
+		}
+
+		jr, err := newResolver(rcfg, sg)
+		if err != nil {
+			return fmt.Errorf("failed to construct a binding resolver for route %d: %w", i, err)
+		}
+		br := &instrumentedResolver{BindingResolver: jr, labels: r.labels}
+
+		var tmpl string
+		if src != nil {
+			tmpl, err = parseTemplate(ctx, n.Template, src)
+			if err != nil {
+				return fmt.Errorf("failed to parse template %v for route %d: %w", n.Template, i, err)
+			}
+		}
+
+		rn, err := newNotifierInstance(notifier)
+		if err != nil {
+			return err
+		}
+
+		if err := rn.SetUp(ctx, rcfg, tmpl, sg, br); err != nil {
+			return fmt.Errorf("failed to call SetUp on notifier for route %d: %w", i, err)
+		}
+
+		r.routes = append(r.routes, &route{filter: prd, resolver: br, notifier: rn, templateHash: templateHash(tmpl)})
+	}
+	return nil
+}
+
+// routeConfig returns a shallow copy of the given Config whose Spec only contains the given Notification.
+func routeConfig(cfg *Config, n *Notification) *Config {
+	rcfg := *cfg
+	spec := *cfg.Spec
+	spec.Notification = n
+	spec.Notifications = nil
+	rcfg.Spec = &spec
+	return &rcfg
+}
+
+// newNotifierInstance returns a copy of the given (not yet set up) notifier so that it can be set up independently of
+// any other copies. The notifier must be a pointer to a struct; any fields set before Main was called are copied.
+func newNotifierInstance(notifier Notifier) (Notifier, error) {
+	v := reflect.ValueOf(notifier)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected notifier %T to be a non-nil pointer to a struct", notifier)
+	}
+
+	cp := reflect.New(v.Elem().Type())
+	cp.Elem().Set(v.Elem())
+	return cp.Interface().(Notifier), nil
+}
+
+// SetUp always fails since a router's routes are set up by newRouter.
+func (r *router) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return errors.New("router routes are set up by newRouter and cannot be set up again")
+}
+
+// SendNotification calls SendNotification on the notifier of every route that matches the given Build, once.
+func (r *router) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	return r.sendWithRetries(ctx, "", build, new(receiverParams))
+}
+
+// sendWithRetries calls SendNotification on the notifier of every route that matches the given Build, retrying each
+// route on its own so that a retryable failure of one route never resends to the others.
+// All matching routes are attempted even if an earlier one fails. The returned error only covers the failed routes
+// and is only permanent if every one of them failed permanently. Routes that the Pub/Sub message with the given
+// (non-empty) ID was already sent to, e.g. before it was redelivered, are skipped. Each attempt gets its own copy of
+// the Build since notifiers are free to modify it (e.g. adding UTM params to the log URL).
+func (r *router) sendWithRetries(ctx context.Context, msgID string, build *cbpb.Build, params *receiverParams) error {
+	var errs []string
+	permanent := true
+	labels := r.metricLabels()
+	for i, rt := range r.routes {
+		rb := proto.Clone(build).(*cbpb.Build)
+		resolved, ok := resolveRouteParams(ctx, i, rt, rb)
+		if !ok {
+			filterMisses.With(labels).Inc()
+			continue
+		}
+		rctx := ctx
+		if resolved != nil {
+			rctx = withResolvedParams(ctx, rt.resolver, rb, resolved)
+		}
+		if !rt.filter.Apply(rctx, rb) {
+			Debugf(ctx, "route %d does not match build", i)
+			filterMisses.With(labels).Inc()
+			continue
+		}
+		filterMatches.With(labels).Inc()
+
+		key := fmt.Sprintf("route/%d/message/%s", i, msgID)
+		if r.sentTo(ctx, msgID, key) {
+			Debugf(ctx, "skipping route %d since the message was already sent to it", i)
+			continue
+		}
+
+		err := retrySend(rctx, params, func() error {
+			ab := proto.Clone(rb).(*cbpb.Build)
+			actx := rctx
+			if resolved != nil {
+				// Passed down so that the notifier gets the same params without resolving them again.
+				actx = withResolvedParams(ctx, rt.resolver, ab, resolved)
+			}
+			return sendToRoute(actx, i, rt, ab, labels)
+		})
+		if err != nil {
+			sendErrors.With(labels).Inc()
+			errs = append(errs, fmt.Sprintf("route %d: %v", i, err))
+			permanent = permanent && IsPermanent(err)
+			continue
+		}
+		if msgID != "" && r.sent != nil {
+			if err := r.sent.Add(ctx, key); err != nil {
+				Warningf(ctx, "failed to record that route %d was sent the message: %v", i, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		err := fmt.Errorf("failed to send notification for %d route(s): %s", len(errs), strings.Join(errs, "; "))
+		if permanent {
+			return Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// sentTo returns true iff the Pub/Sub message with the given ID was already sent to the route with the given key.
+func (r *router) sentTo(ctx context.Context, msgID, key string) bool {
+	if msgID == "" || r.sent == nil {
+		return false
+	}
+	ok, err := r.sent.Contains(ctx, key)
+	if err != nil {
+		Warningf(ctx, "failed to check whether the message was already sent to a route, sending it anyway: %v", err)
+		return false
+	}
+	return ok
+}
+
+// Close closes the notifier of every route that implements io.Closer. All of them are closed even if an earlier one
+// fails.
+func (r *router) Close() error {
+	var errs []string
+	for i, rt := range r.routes {
+		c, ok := rt.notifier.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := c.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("route %d: %v", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close %d route(s): %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// resolveRouteParams resolves the route's params for the given Build if its filter uses them, returning nil params if
+// it does not. If they fail to resolve, the filter cannot be applied, so it returns false and the route is treated as
+// not matching. The failure is counted by the resolver but only logged at debug level since it would otherwise be
+// logged for every message.
+func resolveRouteParams(ctx context.Context, i int, rt *route, build *cbpb.Build) (*ResolvedParams, bool) {
+	if rt.resolver == nil || !filterUsesParams(rt.filter) {
+		return nil, true
+	}
+	params, err := ResolveParams(ctx, rt.resolver, nil, build)
+	if err != nil {
+		Debugf(ctx, "route %d does not match build since its params failed to resolve for its filter: %v", i, err)
+		return nil, false
+	}
+	return params, true
+}
+
+// filterUsesParams returns true iff the given filter might refer to `params`.
+func filterUsesParams(f EventFilter) bool {
+	if p, ok := f.(*CELPredicate); ok {
+		return p.usesParams
+	}
+	return true
+}
+
+func (r *router) metricLabels() prometheus.Labels {
+	if r.labels == nil {
+		return prometheus.Labels{"notifier": fmt.Sprintf("%T", r), "config": ""}
+	}
+	return r.labels
+}
+
+// sendToRoute calls SendNotification on the route's notifier in a trace span, recording its latency.
+func sendToRoute(ctx context.Context, i int, rt *route, build *cbpb.Build, labels prometheus.Labels) error {
+	ctx, span := startSpan(ctx, "Notifier.SendNotification")
+	defer span.End()
+	setBuildAttributes(span, build)
+	span.SetAttributes(attribute.Int("notifier.route", i))
+
+	start := time.Now()
+	err := rt.notifier.SendNotification(ctx, build)
+	sendLatency.With(labels).Observe(time.Since(start).Seconds())
+	return endSpan(span, err)
+}
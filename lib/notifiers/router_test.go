@@ -0,0 +1,343 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+type routeRecorder struct {
+	sent []string
+}
+
+// recordingNotifier is a Notifier that records the config it was set up with and the IDs of the Builds it was sent.
+type recordingNotifier struct {
+	rec      *routeRecorder // Shared by all copies made by newNotifierInstance.
+	name     string
+	setUpErr error
+	sendErr  error
+}
+
+func (r *recordingNotifier) SetUp(_ context.Context, cfg *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	if r.setUpErr != nil {
+		return r.setUpErr
+	}
+	r.name = cfg.Spec.Notification.Delivery["name"].(string)
+	return nil
+}
+
+func (r *recordingNotifier) SendNotification(_ context.Context, build *cbpb.Build) error {
+	r.rec.sent = append(r.rec.sent, r.name+"/"+build.Id)
+	build.LogUrl = "modified-by-" + r.name
+	return r.sendErr
+}
+
+func TestRouter(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: "cloud-build-notifiers/v1",
+		Spec: &Spec{
+			Notifications: []*Notification{{
+				Filter:   "build.status == Build.Status.FAILURE",
+				Delivery: map[string]interface{}{"name": "oncall"},
+			}, {
+				Filter:   `"release" in build.tags`,
+				Delivery: map[string]interface{}{"name": "releases"},
+			}},
+		},
+	}
+	rec := new(routeRecorder)
+
+	r, err := newRouter(ctx, &recordingNotifier{rec: rec}, cfg, new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+
+	for _, b := range []*cbpb.Build{
+		{Id: "failed", Status: cbpb.Build_FAILURE},
+		{Id: "released", Status: cbpb.Build_SUCCESS, Tags: []string{"release"}},
+		{Id: "failed-release", Status: cbpb.Build_FAILURE, Tags: []string{"release"}, LogUrl: "original"},
+		{Id: "ignored", Status: cbpb.Build_SUCCESS},
+	} {
+		if err := r.SendNotification(ctx, b); err != nil {
+			t.Fatalf("SendNotification(%v) failed: %v", b, err)
+		}
+		if b.Id == "failed-release" && b.LogUrl != "original" {
+			t.Errorf("SendNotification modified the original Build's LogUrl to %q", b.LogUrl)
+		}
+	}
+
+	want := []string{"oncall/failed", "releases/released", "oncall/failed-release", "releases/failed-release"}
+	if diff := cmp.Diff(want, rec.sent); diff != "" {
+		t.Errorf("unexpected routed notifications (want- got+):\n%s", diff)
+	}
+}
+
+func TestRouterSingleNotification(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: "cloud-build-notifiers/v1",
+		Spec: &Spec{
+			Notification: &Notification{
+				Filter:   "build.status == Build.Status.SUCCESS",
+				Delivery: map[string]interface{}{"name": "only"},
+			},
+		},
+	}
+	rec := new(routeRecorder)
+
+	r, err := newRouter(ctx, &recordingNotifier{rec: rec}, cfg, new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+	if err := r.SendNotification(ctx, &cbpb.Build{Id: "some-id", Status: cbpb.Build_SUCCESS}); err != nil {
+		t.Fatalf("SendNotification failed: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"only/some-id"}, rec.sent); diff != "" {
+		t.Errorf("unexpected routed notifications (want- got+):\n%s", diff)
+	}
+}
+
+func TestRouterSendErrors(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		APIVersion: "cloud-build-notifiers/v1",
+		Spec: &Spec{
+			Notifications: []*Notification{{
+				Filter:   "build.status == Build.Status.FAILURE",
+				Delivery: map[string]interface{}{"name": "first"},
+			}, {
+				Filter:   "build.status == Build.Status.FAILURE",
+				Delivery: map[string]interface{}{"name": "second"},
+			}},
+		},
+	}
+	rec := new(routeRecorder)
+
+	r, err := newRouter(ctx, &recordingNotifier{rec: rec, sendErr: errors.New("failed to reticulate splines")}, cfg, new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+
+	if err := r.SendNotification(ctx, &cbpb.Build{Id: "some-id", Status: cbpb.Build_FAILURE}); err == nil {
+		t.Error("SendNotification unexpectedly succeeded")
+	} else {
+		t.Logf("got expected error: %v", err)
+	}
+
+	// Both routes should have been attempted even though the first one failed.
+	if diff := cmp.Diff([]string{"first/some-id", "second/some-id"}, rec.sent); diff != "" {
+		t.Errorf("unexpected routed notifications (want- got+):\n%s", diff)
+	}
+}
+
+func TestRouterPermanentErrors(t *testing.T) {
+	ctx := context.Background()
+	errSplines := errors.New("failed to reticulate splines")
+	for _, tc := range []struct {
+		name          string
+		errs          []error
+		wantPermanent bool
+	}{{
+		name:          "all permanent",
+		errs:          []error{Permanent(errSplines), Permanent(errSplines)},
+		wantPermanent: true,
+	}, {
+		name:          "one retryable",
+		errs:          []error{Permanent(errSplines), errSplines},
+		wantPermanent: false,
+	}, {
+		name:          "permanent and success",
+		errs:          []error{nil, Permanent(errSplines)},
+		wantPermanent: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := new(router)
+			for _, err := range tc.errs {
+				prd, perr := MakeCELPredicate("true")
+				if perr != nil {
+					t.Fatal(perr)
+				}
+				r.routes = append(r.routes, &route{filter: prd, notifier: &recordingNotifier{rec: new(routeRecorder), sendErr: err}})
+			}
+
+			err := r.SendNotification(ctx, &cbpb.Build{Id: "some-id"})
+			if err == nil {
+				t.Fatal("SendNotification unexpectedly succeeded")
+			}
+			if got := IsPermanent(err); got != tc.wantPermanent {
+				t.Errorf("IsPermanent(%v) = %v, want %v", err, got, tc.wantPermanent)
+			}
+		})
+	}
+}
+
+func TestRouterRetriesEachRoute(t *testing.T) {
+	ctx := context.Background()
+	prd, err := MakeCELPredicate("true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := new(routeRecorder)
+	r := &router{
+		routes: []*route{
+			{filter: prd, notifier: &recordingNotifier{rec: rec, name: "first"}},
+			{filter: prd, notifier: &recordingNotifier{rec: rec, name: "second", sendErr: errors.New("failed to reticulate splines")}},
+		},
+		sent: NewMemoryDedupStore(10, time.Hour),
+	}
+	params := &receiverParams{maxSendAttempts: 3, retryBackoff: time.Millisecond}
+
+	if err := r.sendWithRetries(ctx, "some-message", &cbpb.Build{Id: "some-id"}, params); err == nil {
+		t.Fatal("sendWithRetries unexpectedly succeeded")
+	} else if IsPermanent(err) {
+		t.Errorf("sendWithRetries got permanent error %v, want retryable", err)
+	}
+	// Only the failing route should have been retried.
+	want := []string{"first/some-id", "second/some-id", "second/some-id", "second/some-id"}
+	if diff := cmp.Diff(want, rec.sent); diff != "" {
+		t.Errorf("unexpected routed notifications (want- got+):\n%s", diff)
+	}
+
+	// A redelivery of the same message should skip the route that it was already sent to.
+	rec.sent = nil
+	if err := r.sendWithRetries(ctx, "some-message", &cbpb.Build{Id: "some-id"}, params); err == nil {
+		t.Fatal("sendWithRetries unexpectedly succeeded")
+	}
+	want = []string{"second/some-id", "second/some-id", "second/some-id"}
+	if diff := cmp.Diff(want, rec.sent); diff != "" {
+		t.Errorf("unexpected routed notifications on redelivery (want- got+):\n%s", diff)
+	}
+}
+
+// setUpCounter is shared by the copies of a countingSetUpNotifier that newRouter makes for each route.
+type setUpCounter struct {
+	setUps, closes int
+}
+
+// countingSetUpNotifier is a Notifier that counts how often its copies are set up and closed, and fails the SetUp of
+// the copy that is set up for the failOn-th time.
+type countingSetUpNotifier struct {
+	counter *setUpCounter
+	failOn  int
+}
+
+func (c *countingSetUpNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	c.counter.setUps++
+	if c.counter.setUps == c.failOn {
+		return errors.New("failed to reticulate splines")
+	}
+	return nil
+}
+
+func (c *countingSetUpNotifier) SendNotification(_ context.Context, _ *cbpb.Build) error {
+	return nil
+}
+
+func (c *countingSetUpNotifier) Close() error {
+	c.counter.closes++
+	return nil
+}
+
+func TestNewRouterClosesRoutesOnError(t *testing.T) {
+	cfg := &Config{Spec: &Spec{Notifications: []*Notification{
+		{Filter: "build.status == Build.Status.FAILURE"},
+		{Filter: "build.status == Build.Status.SUCCESS"},
+		{Filter: "build.status == Build.Status.TIMEOUT"},
+	}}}
+	counter := new(setUpCounter)
+	if _, err := newRouter(context.Background(), &countingSetUpNotifier{counter: counter, failOn: 2}, cfg, new(setupCheckSecretGetter), nil); err == nil {
+		t.Fatal("newRouter unexpectedly succeeded")
+	}
+	// Only the first route was set up, and it is closed so that its clients are not leaked.
+	if counter.setUps != 2 || counter.closes != 1 {
+		t.Errorf("got %d SetUp and %d Close calls, want 2 and 1", counter.setUps, counter.closes)
+	}
+}
+
+func TestNewRouterErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name     string
+		notifier Notifier
+		spec     *Spec
+	}{{
+		name:     "bad filter",
+		notifier: &recordingNotifier{rec: new(routeRecorder)},
+		spec: &Spec{Notifications: []*Notification{{
+			Filter:   "build.status == Build.Status.FAILURE",
+			Delivery: map[string]interface{}{"name": "good"},
+		}, {
+			Filter:   "blah-#B A D#-",
+			Delivery: map[string]interface{}{"name": "bad"},
+		}}},
+	}, {
+		name:     "bad param",
+		notifier: &recordingNotifier{rec: new(routeRecorder)},
+		spec: &Spec{Notifications: []*Notification{{
+			Filter:   "build.status == Build.Status.FAILURE",
+			Delivery: map[string]interface{}{"name": "bad"},
+			Params:   map[string]string{"foo": "not-a-json-path"},
+		}}},
+	}, {
+		name:     "bad set up",
+		notifier: &recordingNotifier{rec: new(routeRecorder), setUpErr: errors.New("failed to set up")},
+		spec: &Spec{Notification: &Notification{
+			Filter: "build.status == Build.Status.FAILURE",
+		}},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{APIVersion: "cloud-build-notifiers/v1", Spec: tc.spec}
+			if _, err := newRouter(ctx, tc.notifier, cfg, new(setupCheckSecretGetter), nil); err == nil {
+				t.Error("newRouter unexpectedly succeeded")
+			} else {
+				t.Logf("got expected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewNotifierInstance(t *testing.T) {
+	rec := new(routeRecorder)
+	orig := &recordingNotifier{rec: rec, name: "orig"}
+
+	got, err := newNotifierInstance(orig)
+	if err != nil {
+		t.Fatalf("newNotifierInstance failed: %v", err)
+	}
+
+	cp, ok := got.(*recordingNotifier)
+	if !ok {
+		t.Fatalf("newNotifierInstance returned a %T, want a *recordingNotifier", got)
+	}
+	if cp == orig {
+		t.Fatal("newNotifierInstance returned the original notifier")
+	}
+	if cp.rec != rec || cp.name != "orig" {
+		t.Errorf("newNotifierInstance did not copy fields: got %+v", cp)
+	}
+
+	cp.name = "copy"
+	if orig.name != "orig" {
+		t.Errorf("modifying the copy modified the original: %+v", orig)
+	}
+}
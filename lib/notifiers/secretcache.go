@@ -0,0 +1,243 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultSecretCacheTTL        = 10 * time.Minute
+	defaultSecretRefreshInterval = 5 * time.Minute
+)
+
+// cachingSecretGetter is a SecretGetter that caches secrets for a TTL. If a secret cannot be fetched again once it
+// expired, the last value is kept so that a Secret Manager outage does not break notifications. It is also a
+// prometheus.Collector that reports the age of every cached secret. Its metrics are labeled by the secrets' local
+// names, since their resource names are redacted from `/configz`.
+type cachingSecretGetter struct {
+	sg  SecretGetter
+	ttl time.Duration // Secrets are fetched on every GetSecret if zero.
+
+	mtx     sync.Mutex
+	entries map[string]*cachedSecret // Map of secret resource name => its cached value.
+	names   map[string]string        // Map of secret resource name => its local name in the current config.
+	now     func() time.Time
+}
+
+type cachedSecret struct {
+	value   string
+	fetched time.Time // When the value was last fetched successfully.
+	expired bool      // Set by invalidateSecret so that the next GetSecret fetches the secret again.
+}
+
+// newCachingSecretGetter returns a cachingSecretGetter that caches the secrets from the given SecretGetter.
+func newCachingSecretGetter(sg SecretGetter, ttl time.Duration) *cachingSecretGetter {
+	return &cachingSecretGetter{
+		sg:      sg,
+		ttl:     ttl,
+		entries: map[string]*cachedSecret{},
+		names:   map[string]string{},
+		now:     time.Now,
+	}
+}
+
+// GetSecret returns the cached secret with the given resource name, fetching it if it is not cached or expired.
+func (c *cachingSecretGetter) GetSecret(ctx context.Context, name string) (string, error) {
+	c.mtx.Lock()
+	e, ok := c.entries[name]
+	if ok && !e.expired && c.now().Sub(e.fetched) < c.ttl {
+		c.mtx.Unlock()
+		return e.value, nil
+	}
+	c.mtx.Unlock()
+	// Not holding the lock while fetching, since a slow fetch should not block every other secret. Concurrent fetches
+	// of the same secret are harmless.
+	return c.fetch(ctx, name)
+}
+
+// fetch fetches the secret with the given resource name and caches it. If that fails and the secret was fetched
+// before, the last value is returned.
+func (c *cachingSecretGetter) fetch(ctx context.Context, name string) (string, error) {
+	s, err := c.sg.GetSecret(ctx, name)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err != nil {
+		secretFetchFailures.With(prometheus.Labels{"secret": c.names[name]}).Inc()
+		e, ok := c.entries[name]
+		if !ok {
+			return "", err
+		}
+		Warningf(ctx, "failed to fetch secret %q, using the value fetched %v ago: %v", name, c.now().Sub(e.fetched), err)
+		return e.value, nil
+	}
+	c.entries[name] = &cachedSecret{value: s, fetched: c.now()}
+	return s, nil
+}
+
+// nameSecrets sets the local names that label the metrics of the given secrets, replacing those of the previous
+// config. If several local names refer to the same resource, the first one is used.
+func (c *cachingSecretGetter) nameSecrets(secrets []*Secret) {
+	names := map[string]string{}
+	for _, s := range secrets {
+		if _, ok := names[s.ResourceName]; !ok {
+			names[s.ResourceName] = s.LocalName
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.names = names
+}
+
+// invalidateSecret makes the next GetSecret for the given resource name fetch the secret again.
+func (c *cachingSecretGetter) invalidateSecret(name string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.entries[name]; ok {
+		e.expired = true
+	}
+}
+
+// refresh fetches every cached secret again, so that rotated secrets are picked up before they expire.
+func (c *cachingSecretGetter) refresh(ctx context.Context) {
+	c.mtx.Lock()
+	var names []string
+	for name := range c.entries {
+		names = append(names, name)
+	}
+	c.mtx.Unlock()
+
+	for _, name := range names {
+		// Failures are logged and counted by fetch.
+		c.fetch(ctx, name)
+	}
+}
+
+// poll calls refresh at the given interval until the context is done.
+func (c *cachingSecretGetter) poll(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			c.refresh(ctx)
+		}
+	}
+}
+
+func (c *cachingSecretGetter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- secretAgeDesc
+}
+
+func (c *cachingSecretGetter) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for name, e := range c.entries {
+		// Secrets that are not in the current config are left out.
+		if local, ok := c.names[name]; ok {
+			ch <- prometheus.MustNewConstMetric(secretAgeDesc, prometheus.GaugeValue, c.now().Sub(e.fetched).Seconds(), local)
+		}
+	}
+}
+
+// secretNamer is implemented by SecretGetters whose metrics are labeled by the secrets' local names.
+type secretNamer interface {
+	nameSecrets(secrets []*Secret)
+}
+
+// secretInvalidator is implemented by SecretGetters that cache secrets.
+type secretInvalidator interface {
+	invalidateSecret(name string)
+}
+
+// SecretHandle is a secret that is got from the SecretGetter every time it is used instead of once in SetUp, so that a
+// rotated secret (e.g. one pinned to `versions/latest`) is picked up without a redeploy. The SecretGetter given to
+// SetUp caches secrets, so this is cheap.
+type SecretHandle struct {
+	sg       SecretGetter
+	resource string
+}
+
+// NewSecretHandle returns a SecretHandle for the secret with the given resource name.
+func NewSecretHandle(sg SecretGetter, resource string) *SecretHandle {
+	return &SecretHandle{sg: sg, resource: resource}
+}
+
+// Resource returns the resource name of the secret.
+func (h *SecretHandle) Resource() string {
+	return h.resource
+}
+
+// Get returns the current value of the secret.
+func (h *SecretHandle) Get(ctx context.Context) (string, error) {
+	return h.sg.GetSecret(ctx, h.resource)
+}
+
+// Refresh fetches the secret again, bypassing any cache, and returns its value and whether it changed.
+func (h *SecretHandle) Refresh(ctx context.Context) (string, bool, error) {
+	old, err := h.Get(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	return h.refresh(ctx, old)
+}
+
+// refresh fetches the secret again, bypassing any cache, and returns its value and whether it differs from the given
+// value that was used before.
+func (h *SecretHandle) refresh(ctx context.Context, used string) (string, bool, error) {
+	if si, ok := h.sg.(secretInvalidator); ok {
+		si.invalidateSecret(h.resource)
+	}
+	s, err := h.Get(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	return s, s != used, nil
+}
+
+// Use calls fn with the current value of the secret. If fn fails with an error that isAuthError returns true for
+// (e.g. a 401 response from the delivery endpoint), the secret is fetched again and, if it was rotated, fn is called
+// once more with the new value.
+func (h *SecretHandle) Use(ctx context.Context, fn func(string) error, isAuthError func(error) bool) error {
+	s, err := h.Get(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn(s)
+	if err == nil || !isAuthError(err) {
+		return err
+	}
+
+	// Compared with the value that failed rather than the cached one, which a background refresh might already have
+	// rotated.
+	s, changed, rerr := h.refresh(ctx, s)
+	if rerr != nil {
+		Warningf(ctx, "failed to refresh secret %q after an auth error: %v", h.resource, rerr)
+		return err
+	}
+	if !changed {
+		return err
+	}
+	Infof(ctx, "secret %q was rotated, trying again with the new value", h.resource)
+	return fn(s)
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingSecretGetter is a SecretGetter whose secrets can be changed and that counts how often they are fetched.
+type countingSecretGetter struct {
+	secrets map[string]string
+	err     error
+	fetches int
+}
+
+func (c *countingSecretGetter) GetSecret(_ context.Context, name string) (string, error) {
+	c.fetches++
+	if c.err != nil {
+		return "", c.err
+	}
+	return c.secrets[name], nil
+}
+
+func TestCachingSecretGetter(t *testing.T) {
+	ctx := context.Background()
+	sg := &countingSecretGetter{secrets: map[string]string{"s": "v1"}}
+	c := newCachingSecretGetter(sg, time.Minute)
+	c.nameSecrets([]*Secret{{LocalName: "token", ResourceName: "s"}})
+	now := time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	get := func(want string, wantFetches int) {
+		t.Helper()
+		got, err := c.GetSecret(ctx, "s")
+		if err != nil {
+			t.Fatalf("GetSecret failed: %v", err)
+		}
+		if got != want || sg.fetches != wantFetches {
+			t.Errorf("GetSecret = %q after %d fetches, want %q after %d fetches", got, sg.fetches, want, wantFetches)
+		}
+	}
+
+	get("v1", 1)
+	sg.secrets["s"] = "v2"
+	now = now.Add(30 * time.Second)
+	get("v1", 1) // Still cached.
+	now = now.Add(30 * time.Second)
+	get("v2", 2) // Expired.
+
+	sg.secrets["s"] = "v3"
+	c.invalidateSecret("s")
+	get("v3", 3)
+
+	sg.secrets["s"] = "v4"
+	c.refresh(ctx)
+	get("v4", 4)
+
+	// The last value is kept if the secret cannot be fetched again.
+	sg.err = errors.New("unavailable")
+	failures := secretFetchFailures.With(prometheus.Labels{"secret": "token"})
+	before := testutil.ToFloat64(failures)
+	now = now.Add(2 * time.Minute)
+	get("v4", 5)
+	if got := testutil.ToFloat64(failures) - before; got != 1 {
+		t.Errorf("got %v more fetch failures, want 1", got)
+	}
+
+	// Secrets that were never fetched still fail.
+	if _, err := c.GetSecret(ctx, "other"); err == nil {
+		t.Error("GetSecret unexpectedly succeeded for a secret that cannot be fetched")
+	}
+
+	const wantAge = `
+# HELP cloud_build_notifier_secret_age_seconds Time since a cached secret was last fetched successfully.
+# TYPE cloud_build_notifier_secret_age_seconds gauge
+cloud_build_notifier_secret_age_seconds{secret="token"} 120
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(wantAge)); err != nil {
+		t.Errorf("got unexpected secret age metric: %v", err)
+	}
+
+	// Secrets that are no longer in the config are left out of the metric.
+	c.nameSecrets(nil)
+	if n := testutil.CollectAndCount(c); n != 0 {
+		t.Errorf("got %d secret age metrics for a config without secrets, want 0", n)
+	}
+}
+
+func TestSecretHandleUse(t *testing.T) {
+	errAuth := errors.New("unauthorized")
+	isAuthError := func(err error) bool { return errors.Is(err, errAuth) }
+
+	for _, tc := range []struct {
+		name      string
+		rotateTo  string // The value the secret is rotated to before it is used, if any.
+		cacheTo   string // The value the cache is refreshed to after the first call of fn fails, if any.
+		accept    string // The only value that fn accepts.
+		wantCalls []string
+		wantErr   bool
+	}{{
+		name:      "current value works",
+		accept:    "old",
+		wantCalls: []string{"old"},
+	}, {
+		name:      "rotated",
+		rotateTo:  "new",
+		accept:    "new",
+		wantCalls: []string{"old", "new"},
+	}, {
+		name:      "rotated in the cache after the failed call",
+		cacheTo:   "new",
+		accept:    "new",
+		wantCalls: []string{"old", "new"},
+	}, {
+		name:      "not rotated",
+		accept:    "new",
+		wantCalls: []string{"old"},
+		wantErr:   true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			sg := &countingSecretGetter{secrets: map[string]string{"s": "old"}}
+			c := newCachingSecretGetter(sg, time.Hour)
+			h := NewSecretHandle(c, "s")
+			if _, err := h.Get(ctx); err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if tc.rotateTo != "" {
+				sg.secrets["s"] = tc.rotateTo
+			}
+
+			var calls []string
+			err := h.Use(ctx, func(s string) error {
+				calls = append(calls, s)
+				if tc.cacheTo != "" && len(calls) == 1 {
+					// As if a background refresh picked up the rotated secret while fn was running.
+					sg.secrets["s"] = tc.cacheTo
+					c.refresh(ctx)
+				}
+				if s != tc.accept {
+					return errAuth
+				}
+				return nil
+			}, isAuthError)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Use got error %v, want error = %v", err, tc.wantErr)
+			}
+			if strings.Join(calls, ",") != strings.Join(tc.wantCalls, ",") {
+				t.Errorf("Use called fn with %q, want %q", calls, tc.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"sort"
+	texttemplate "text/template"
+	"text/template/parse"
+)
+
+// templateSecretsField is the TemplateView field that holds the secrets used by a template.
+const templateSecretsField = "Secrets"
+
+// redactingSecretGetter is a SecretGetter that makes the logger redact every secret value it gets.
+type redactingSecretGetter struct {
+	SecretGetter
+}
+
+func (r *redactingSecretGetter) GetSecret(ctx context.Context, name string) (string, error) {
+	s, err := r.SecretGetter.GetSecret(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	stdLogger.redactSecret(s)
+	return s, nil
+}
+
+// TemplateSecrets are the secrets in a config's `spec.secrets` that a template uses, for use as TemplateView.Secrets.
+// Each of them is a SecretHandle, so they are got from the SecretGetter on every send and rotated secrets are picked
+// up without a redeploy.
+type TemplateSecrets struct {
+	handles map[string]*SecretHandle // Map of the secret's local name => its handle.
+}
+
+// NewTemplateSecrets returns the TemplateSecrets for the secrets that the given parsed text/template or html/template
+// Template (or any template associated with it) uses as `.Secrets.<name>` or `index .Secrets "<name>"`. If it uses
+// `.Secrets` in any other way, all of the config's secrets are included. It fails if any of them cannot be got, so
+// that a bad config is caught at set-up.
+func NewTemplateSecrets(ctx context.Context, sg SecretGetter, cfg *Config, tmpl templateExecutor) (*TemplateSecrets, error) {
+	var trees []*parse.Tree
+	switch t := tmpl.(type) {
+	case *texttemplate.Template:
+		for _, at := range t.Templates() {
+			trees = append(trees, at.Tree)
+		}
+	case *htmltemplate.Template:
+		for _, at := range t.Templates() {
+			trees = append(trees, at.Tree)
+		}
+	default:
+		return nil, fmt.Errorf("got unsupported template type %T", tmpl)
+	}
+	names, all := usedTemplateSecrets(trees...)
+	if all {
+		names = nil
+		for _, s := range cfg.Spec.Secrets {
+			names = append(names, s.LocalName)
+		}
+	}
+
+	ts := &TemplateSecrets{handles: map[string]*SecretHandle{}}
+	for _, name := range names {
+		resource, err := FindSecretResourceName(cfg.Spec.Secrets, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find Secret %q used by the template: %w", name, err)
+		}
+		ts.handles[name] = NewSecretHandle(sg, resource)
+	}
+	if _, err := ts.Get(ctx); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// Get returns the current values of the secrets, keyed by their local names. The values are redacted from every log
+// entry. A nil TemplateSecrets has no secrets.
+func (t *TemplateSecrets) Get(ctx context.Context) (map[string]string, error) {
+	secrets := map[string]string{}
+	if t == nil {
+		return secrets, nil
+	}
+	for name, h := range t.handles {
+		s, err := h.Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Secret %q used by the template: %w", name, err)
+		}
+		stdLogger.redactSecret(s)
+		secrets[name] = s
+	}
+	return secrets, nil
+}
+
+// usedTemplateSecrets returns the sorted names of the secrets that the templates use, or true if they use `.Secrets`
+// in a way that the names cannot be determined from.
+func usedTemplateSecrets(trees ...*parse.Tree) ([]string, bool) {
+	used := map[string]bool{}
+	all := false
+	visit := func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.FieldNode:
+			if name, ok := secretsFieldName(n.Ident); ok {
+				if name == "" {
+					all = true
+				} else {
+					used[name] = true
+				}
+			}
+		case *parse.VariableNode:
+			// Only `$.Secrets...` refers to the TemplateView; other variables could be anything.
+			if len(n.Ident) > 1 && n.Ident[0] == "$" {
+				if name, ok := secretsFieldName(n.Ident[1:]); ok {
+					if name == "" {
+						all = true
+					} else {
+						used[name] = true
+					}
+				}
+			}
+		case *parse.CommandNode:
+			// `index .Secrets "name"` is handled here so that its bare `.Secrets` argument is not walked.
+			if name, ok := indexedSecretName(n); ok {
+				used[name] = true
+			}
+		}
+	}
+	for _, t := range trees {
+		if t != nil && t.Root != nil {
+			walkTemplate(t.Root, visit)
+		}
+	}
+
+	var names []string
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, all
+}
+
+// secretsFieldName returns the secret name in a `.Secrets.<name>` field chain, the empty string if the chain is just
+// `.Secrets`, and false if it does not start with `.Secrets` at all.
+func secretsFieldName(ident []string) (string, bool) {
+	if len(ident) == 0 || ident[0] != templateSecretsField {
+		return "", false
+	}
+	if len(ident) == 1 {
+		return "", true
+	}
+	return ident[1], true
+}
+
+// indexedSecretName returns the secret name in an `index .Secrets "<name>"` command.
+func indexedSecretName(n *parse.CommandNode) (string, bool) {
+	if len(n.Args) != 3 {
+		return "", false
+	}
+	if id, ok := n.Args[0].(*parse.IdentifierNode); !ok || id.Ident != "index" {
+		return "", false
+	}
+	f, ok := n.Args[1].(*parse.FieldNode)
+	if !ok || len(f.Ident) != 1 || f.Ident[0] != templateSecretsField {
+		return "", false
+	}
+	s, ok := n.Args[2].(*parse.StringNode)
+	if !ok {
+		return "", false
+	}
+	return s.Text, true
+}
+
+// walkTemplate calls fn for every node in the template, except for the arguments of `index .Secrets "<name>"`
+// commands.
+func walkTemplate(n parse.Node, fn func(parse.Node)) {
+	if n == nil {
+		return
+	}
+	fn(n)
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			walkTemplate(c, fn)
+		}
+	case *parse.ActionNode:
+		walkTemplate(n.Pipe, fn)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			walkTemplate(c, fn)
+		}
+	case *parse.CommandNode:
+		if _, ok := indexedSecretName(n); ok {
+			return
+		}
+		for _, a := range n.Args {
+			walkTemplate(a, fn)
+		}
+	case *parse.ChainNode:
+		walkTemplate(n.Node, fn)
+	case *parse.IfNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.RangeNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.WithNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.TemplateNode:
+		walkTemplate(n.Pipe, fn)
+	}
+}
+
+func walkBranch(b *parse.BranchNode, fn func(parse.Node)) {
+	walkTemplate(b.Pipe, fn)
+	walkTemplate(b.List, fn)
+	walkTemplate(b.ElseList, fn)
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	htmltemplate "html/template"
+	"testing"
+	texttemplate "text/template"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTemplateSecrets(t *testing.T) {
+	cfg := &Config{Spec: &Spec{Secrets: []*Secret{
+		{LocalName: "token", ResourceName: "projects/p/secrets/token/versions/latest"},
+		{LocalName: "key", ResourceName: "projects/p/secrets/key/versions/latest"},
+	}}}
+	sg := &fakeSecretGetter{secrets: map[string]string{
+		"projects/p/secrets/token/versions/latest": "t0ken",
+		"projects/p/secrets/key/versions/latest":   "k3y",
+	}}
+
+	for _, tc := range []struct {
+		name string
+		tmpl func() (templateExecutor, error)
+		want map[string]string
+	}{{
+		name: "no secrets",
+		tmpl: func() (templateExecutor, error) { return texttemplate.New("t").Parse(`{{.Build.Id}}`) },
+		want: map[string]string{},
+	}, {
+		name: "field",
+		tmpl: func() (templateExecutor, error) {
+			return texttemplate.New("t").Parse(`{{if .Build}}{{.Secrets.token}}{{end}}`)
+		},
+		want: map[string]string{"token": "t0ken"},
+	}, {
+		name: "index",
+		tmpl: func() (templateExecutor, error) { return texttemplate.New("t").Parse(`{{index .Secrets "key"}}`) },
+		want: map[string]string{"key": "k3y"},
+	}, {
+		name: "root variable in range",
+		tmpl: func() (templateExecutor, error) {
+			return texttemplate.New("t").Parse(`{{range .Build.Steps}}{{$.Secrets.key}}{{end}}`)
+		},
+		want: map[string]string{"key": "k3y"},
+	}, {
+		name: "associated template",
+		tmpl: func() (templateExecutor, error) {
+			return texttemplate.New("t").Parse(`{{define "auth"}}{{.Secrets.token}}{{end}}{{template "auth" .}}`)
+		},
+		want: map[string]string{"token": "t0ken"},
+	}, {
+		name: "bare secrets",
+		tmpl: func() (templateExecutor, error) { return texttemplate.New("t").Parse(`{{range .Secrets}}{{.}}{{end}}`) },
+		want: map[string]string{"token": "t0ken", "key": "k3y"},
+	}, {
+		name: "html template",
+		tmpl: func() (templateExecutor, error) {
+			return htmltemplate.New("t").Parse(`<a href="?token={{.Secrets.token}}">logs</a>`)
+		},
+		want: map[string]string{"token": "t0ken"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpl, err := tc.tmpl()
+			if err != nil {
+				t.Fatalf("failed to parse template: %v", err)
+			}
+			ts, err := NewTemplateSecrets(context.Background(), sg, cfg, tmpl)
+			if err != nil {
+				t.Fatalf("NewTemplateSecrets failed: %v", err)
+			}
+			got, err := ts.Get(context.Background())
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Get got unexpected secrets (want- got+):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTemplateSecretsRotation(t *testing.T) {
+	ctx := context.Background()
+	const resource = "projects/p/secrets/token/versions/latest"
+	cfg := &Config{Spec: &Spec{Secrets: []*Secret{{LocalName: "token", ResourceName: resource}}}}
+	sg := &fakeSecretGetter{secrets: map[string]string{resource: "old"}}
+	tmpl, err := texttemplate.New("t").Parse(`{{.Secrets.token}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewTemplateSecrets(ctx, sg, cfg, tmpl)
+	if err != nil {
+		t.Fatalf("NewTemplateSecrets failed: %v", err)
+	}
+
+	// The secrets are got again on every send instead of being kept from set-up.
+	sg.secrets[resource] = "new"
+	got, err := ts.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if diff := cmp.Diff(map[string]string{"token": "new"}, got); diff != "" {
+		t.Errorf("Get got unexpected secrets (want- got+):\n%s", diff)
+	}
+}
+
+func TestTemplateSecretsErrors(t *testing.T) {
+	cfg := &Config{Spec: &Spec{Secrets: []*Secret{
+		{LocalName: "token", ResourceName: "projects/p/secrets/token/versions/latest"},
+	}}}
+	for _, tc := range []struct {
+		name string
+		tmpl string
+	}{{
+		name: "unknown secret",
+		tmpl: `{{.Secrets.nope}}`,
+	}, {
+		name: "secret not stored",
+		tmpl: `{{.Secrets.token}}`,
+	}} {
+		tmpl, err := texttemplate.New("t").Parse(tc.tmpl)
+		if err != nil {
+			t.Fatalf("%s: failed to parse template: %v", tc.name, err)
+		}
+		if _, err := NewTemplateSecrets(context.Background(), new(fakeSecretGetter), cfg, tmpl); err == nil {
+			t.Errorf("%s: NewTemplateSecrets unexpectedly succeeded", tc.name)
+		}
+	}
+}
+
+func TestRedactingSecretGetter(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l *logger) { stdLogger = l }(stdLogger)
+	stdLogger = &logger{out: &buf, level: severityInfo, now: stdLogger.now}
+
+	sg := &redactingSecretGetter{&fakeSecretGetter{secrets: map[string]string{"s": "hunter2"}}}
+	if _, err := sg.GetSecret(context.Background(), "s"); err != nil {
+		t.Fatalf("GetSecret failed: %v", err)
+	}
+	Infof(context.Background(), "the password is %s", "hunter2")
+	if bytes.Contains(buf.Bytes(), []byte("hunter2")) {
+		t.Errorf("got unredacted secret in log output %q", buf.String())
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+)
+
+// multiSecretGetter is a SecretGetter that dispatches to other SecretGetters based on the scheme of the secret's
+// resource name.
+type multiSecretGetter struct {
+	schemes map[string]SecretGetter // Map of scheme => its SecretGetter. Names without a scheme use the "" entry.
+}
+
+// newSecretGetter returns a SecretGetter that supports the following resource names, as given in `spec.secrets`:
+// - `projects/some-project/secrets/some-secret/versions/latest` for Secret Manager secret versions, using the given
+// SecretGetter.
+// - `env://SOME_VAR` for secrets stored in the environment variable `SOME_VAR`.
+// - `file:///path/to/file` for secrets stored in local files, such as Cloud Run secret volumes.
+func newSecretGetter(sm SecretGetter) SecretGetter {
+	return &multiSecretGetter{schemes: map[string]SecretGetter{
+		"":     sm,
+		"env":  new(envSecretGetter),
+		"file": new(fileSecretGetter),
+	}}
+}
+
+func (m *multiSecretGetter) GetSecret(ctx context.Context, name string) (string, error) {
+	var scheme string
+	if i := strings.Index(name, "://"); i >= 0 {
+		scheme = name[:i]
+	}
+
+	sg, ok := m.schemes[scheme]
+	if !ok {
+		return "", fmt.Errorf("got unsupported scheme %q in secret %q (expected a Secret Manager secret version, `env://` or `file://`)", scheme, name)
+	}
+	return sg.GetSecret(ctx, name)
+}
+
+// envSecretGetter is a SecretGetter for `env://SOME_VAR` resource names, whose value is the value of the environment
+// variable `SOME_VAR`.
+type envSecretGetter struct{}
+
+func (e *envSecretGetter) GetSecret(_ context.Context, name string) (string, error) {
+	v := strings.TrimPrefix(name, "env://")
+	val, ok := os.LookupEnv(v)
+	if !ok {
+		return "", fmt.Errorf("environment variable %q is not set", v)
+	}
+	return val, nil
+}
+
+// fileSecretGetter is a SecretGetter for `file:///path/to/file` resource names, whose value is the contents of the file
+// without a trailing newline.
+type fileSecretGetter struct{}
+
+func (f *fileSecretGetter) GetSecret(_ context.Context, name string) (string, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse URI %q: %w", name, err)
+	}
+	// Host is non-empty for relative paths like `file://path/to/file`.
+	b, err := ioutil.ReadFile(u.Host + u.Path)
+	if err != nil {
+		return "", err
+	}
+	// Files written by hand or with `echo` usually end with a newline that is not part of the secret.
+	return strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r"), nil
+}
+
+// lazySecretManager is a SecretGetter for Secret Manager secret versions that only creates a Secret Manager client once
+// it is first needed, so that notifiers whose secrets all come from other sources do not need GCP credentials.
+type lazySecretManager struct {
+	once   sync.Once
+	client *secretmanager.Client
+	err    error
+}
+
+func (l *lazySecretManager) GetSecret(ctx context.Context, name string) (string, error) {
+	l.once.Do(func() {
+		// Not the caller's context since the client outlives it and stops working once its context is canceled.
+		l.client, l.err = secretmanager.NewClient(context.Background())
+	})
+	if l.err != nil {
+		return "", fmt.Errorf("failed to create new SecretManager client: %w", l.err)
+	}
+	return (&actualSecretManager{client: l.client}).GetSecret(ctx, name)
+}
+
+// Close closes the underlying Secret Manager client, if one was created.
+func (l *lazySecretManager) Close() error {
+	if l.client == nil {
+		return nil
+	}
+	return l.client.Close()
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetSecretFromSources(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "webhook-url")
+	if err := ioutil.WriteFile(secretFile, []byte("https://hooks.example.com/file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	const envVar = "NOTIFIERS_TEST_SECRET"
+	os.Setenv(envVar, "https://hooks.example.com/env")
+	defer os.Unsetenv(envVar)
+
+	const smName = "projects/some-project/secrets/webhook-url/versions/latest"
+	sg := newSecretGetter(&fakeSecretGetter{secrets: map[string]string{smName: "https://hooks.example.com/sm"}})
+
+	for _, tc := range []struct {
+		name      string
+		resource  string
+		want      string
+		wantError bool
+	}{{
+		name:     "secret manager",
+		resource: smName,
+		want:     "https://hooks.example.com/sm",
+	}, {
+		name:     "env",
+		resource: "env://" + envVar,
+		want:     "https://hooks.example.com/env",
+	}, {
+		name:     "file",
+		resource: "file://" + secretFile,
+		want:     "https://hooks.example.com/file",
+	}, {
+		name:      "missing file",
+		resource:  "file://" + filepath.Join(dir, "nowhere"),
+		wantError: true,
+	}, {
+		name:      "unset env var",
+		resource:  "env://NOTIFIERS_TEST_UNSET_VAR",
+		wantError: true,
+	}, {
+		name:      "unsupported scheme",
+		resource:  "vault://secret/webhook-url",
+		wantError: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := sg.GetSecret(context.Background(), tc.resource)
+			if err != nil {
+				if tc.wantError {
+					t.Logf("got expected error: %v", err)
+					return
+				}
+				t.Fatalf("GetSecret(%q) failed: %v", tc.resource, err)
+			}
+			if tc.wantError {
+				t.Fatalf("GetSecret(%q) succeeded unexpectedly", tc.resource)
+			}
+			if got != tc.want {
+				t.Errorf("GetSecret(%q) = %q, want %q", tc.resource, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultHTTPReadTimeout  = 30 * time.Second
+	defaultHTTPWriteTimeout = 5 * time.Minute // Cloud Run's default request timeout.
+	// Cloud Run kills the container 10 seconds after sending SIGTERM, which leaves a little time to close the notifier.
+	defaultShutdownTimeout = 8 * time.Second
+)
+
+// durationFromEnv returns the duration in the given environment variable, or the default if it is not set.
+func durationFromEnv(name string, def time.Duration) (time.Duration, error) {
+	v, ok := GetEnv(name)
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s %q: %w", name, v, err)
+	}
+	return d, nil
+}
+
+// newServerFromEnv returns an HTTP server for the default mux at the given address along with how long to wait for
+// in-flight requests on shutdown, using the timeouts in HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT and SHUTDOWN_TIMEOUT.
+func newServerFromEnv(addr string) (*http.Server, time.Duration, error) {
+	read, err := durationFromEnv("HTTP_READ_TIMEOUT", defaultHTTPReadTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	write, err := durationFromEnv("HTTP_WRITE_TIMEOUT", defaultHTTPWriteTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	shutdown, err := durationFromEnv("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &http.Server{
+		Addr:         addr,
+		ReadTimeout:  read,
+		WriteTimeout: write,
+	}, shutdown, nil
+}
+
+// errShutdownTimeout is returned by serve if requests were still in flight once the shutdown timeout passed.
+var errShutdownTimeout = errors.New("in-flight requests did not finish before the shutdown timeout")
+
+// serve serves HTTP requests on the listener until serving fails or the context is done. In the latter case, the
+// server stops accepting new requests and waits up to the shutdown timeout for in-flight requests to finish.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, shutdownTimeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	Infof(ctx, "shutting down, waiting up to %v for in-flight requests", shutdownTimeout)
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", errShutdownTimeout, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to shut down HTTP server: %w", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// closeNotifier closes the notifier if it implements io.Closer, e.g. to flush and close its clients, along with the
+// receiver's dedup store.
+func closeNotifier(ctx context.Context, notifier Notifier, params *receiverParams) {
+	if c, ok := notifier.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			Warningf(ctx, "failed to close notifier: %v", err)
+		}
+	}
+	if params.dedup != nil {
+		if err := params.dedup.Close(); err != nil {
+			Warningf(ctx, "failed to close dedup store: %v", err)
+		}
+	}
+}
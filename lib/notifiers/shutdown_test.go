@@ -0,0 +1,158 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+// closingNotifier is a Notifier that records whether it was closed.
+type closingNotifier struct {
+	closed   chan struct{}
+	closeErr error
+}
+
+func newClosingNotifier(closeErr error) *closingNotifier {
+	return &closingNotifier{closed: make(chan struct{}), closeErr: closeErr}
+}
+
+func (c *closingNotifier) SetUp(_ context.Context, _ *Config, _ string, _ SecretGetter, _ BindingResolver) error {
+	return nil
+}
+
+func (c *closingNotifier) SendNotification(_ context.Context, _ *cbpb.Build) error {
+	return nil
+}
+
+func (c *closingNotifier) Close() error {
+	close(c.closed)
+	return c.closeErr
+}
+
+func (c *closingNotifier) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestServe(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		handleFor time.Duration // How long the in-flight request takes after shutdown starts.
+		wantError bool
+	}{{
+		name:      "drained",
+		handleFor: 50 * time.Millisecond,
+	}, {
+		name:      "timed out",
+		handleFor: 5 * time.Second,
+		wantError: true,
+	}} {
+		started, release := make(chan struct{}), make(chan struct{})
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
+			close(started)
+			select {
+			case <-release:
+			case <-time.After(tc.handleFor):
+			}
+			w.Write([]byte("done"))
+		})
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() {
+			served <- serve(ctx, &http.Server{Handler: mux}, ln, time.Second)
+		}()
+
+		type result struct {
+			body string
+			err  error
+		}
+		resp := make(chan result, 1)
+		go func() {
+			r, err := http.Get("http://" + ln.Addr().String())
+			if err != nil {
+				resp <- result{err: err}
+				return
+			}
+			defer r.Body.Close()
+			b, err := ioutil.ReadAll(r.Body)
+			resp <- result{body: string(b), err: err}
+		}()
+
+		<-started
+		cancel()
+
+		if err := <-served; (err != nil) != tc.wantError {
+			t.Errorf("%s: serve() got error %v, want error = %v", tc.name, err, tc.wantError)
+		}
+		close(release)
+		if got := <-resp; !tc.wantError && (got.err != nil || got.body != "done") {
+			t.Errorf("%s: in-flight request got (%q, %v), want (%q, nil)", tc.name, got.body, got.err, "done")
+		}
+	}
+}
+
+func TestRouterClose(t *testing.T) {
+	ok, failing := newClosingNotifier(nil), newClosingNotifier(errors.New("oops"))
+	r := &router{routes: []*route{
+		{notifier: failing},
+		{notifier: &recordingNotifier{}}, // Not an io.Closer.
+		{notifier: ok},
+	}}
+
+	if err := r.Close(); err == nil {
+		t.Error("Close succeeded unexpectedly")
+	}
+	if !ok.isClosed() || !failing.isClosed() {
+		t.Errorf("Close did not close every route: got closed = [%v, %v], want [true, true]", failing.isClosed(), ok.isClosed())
+	}
+}
+
+func TestRetireRouter(t *testing.T) {
+	n := newClosingNotifier(nil)
+	r := &router{routes: []*route{{notifier: n}}}
+
+	r.inflight.Add(1)
+	go retireRouter(context.Background(), r)
+
+	time.Sleep(50 * time.Millisecond)
+	if n.isClosed() {
+		t.Fatal("router was closed while a notification was in flight")
+	}
+
+	r.inflight.Done()
+	select {
+	case <-n.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("router was not closed after the in-flight notification finished")
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// shortSHALength is the length of the commit SHAs returned by shortSha, matching Cloud Build's `SHORT_SHA`.
+const shortSHALength = 7
+
+// TemplateFuncs returns the functions that every notifier's templates can use:
+// - `toJson`: the value encoded as JSON. Protos such as `.Build` are encoded like the Pub/Sub messages they came in.
+// - `json`: the string escaped for use inside a JSON string, e.g. `"{{json .Build.FailureInfo.Detail}}"`.
+// - `quote`: the string as a quoted JSON string, e.g. `{{quote .Build.FailureInfo.Detail}}`.
+// - `default`: `{{.Params.channel | default "#builds"}}` is the param, or "#builds" if it is empty.
+// - `upper`, `lower` and `trunc`: `{{trunc 50 .Build.FailureInfo.Detail}}` is at most the first 50 characters.
+// - `formatTime`: `{{formatTime "2006-01-02 15:04" "Europe/Berlin" .Build.StartTime}}` formats a timestamp with a Go
+// layout in a time zone.
+// - `duration`: `{{duration .Build.StartTime .Build.FinishTime}}` is the time between two timestamps, rounded to the
+// second, or 0s if either is unset.
+// - `shortSha`: the first 7 characters of a commit SHA.
+//
+// Notifiers should add them to their templates with `template.New(name).Funcs(notifiers.TemplateFuncs())`, or with
+// `Funcs(htmltemplate.FuncMap(notifiers.TemplateFuncs()))` for html/template.
+func TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"toJson":     toJSON,
+		"json":       jsonEscape,
+		"quote":      jsonQuote,
+		"default":    defaultValue,
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"trunc":      truncate,
+		"formatTime": formatTime,
+		"duration":   timestampDuration,
+		"shortSha":   shortSHA,
+	}
+}
+
+func toJSON(v interface{}) (string, error) {
+	if m, ok := v.(proto.Message); ok {
+		b, err := protojson.Marshal(m)
+		if err != nil {
+			return "", err
+		}
+		// Compacted since protojson's output is deliberately unstable.
+		buf := new(bytes.Buffer)
+		if err := json.Compact(buf, b); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func jsonQuote(s string) (string, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func jsonEscape(s string) (string, error) {
+	q, err := jsonQuote(s)
+	if err != nil {
+		return "", err
+	}
+	return q[1 : len(q)-1], nil
+}
+
+// defaultValue returns v, or def if v is nil or the zero value of its type (such as an empty string) or an empty
+// slice or map.
+func defaultValue(def, v interface{}) interface{} {
+	if v == nil {
+		return def
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Array:
+		if rv.Len() == 0 {
+			return def
+		}
+	default:
+		if rv.IsZero() {
+			return def
+		}
+	}
+	return v
+}
+
+// truncate returns the first n characters of s.
+func truncate(n int, s string) string {
+	r := []rune(s)
+	if n < 0 || len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
+
+// formatTime formats the given *timestamppb.Timestamp or time.Time with the Go layout in the named time zone (e.g.
+// "UTC" or "Europe/Berlin"). It returns the empty string for an unset timestamp.
+func formatTime(layout, tz string, t interface{}) (string, error) {
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return "", fmt.Errorf("failed to load time zone %q: %w", tz, err)
+	}
+	tm, ok, err := toTime(t)
+	if err != nil || !ok {
+		return "", err
+	}
+	return tm.In(loc).Format(layout), nil
+}
+
+func timestampDuration(start, end interface{}) (time.Duration, error) {
+	s, ok, err := toTime(start)
+	if err != nil || !ok {
+		return 0, err
+	}
+	e, ok, err := toTime(end)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return e.Sub(s).Round(time.Second), nil
+}
+
+// toTime converts a *timestamppb.Timestamp or time.Time to a time.Time. It returns false if the timestamp is unset.
+func toTime(t interface{}) (time.Time, bool, error) {
+	switch t := t.(type) {
+	case nil:
+		return time.Time{}, false, nil
+	case *timestamppb.Timestamp:
+		if t == nil {
+			return time.Time{}, false, nil
+		}
+		return t.AsTime(), true, nil
+	case time.Time:
+		return t, !t.IsZero(), nil
+	default:
+		return time.Time{}, false, fmt.Errorf("expected a timestamp, got %T", t)
+	}
+}
+
+func shortSHA(sha string) string {
+	return truncate(shortSHALength, sha)
+}
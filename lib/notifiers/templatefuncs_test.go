@@ -0,0 +1,159 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"testing"
+	"text/template"
+	"time"
+
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	start := time.Date(2021, 4, 1, 22, 30, 0, 0, time.UTC)
+	view := &TemplateView{
+		Build: &BuildView{Build: &cbpb.Build{
+			Id:         "some-build",
+			Status:     cbpb.Build_FAILURE,
+			StartTime:  timestamppb.New(start),
+			FinishTime: timestamppb.New(start.Add(90*time.Second + 400*time.Millisecond)),
+			Tags:       []string{"a", "b"},
+			FailureInfo: &cbpb.Build_FailureInfo{
+				Detail: `step "test" failed: exit status 1`,
+			},
+			Substitutions: map[string]string{"COMMIT_SHA": "0123456789abcdef"},
+		}},
+		Params: map[string]string{"channel": "", "team": "infra"},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		tmpl      string
+		want      string
+		wantError bool
+	}{{
+		name: "toJson proto",
+		tmpl: `{{toJson .Build.Tags}} {{toJson .Build.FailureInfo}}`,
+		want: `["a","b"] {"detail":"step \"test\" failed: exit status 1"}`,
+	}, {
+		name: "toJson map",
+		tmpl: `{{toJson .Params}}`,
+		want: `{"channel":"","team":"infra"}`,
+	}, {
+		name: "json",
+		tmpl: `{"detail": "{{json .Build.FailureInfo.Detail}}"}`,
+		want: `{"detail": "step \"test\" failed: exit status 1"}`,
+	}, {
+		name: "quote",
+		tmpl: `{"detail": {{quote .Build.FailureInfo.Detail}}}`,
+		want: `{"detail": "step \"test\" failed: exit status 1"}`,
+	}, {
+		name: "default",
+		tmpl: `{{.Params.channel | default "#builds"}} {{.Params.team | default "none"}} {{.Params.missing | default "none"}}`,
+		want: `#builds infra none`,
+	}, {
+		name: "strings",
+		tmpl: `{{upper "ok"}} {{lower "OK"}} {{trunc 4 .Build.FailureInfo.Detail}} {{trunc 100 "short"}}`,
+		want: `OK ok step short`,
+	}, {
+		name: "formatTime",
+		tmpl: `{{formatTime "2006-01-02 15:04" "Europe/Berlin" .Build.StartTime}} {{formatTime "15:04" "UTC" .Build.CreateTime}}|`,
+		want: `2021-04-02 00:30 |`,
+	}, {
+		name:      "formatTime unknown zone",
+		tmpl:      `{{formatTime "15:04" "Nowhere/Special" .Build.StartTime}}`,
+		wantError: true,
+	}, {
+		name: "duration",
+		tmpl: `{{duration .Build.StartTime .Build.FinishTime}} {{duration .Build.CreateTime .Build.FinishTime}}`,
+		want: `1m30s 0s`,
+	}, {
+		name:      "duration of non-timestamp",
+		tmpl:      `{{duration .Build.Id .Build.FinishTime}}`,
+		wantError: true,
+	}, {
+		name: "shortSha",
+		tmpl: `{{shortSha .Build.Substitutions.COMMIT_SHA}} {{shortSha "abc"}}`,
+		want: `0123456 abc`,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpl, err := template.New("t").Funcs(TemplateFuncs()).Parse(tc.tmpl)
+			if err != nil {
+				t.Fatalf("failed to parse template: %v", err)
+			}
+			var buf bytes.Buffer
+			err = tmpl.Execute(&buf, view)
+			if err != nil {
+				if tc.wantError {
+					t.Logf("got expected error: %v", err)
+					return
+				}
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if tc.wantError {
+				t.Fatalf("Execute unexpectedly succeeded with %q", buf.String())
+			}
+			if got := buf.String(); got != tc.want {
+				t.Errorf("Execute = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTemplateFuncsJSONPayload(t *testing.T) {
+	// Templates that build JSON payloads stay valid no matter what the Build contains.
+	tmpl, err := template.New("t").Funcs(TemplateFuncs()).Parse(`{"id": {{quote .Build.Id}}, "build": {{toJson .Build}}}`)
+	if err != nil {
+		t.Fatalf("failed to parse template: %v", err)
+	}
+	var buf bytes.Buffer
+	build := &cbpb.Build{Id: `a "quoted" id`, FailureInfo: &cbpb.Build_FailureInfo{Detail: "line\nbreak \\ \"quote\""}}
+	if err := tmpl.Execute(&buf, &TemplateView{Build: &BuildView{Build: build}}); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	var got struct {
+		ID    string `json:"id"`
+		Build struct {
+			FailureInfo struct {
+				Detail string `json:"detail"`
+			} `json:"failureInfo"`
+		} `json:"build"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("got invalid JSON %q: %v", buf.String(), err)
+	}
+	if got.ID != build.Id || got.Build.FailureInfo.Detail != build.FailureInfo.Detail {
+		t.Errorf("got payload %+v that does not match the Build", got)
+	}
+}
+
+func TestTemplateFuncsHTML(t *testing.T) {
+	tmpl, err := htmltemplate.New("t").Funcs(htmltemplate.FuncMap(TemplateFuncs())).Parse(`<b>{{upper .}}</b>`)
+	if err != nil {
+		t.Fatalf("failed to parse template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, "<fail>"); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if want := "<b>&lt;FAIL&gt;</b>"; buf.String() != want {
+		t.Errorf("Execute = %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+)
+
+const tracerName = "github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
+
+// httpClient is returned by HTTPClient. It is replaced by a client that propagates trace context once tracing is set
+// up.
+var httpClient = http.DefaultClient
+
+// HTTPClient returns the HTTP client that notifiers should use for outbound requests so that they are traced and carry
+// W3C trace context when tracing is enabled.
+func HTTPClient() *http.Client {
+	return httpClient
+}
+
+// templateExecutor is implemented by both text/template and html/template Templates.
+type templateExecutor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// ExecuteTemplate executes the given text/template or html/template Template in a trace span.
+func ExecuteTemplate(ctx context.Context, tmpl templateExecutor, w io.Writer, data interface{}) error {
+	_, span := startSpan(ctx, "template.Execute")
+	defer span.End()
+	return endSpan(span, tmpl.Execute(w, data))
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// startSpan starts a span with the given name, which is a no-op unless tracing is set up.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name)
+}
+
+// setBuildAttributes adds the Build's ID and status to the span.
+func setBuildAttributes(span trace.Span, build *cbpb.Build) {
+	span.SetAttributes(
+		attribute.String("build.id", build.Id),
+		attribute.String("build.status", build.Status.String()),
+	)
+}
+
+// endSpan records the given error (if any) on the span and returns it.
+func endSpan(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// setUpTracing sets up the global tracer provider from the environment and returns a function that flushes and stops
+// it. Tracing is disabled unless OTEL_TRACES_EXPORTER is `otlp`, in which case spans are exported over OTLP/HTTP and
+// the exporter is configured by the standard OTEL_EXPORTER_OTLP_* variables (e.g. OTEL_EXPORTER_OTLP_ENDPOINT).
+func setUpTracing(ctx context.Context, notifier Notifier) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	exporter, _ := GetEnv("OTEL_TRACES_EXPORTER")
+	switch exporter {
+	case "", "none":
+		return noop, nil
+	case "otlp":
+	default:
+		return nil, fmt.Errorf("got unsupported OTEL_TRACES_EXPORTER %q (expected `otlp` or `none`)", exporter)
+	}
+
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+
+	// Attributes from OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME take priority over the default service name.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", fmt.Sprintf("cloud-build-notifier:%T", notifier))),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	httpClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+	return tp.Shutdown, nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"text/template"
+
+	"github.com/golang/protobuf/proto"
+	"go.opentelemetry.io/otel"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	protov2 "google.golang.org/protobuf/proto"
+)
+
+// webhookNotifier is a Notifier that resolves its params, executes a template and POSTs the result to a URL, like
+// most real notifiers do.
+type webhookNotifier struct {
+	url  string
+	br   BindingResolver
+	tmpl *template.Template
+}
+
+func (w *webhookNotifier) SetUp(_ context.Context, _ *Config, tmpl string, _ SecretGetter, br BindingResolver) error {
+	w.br = br
+	var err error
+	w.tmpl, err = template.New("test").Parse(tmpl)
+	return err
+}
+
+func (w *webhookNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
+	params, err := w.br.Resolve(ctx, nil, build)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := ExecuteTemplate(ctx, w.tmpl, &buf, &TemplateView{Build: &BuildView{Build: build}, Params: params}); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, &buf)
+	if err != nil {
+		return err
+	}
+	resp, err := HTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// otlpCollector is a fake OTLP/HTTP collector that records the names of the spans it receives.
+type otlpCollector struct {
+	mtx   sync.Mutex
+	spans []string
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := new(coltracepb.ExportTraceServiceRequest)
+	if err := protov2.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ils := range rs.InstrumentationLibrarySpans {
+			for _, s := range ils.Spans {
+				c.spans = append(c.spans, s.Name)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(nil)
+}
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+
+	collector := new(otlpCollector)
+	cs := httptest.NewServer(collector)
+	defer cs.Close()
+
+	var traceparent string
+	ws := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	}))
+	defer ws.Close()
+
+	for k, v := range map[string]string{
+		"OTEL_TRACES_EXPORTER":        "otlp",
+		"OTEL_EXPORTER_OTLP_ENDPOINT": cs.URL,
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	prevTP, prevPropagator, prevClient := otel.GetTracerProvider(), otel.GetTextMapPropagator(), httpClient
+	defer func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevPropagator)
+		httpClient = prevClient
+	}()
+
+	shutdown, err := setUpTracing(ctx, new(webhookNotifier))
+	if err != nil {
+		t.Fatalf("setUpTracing failed: %v", err)
+	}
+
+	cfg := &Config{Spec: &Spec{Notification: &Notification{Filter: "build.status == Build.Status.SUCCESS"}}}
+	rtr, err := newRouter(ctx, &webhookNotifier{url: ws.URL}, cfg, new(setupCheckSecretGetter), nil)
+	if err != nil {
+		t.Fatalf("newRouter failed: %v", err)
+	}
+
+	data, err := protojson.Marshal(proto.MessageV2(&cbpb.Build{Id: "some-build", Status: cbpb.Build_SUCCESS}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pspw := &pubSubPushWrapper{Message: pubSubPushMessage{Data: data, ID: "some-message"}}
+	if got := handleMessage(ctx, rtr, &receiverParams{maxSendAttempts: 1}, pspw); got != ackMessage {
+		t.Fatalf("handleMessage = %v, want %v", got, ackMessage)
+	}
+
+	// Shutting down flushes all spans to the collector.
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("failed to shut down tracing: %v", err)
+	}
+
+	if traceparent == "" {
+		t.Error("webhook request did not carry a traceparent header")
+	}
+
+	got := map[string]bool{}
+	for _, name := range collector.spans {
+		got[name] = true
+	}
+	for _, want := range []string{
+		"HandleMessage",
+		"DecodeBuild",
+		"CELPredicate.Apply",
+		"Notifier.SendNotification",
+		"BindingResolver.Resolve",
+		"template.Execute",
+		"HTTP POST",
+	} {
+		if !got[want] {
+			t.Errorf("collector did not get a %q span, got: %v", want, collector.spans)
+		}
+	}
+}
@@ -17,11 +17,12 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"text/template"
 
 	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
-	log "github.com/golang/glog"
 	"github.com/slack-go/slack"
 	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
 )
@@ -32,16 +33,17 @@ const (
 
 func main() {
 	if err := notifiers.Main(new(slackNotifier)); err != nil {
-		log.Fatalf("fatal error: %v", err)
+		notifiers.Fatalf(context.Background(), "fatal error: %v", err)
 	}
 }
 
 type slackNotifier struct {
 	filter     notifiers.EventFilter
 	tmpl       *template.Template
-	webhookURL string
+	webhookURL *notifiers.SecretHandle
 	br         notifiers.BindingResolver
 	tmplView   *notifiers.TemplateView
+	secrets    *notifiers.TemplateSecrets
 }
 
 func (s *slackNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, blockKitTemplate string, sg notifiers.SecretGetter, br notifiers.BindingResolver) error {
@@ -59,13 +61,21 @@ func (s *slackNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, blockK
 	if err != nil {
 		return fmt.Errorf("failed to find Secret for ref %q: %w", wuRef, err)
 	}
-	wu, err := sg.GetSecret(ctx, wuResource)
-	if err != nil {
+	// Fetched on every send, so that a rotated webhook URL is picked up without a redeploy.
+	s.webhookURL = notifiers.NewSecretHandle(sg, wuResource)
+	if _, err := s.webhookURL.Get(ctx); err != nil {
 		return fmt.Errorf("failed to get token secret: %w", err)
 	}
-	s.webhookURL = wu
-	tmpl, err := template.New("blockkit_template").Parse(blockKitTemplate)
+	tmpl, err := template.New("blockkit_template").Funcs(notifiers.TemplateFuncs()).Parse(blockKitTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to parse Block Kit template: %w", err)
+	}
 	s.tmpl = tmpl
+	secrets, err := notifiers.NewTemplateSecrets(ctx, sg, cfg, tmpl)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets used by the template: %w", err)
+	}
+	s.secrets = secrets
 	s.br = br
 
 	return nil
@@ -77,28 +87,56 @@ func (s *slackNotifier) SendNotification(ctx context.Context, build *cbpb.Build)
 		return nil
 	}
 
-	log.Infof("sending Slack webhook for Build %q (status: %q)", build.Id, build.Status)
+	notifiers.Infof(ctx, "sending Slack webhook for Build %q (status: %q)", build.Id, build.Status)
 
 	bindings, err := s.br.Resolve(ctx, nil, build)
 	if err != nil {
-		return fmt.Errorf("failed to resolve bindings: %w", err)
+		return notifiers.Permanent(fmt.Errorf("failed to resolve bindings: %w", err))
+	}
+	secrets, err := s.secrets.Get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets used by the template: %w", err)
 	}
 
 	s.tmplView = &notifiers.TemplateView{
-		Build:  &notifiers.BuildView{Build: build},
-		Params: bindings,
+		Build:   &notifiers.BuildView{Build: build},
+		Params:  bindings,
+		Secrets: secrets,
 	}
 
-	msg, err := s.writeMessage()
+	msg, err := s.writeMessage(ctx)
 
 	if err != nil {
-		return fmt.Errorf("failed to write Slack message: %w", err)
+		return notifiers.Permanent(fmt.Errorf("failed to write Slack message: %w", err))
 	}
 
-	return slack.PostWebhook(s.webhookURL, msg)
+	post := func(webhookURL string) error {
+		return slack.PostWebhookCustomHTTPContext(ctx, webhookURL, notifiers.HTTPClient(), msg)
+	}
+	if err := s.webhookURL.Use(ctx, post, isRevokedWebhookError); err != nil {
+		// Slack's status code errors know whether they are worth retrying (i.e. 429s and 5xxs).
+		var rerr interface{ Retryable() bool }
+		if errors.As(err, &rerr) && !rerr.Retryable() {
+			return notifiers.Permanent(fmt.Errorf("failed to post Slack webhook: %w", err))
+		}
+		return fmt.Errorf("failed to post Slack webhook: %w", err)
+	}
+
+	return nil
+}
+
+// isRevokedWebhookError returns true iff the error is a response status that Slack sends for a webhook URL that was
+// revoked or removed, in which case it might have been rotated.
+func isRevokedWebhookError(err error) bool {
+	var serr interface{ HTTPStatusCode() int }
+	if !errors.As(err, &serr) {
+		return false
+	}
+	code := serr.HTTPStatusCode()
+	return code == http.StatusForbidden || code == http.StatusNotFound
 }
 
-func (s *slackNotifier) writeMessage() (*slack.WebhookMessage, error) {
+func (s *slackNotifier) writeMessage(ctx context.Context) (*slack.WebhookMessage, error) {
 	build := s.tmplView.Build
 	_, err := notifiers.AddUTMParams(build.LogUrl, notifiers.ChatMedium)
 
@@ -117,7 +155,7 @@ func (s *slackNotifier) writeMessage() (*slack.WebhookMessage, error) {
 	}
 
 	var buf bytes.Buffer
-	if err := s.tmpl.Execute(&buf, s.tmplView); err != nil {
+	if err := notifiers.ExecuteTemplate(ctx, s.tmpl, &buf, s.tmplView); err != nil {
 		return nil, err
 	}
 	var blocks slack.Blocks
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"testing"
 	"text/template"
 
@@ -55,7 +56,7 @@ func TestWriteMessage(t *testing.T) {
 		LogUrl:    "https://some.example.com/log/url?foo=bar",
 	}}}
 
-	got, err := n.writeMessage()
+	got, err := n.writeMessage(context.Background())
 	if err != nil {
 		t.Fatalf("writeMessage failed: %v", err)
 	}
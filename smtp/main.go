@@ -17,15 +17,15 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"mime/quotedprintable"
 	"net/smtp"
+	"net/textproto"
 	"strings"
 
 	"github.com/GoogleCloudPlatform/cloud-build-notifiers/lib/notifiers"
-	log "github.com/golang/glog"
-	"github.com/golang/protobuf/proto"
 	cbpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
 )
 
@@ -35,7 +35,7 @@ const (
 
 func main() {
 	if err := notifiers.Main(new(smtpNotifier)); err != nil {
-		log.Fatalf("fatal error: %v", err)
+		notifiers.Fatalf(context.Background(), "fatal error: %v", err)
 	}
 }
 
@@ -45,11 +45,13 @@ type smtpNotifier struct {
 	mcfg     mailConfig
 	br       notifiers.BindingResolver
 	tmplView *notifiers.TemplateView
+	secrets  *notifiers.TemplateSecrets
 }
 
 type mailConfig struct {
-	server, port, sender, from, password string
-	recipients                           []string
+	server, port, sender, from string
+	password                   *notifiers.SecretHandle
+	recipients                 []string
 }
 
 func (s *smtpNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, cfgTemplate string, sg notifiers.SecretGetter, br notifiers.BindingResolver) error {
@@ -58,11 +60,16 @@ func (s *smtpNotifier) SetUp(ctx context.Context, cfg *notifiers.Config, cfgTemp
 		return fmt.Errorf("failed to create CELPredicate: %w", err)
 	}
 	s.filter = prd
-	tmpl, err := template.New("email_template").Parse(cfgTemplate)
+	tmpl, err := template.New("email_template").Funcs(template.FuncMap(notifiers.TemplateFuncs())).Parse(cfgTemplate)
 	if err != nil {
 		return fmt.Errorf("failed to parse HTML email template: %w", err)
 	}
 	s.tmpl = tmpl
+	secrets, err := notifiers.NewTemplateSecrets(ctx, sg, cfg, tmpl)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets used by the template: %w", err)
+	}
+	s.secrets = secrets
 
 	mcfg, err := getMailConfig(ctx, sg, cfg.Spec)
 	if err != nil {
@@ -118,8 +125,9 @@ func getMailConfig(ctx context.Context, sg notifiers.SecretGetter, spec *notifie
 		return mailConfig{}, fmt.Errorf("failed to find Secret resource name for reference %q: %w", passwordRef, err)
 	}
 
-	password, err := sg.GetSecret(ctx, passwordResource)
-	if err != nil {
+	// Fetched on every send, so that a rotated password is picked up without a redeploy.
+	password := notifiers.NewSecretHandle(sg, passwordResource)
+	if _, err := password.Get(ctx); err != nil {
 		return mailConfig{}, fmt.Errorf("failed to get SMTP password: %w", err)
 	}
 
@@ -135,38 +143,52 @@ func getMailConfig(ctx context.Context, sg notifiers.SecretGetter, spec *notifie
 
 func (s *smtpNotifier) SendNotification(ctx context.Context, build *cbpb.Build) error {
 	if !s.filter.Apply(ctx, build) {
-		log.V(2).Infof("no mail for event:\n%s", proto.MarshalTextString(build))
+		notifiers.Debugf(ctx, "no mail for event")
 		return nil
 	}
 	bindings, err := s.br.Resolve(ctx, nil, build)
 	if err != nil {
-		log.Errorf("failed to resolve bindings :%v", err)
+		return notifiers.Permanent(fmt.Errorf("failed to resolve bindings: %w", err))
+	}
+	secrets, err := s.secrets.Get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get secrets used by the template: %w", err)
 	}
 	s.tmplView = &notifiers.TemplateView{
-		Build:  &notifiers.BuildView{Build: build},
-		Params: bindings,
+		Build:   &notifiers.BuildView{Build: build},
+		Params:  bindings,
+		Secrets: secrets,
 	}
-	log.Infof("sending email for (build id = %q, status = %s)", build.GetId(), build.GetStatus())
-	return s.sendSMTPNotification()
+	notifiers.Infof(ctx, "sending email for (build id = %q, status = %s)", build.GetId(), build.GetStatus())
+	return s.sendSMTPNotification(ctx)
 }
 
-func (s *smtpNotifier) sendSMTPNotification() error {
-	email, err := s.buildEmail()
+func (s *smtpNotifier) sendSMTPNotification(ctx context.Context) error {
+	email, err := s.buildEmail(ctx)
 	if err != nil {
-		log.Warningf("failed to build email: %v", err)
+		notifiers.Warningf(ctx, "failed to build email: %v", err)
 	}
 
 	addr := fmt.Sprintf("%s:%s", s.mcfg.server, s.mcfg.port)
-	auth := smtp.PlainAuth("", s.mcfg.sender, s.mcfg.password, s.mcfg.server)
+	send := func(password string) error {
+		auth := smtp.PlainAuth("", s.mcfg.sender, password, s.mcfg.server)
+		return smtp.SendMail(addr, auth, s.mcfg.from, s.mcfg.recipients, []byte(email))
+	}
 
-	if err = smtp.SendMail(addr, auth, s.mcfg.from, s.mcfg.recipients, []byte(email)); err != nil {
+	if err = s.mcfg.password.Use(ctx, send, isAuthError); err != nil {
 		return fmt.Errorf("failed to send email: %w", err)
 	}
-	log.V(2).Infoln("email sent successfully")
+	notifiers.Debugf(ctx, "email sent successfully")
 	return nil
 }
 
-func (s *smtpNotifier) buildEmail() (string, error) {
+// isAuthError returns true iff the error is the SMTP server rejecting the credentials.
+func isAuthError(err error) bool {
+	var terr *textproto.Error
+	return errors.As(err, &terr) && terr.Code == 535
+}
+
+func (s *smtpNotifier) buildEmail(ctx context.Context) (string, error) {
 	build := s.tmplView.Build
 	logURL, err := notifiers.AddUTMParams(s.tmplView.Build.LogUrl, notifiers.EmailMedium)
 	if err != nil {
@@ -175,7 +197,7 @@ func (s *smtpNotifier) buildEmail() (string, error) {
 	build.LogUrl = logURL
 
 	body := new(bytes.Buffer)
-	if err := s.tmpl.Execute(body, s.tmplView); err != nil {
+	if err := notifiers.ExecuteTemplate(ctx, s.tmpl, body, s.tmplView); err != nil {
 		return "", err
 	}
 
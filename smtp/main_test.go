@@ -17,6 +17,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"strings"
 	"testing"
 	"text/template"
@@ -72,6 +73,14 @@ func (f *fakeSecretGetter) GetSecret(_ context.Context, _ string) (string, error
 	return password, nil
 }
 
+// equalSecretHandles compares SecretHandles by the secret they refer to.
+var equalSecretHandles = cmp.Comparer(func(a, b *notifiers.SecretHandle) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Resource() == b.Resource()
+})
+
 func TestGetMailConfig(t *testing.T) {
 
 	for _, tc := range []struct {
@@ -99,7 +108,7 @@ func TestGetMailConfig(t *testing.T) {
 			wantConfig: mailConfig{
 				server:     "smtp.example.com",
 				port:       "4040",
-				password:   password,
+				password:   notifiers.NewSecretHandle(nil, "/does/not/matter"),
 				sender:     "me@example.com",
 				from:       "another_me@example.com",
 				recipients: []string{"my-cto@example.com", "my-friend@example.com"},
@@ -132,7 +141,7 @@ func TestGetMailConfig(t *testing.T) {
 				}
 			}
 
-			if diff := cmp.Diff(tc.wantConfig, gotConfig, cmp.AllowUnexported(mailConfig{})); diff != "" {
+			if diff := cmp.Diff(tc.wantConfig, gotConfig, cmp.AllowUnexported(mailConfig{}), equalSecretHandles); diff != "" {
 				t.Errorf("unexpected diff: %v", diff)
 			}
 		})
@@ -166,7 +175,7 @@ spec:
 	wantMailConfig := mailConfig{
 		server:     "smtp.example.com",
 		port:       "587",
-		password:   password,
+		password:   notifiers.NewSecretHandle(nil, "projects/some-project/secrets/smtp-notifier-password/versions/latest"),
 		sender:     "my-notifier@example.com",
 		from:       "my-notifier-from@example.com",
 		recipients: []string{"some-eng@example.com", "me@example.com"},
@@ -184,7 +193,7 @@ spec:
 		t.Errorf("getMailConfig failed unexpectedly: %v", err)
 	}
 
-	if diff := cmp.Diff(wantMailConfig, gotMailConfig, cmp.AllowUnexported(mailConfig{})); diff != "" {
+	if diff := cmp.Diff(wantMailConfig, gotMailConfig, cmp.AllowUnexported(mailConfig{}), equalSecretHandles); diff != "" {
 		t.Errorf("gotMailConfig got unexpected diff: %s", diff)
 	}
 }
@@ -226,3 +235,21 @@ func TestDefaultEmailTemplate(t *testing.T) {
 		t.Error("missing Log URL")
 	}
 }
+
+type failingResolver struct{}
+
+func (failingResolver) Resolve(context.Context, notifiers.SecretGetter, *cbpb.Build) (map[string]string, error) {
+	return nil, errors.New("failed to resolve param \"branch\"")
+}
+
+func TestSendNotificationResolveError(t *testing.T) {
+	prd, err := notifiers.MakeCELPredicate("true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &smtpNotifier{filter: prd, br: failingResolver{}}
+	err = n.SendNotification(context.Background(), &cbpb.Build{Id: "some-id"})
+	if err == nil || !notifiers.IsPermanent(err) {
+		t.Errorf("SendNotification got error %v, want a permanent error", err)
+	}
+}